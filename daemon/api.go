@@ -24,6 +24,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"time"
 
@@ -39,6 +40,13 @@ const (
 	ADMIN_UPDATE_HOST  = "admin.host.update"
 	ADMIN_DELETE_HOST  = "admin.host.delete"
 	ADMIN_DELETE_SPACE = "admin.space.delete"
+	ADMIN_UPDATE_SPACE = "admin.space.update"
+	ADMIN_READ_SPACE   = "admin.space.read"
+	ADMIN_READ_QUOTA   = "admin.quota.read"
+	ADMIN_UPDATE_QUOTA = "admin.quota.update"
+	ADMIN_READ_USAGE   = "admin.usage.read"
+	ADMIN_EXEC_SPACE   = "admin.space.exec"
+	USER_SPACE_EXEC    = "user.space.exec"
 	USER_SPACE_CREATE  = "user.space.create"
 )
 
@@ -68,6 +76,47 @@ func getUserFromRequest(r *http.Request) (*auth.User, error) {
 	return &user, nil
 }
 
+//getSpaceFromRequest Gets the space named by the spaceid parameter. Users may only get their own spaces unless they
+//hold adminPermission. On failure, the returned int is the HTTP status that should be sent.
+func getSpaceFromRequest(r *http.Request, user *auth.User, adminPermission string) (*Space, int, error) {
+	//Get spaceid
+	spaceID := pat.Param(r, "spaceid")
+	//Make sure the spaceid is set
+	if spaceID == "" {
+		return nil, http.StatusBadRequest, errors.New("No space selected")
+	}
+
+	//Retrieve the space
+	var space Space
+	query := database.First(&space, spaceID)
+	if query.RecordNotFound() {
+		return nil, http.StatusNotFound, errors.New("Space not found")
+	}
+	if query.Error != nil {
+		return nil, http.StatusInternalServerError, errors.New("Error Retrieving Space")
+	}
+
+	//Ensure auth
+	if space.OwnerID != user.ID {
+		hasPerm, err := authProvider.CheckPermission(user.ID, adminPermission)
+		if err != nil || !hasPerm {
+			return nil, http.StatusUnauthorized, errors.New("Unauthorized")
+		}
+	}
+	return &space, http.StatusOK, nil
+}
+
+//getExecSpaceFromRequest Gets the space named by the spaceid parameter for a request that runs code in it. Writing files
+//counts as running code since any file can be written, including authorized_keys and the profile of the shell.
+//Users need USER_SPACE_EXEC for their own spaces and ADMIN_EXEC_SPACE on top of it for the spaces of others.
+func getExecSpaceFromRequest(r *http.Request, user *auth.User) (*Space, int, error) {
+	hasPerm, err := authProvider.CheckPermission(user.ID, USER_SPACE_EXEC)
+	if err != nil || !hasPerm {
+		return nil, http.StatusUnauthorized, errors.New("Unauthorized")
+	}
+	return getSpaceFromRequest(r, user, ADMIN_EXEC_SPACE)
+}
+
 //getOrchestratorInfoAPIHandler Returns OrchestratorInfo to clients
 func getOrchestratorInfoAPIHandler(w http.ResponseWriter, r *http.Request) {
 	//It is probably faster to do this just once. We will cross that bridge when we get there
@@ -76,7 +125,16 @@ func getOrchestratorInfoAPIHandler(w http.ResponseWriter, r *http.Request) {
 		SupportsCAS:        viper.GetBool("SupportsCAS"),
 		CASURL:             viper.GetString("CASURL"),
 		AllowsRegistration: viper.GetBool("AllowRegistration"),
+		RegistrationPrefix: getRegistrationUsernamePrefix(),
 		AllowsLocalLogin:   viper.GetBool("AllowLocalLogin"),
+		SupportsLDAP:       viper.GetBool("LDAPEnabled"),
+		SupportsOIDC:       viper.GetBool("OIDCEnabled"),
+	}
+	if viper.GetBool("OIDCEnabled") {
+		orcInfo.OIDCIssuerURL = viper.GetString("OIDCIssuerURL")
+	}
+	if viper.GetBool("SSHGatewayEnabled") {
+		orcInfo.SSHGatewayAddress = viper.GetString("SSHGatewayDisplayAddress")
 	}
 	jsonBytes, _ := json.Marshal(orcInfo)
 	fmt.Fprint(w, string(jsonBytes))
@@ -115,29 +173,73 @@ func postSpaceAPIHandler(w http.ResponseWriter, r *http.Request) {
 	//Let's copy the data we want. Excludes anything that does not belong.
 	var createdSpace Space
 	createdSpace.ImageID = spaceRequest.ImageID
-	createdSpace.SSHKeyID = spaceRequest.SSHKeyID
 	createdSpace.FriendlyName = spaceRequest.FriendlyName
 	createdSpace.OwnerID = user.ID
+	createdSpace.MemoryBytes = spaceRequest.MemoryBytes
+	createdSpace.CPUShares = spaceRequest.CPUShares
+	createdSpace.DiskBytes = spaceRequest.DiskBytes
+	applyDefaultSpaceResources(&createdSpace)
+	err = checkSpaceResources(createdSpace)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Invalid Request: "+err.Error()+"\n")
+		return
+	}
+	//Clients select a key by the ID they see in the API. The key has to belong to the user.
+	if spaceRequest.SSHKey != "" {
+		var key UserPublicKey
+		query := database.Where("public_id = ? AND owner_id = ?", spaceRequest.SSHKey, user.ID).First(&key)
+		if query.RecordNotFound() {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, "Invalid Request: SSH key not found\n")
+			return
+		}
+		if query.Error != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, "Internal Server Error")
+			return
+		}
+		createdSpace.SSHKeyID = key.ID
+	}
 
 	log.Infof("Got Space Creation Request from %s\n", user.Username)
+	//Hold the quota of the user until the request is over so that parallel requests are checked one at a time
+	unlockQuota := lockQuotaForUser(user.ID)
+	defer unlockQuota()
 	//Check Quota
-	isUnderQuota := checkQuotaRestrictions(user.Username)
+	isUnderQuota, quotaReason, err := checkQuotaRestrictions(database, user, createdSpace)
+	if err != nil {
+		log.Criticalf("Error checking quota for %s: %s\n", user.Username, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Internal Server Error")
+		return
+	}
 	if !isUnderQuota {
 		w.WriteHeader(http.StatusForbidden)
-		fmt.Fprint(w, "Quota Exceeded")
-		log.Warningf("Request from %s because of quota restrictions\n", user.Username)
+		fmt.Fprint(w, "Quota Exceeded: "+quotaReason)
+		log.Warningf("Denied request from %s because of quota restrictions: %s\n", user.Username, quotaReason)
 		return
 	}
 
 	//Start Creation
-	creationStatusChan := make(chan string)
+	creationStatusChan := make(chan string, 16)
 	go startSpace(database, &createdSpace, creationStatusChan)
+	//Creation carries on after a timeout or a disconnect so keep reading until it is done
+	defer func() {
+		go func() {
+			for range creationStatusChan {
+			}
+		}()
+	}()
 
 	//Start Watching Status
 	fmt.Fprint(w, "Space creation started\n")
 	for true {
 		select {
-		case responseLine := <-creationStatusChan:
+		case responseLine, open := <-creationStatusChan:
+			if !open {
+				return
+			}
 			fmt.Fprintf(w, "%s\n", responseLine)
 			if strings.HasPrefix(responseLine, "Error") || strings.HasPrefix(responseLine, "Creation Complete") {
 				return
@@ -242,6 +344,86 @@ func deleteSpaceAPIHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+//postPauseSpaceAPIHandler Handles POST /api/v1/space/:spaceid/pause
+func postPauseSpaceAPIHandler(w http.ResponseWriter, r *http.Request) {
+	//Get user and error out if it didn't work
+	user, err := getUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	space, status, err := getSpaceFromRequest(r, user, ADMIN_UPDATE_SPACE)
+	if err != nil {
+		w.WriteHeader(status)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	err = PauseSpace(database, *space)
+	if err != nil {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, "Error Pausing Space: "+err.Error())
+		return
+	}
+	fmt.Fprint(w, "OK")
+}
+
+//postResumeSpaceAPIHandler Handles POST /api/v1/space/:spaceid/resume
+func postResumeSpaceAPIHandler(w http.ResponseWriter, r *http.Request) {
+	//Get user and error out if it didn't work
+	user, err := getUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	space, status, err := getSpaceFromRequest(r, user, ADMIN_UPDATE_SPACE)
+	if err != nil {
+		w.WriteHeader(status)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	err = ResumeSpace(database, *space)
+	if err != nil {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, "Error Resuming Space: "+err.Error())
+		return
+	}
+	fmt.Fprint(w, "OK")
+}
+
+//getLifecycleAPIHandler Handles GET /api/v1/lifecycle - Reports what the lifecycle engine would do right now
+func getLifecycleAPIHandler(w http.ResponseWriter, r *http.Request) {
+	//Get user and error out if it didn't work
+	user, err := getUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	//Check permission
+	hasPerm, err := authProvider.CheckPermission(user.ID, ADMIN_READ_SPACE)
+	if err != nil || !hasPerm {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, "Unauthorized\n")
+		return
+	}
+
+	actions, err := evaluateLifecyclePolicies(database)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	jsonBytes, _ := json.Marshal(actions)
+	fmt.Fprint(w, string(jsonBytes))
+}
+
 //postDockerHostAPIHandler Handles the requests for adding a new docker host
 func postDockerHostAPIHandler(w http.ResponseWriter, r *http.Request) {
 	//Get user and error out if it didn't work
@@ -268,18 +450,26 @@ func postDockerHostAPIHandler(w http.ResponseWriter, r *http.Request) {
 	var dockerHost DockerInstance
 	err = decoder.Decode(&dockerHost)
 	if err != nil {
-		panic(err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Invalid Request: Error Decoding JSON\n")
+		return
 	}
+	//This always adds a host. Hosts are changed with PUT /api/v1/host/:hostid.
+	dockerHost.ID = 0
 
 	//Call the connection methods
-	addAndConnectToDockerInstance(database, &dockerHost)
-
+	_, err = addAndConnectToDockerInstance(database, &dockerHost)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprint(w, "Error Connecting to Host: "+err.Error())
+		return
+	}
+	log.Infof("%s added host %s(%d)\n", user.Username, dockerHost.Name, dockerHost.ID)
 	fmt.Fprint(w, "OK")
-	defer r.Body.Close()
 }
 
-//postKeyAPIHandler Handles requests to add a key to a user profile
-func postKeyAPIHandler(w http.ResponseWriter, r *http.Request) {
+//getDockerHostsAPIHandler Handles GET /api/v1/hosts - Lists all docker hosts
+func getDockerHostsAPIHandler(w http.ResponseWriter, r *http.Request) {
 	//Get user and error out if it didn't work
 	user, err := getUserFromRequest(r)
 	if err != nil {
@@ -289,114 +479,728 @@ func postKeyAPIHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	//Check permission
-	hasPerm, err := authProvider.CheckPermission(user.ID, USER_SPACE_CREATE)
+	hasPerm, err := authProvider.CheckPermission(user.ID, ADMIN_READ_HOST)
 	if err != nil || !hasPerm {
 		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, "Unauthorized\n")
 		return
 	}
 
-	//Decode body of request
+	//Hosts in the cache have live connection status so prefer those over the stored record
+	hosts := getAllDockerInstanceConfigurations(database)
+	for i, host := range hosts {
+		if cachedHost := getHostByID(host.ID); cachedHost != nil {
+			hosts[i] = copyDockerInstance(cachedHost)
+		}
+	}
+	jsonBytes, _ := json.Marshal(hosts)
+	fmt.Fprint(w, string(jsonBytes))
+}
+
+//getDockerHostAPIHandler Handles GET /api/v1/host/:hostid
+func getDockerHostAPIHandler(w http.ResponseWriter, r *http.Request) {
+	//Get user and error out if it didn't work
+	user, err := getUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	//Check permission
+	hasPerm, err := authProvider.CheckPermission(user.ID, ADMIN_READ_HOST)
+	if err != nil || !hasPerm {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, "Unauthorized\n")
+		return
+	}
+
+	var host DockerInstance
+	if database.First(&host, pat.Param(r, "hostid")).RecordNotFound() {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "Host not found\n")
+		return
+	}
+	if cachedHost := getHostByID(host.ID); cachedHost != nil {
+		host = copyDockerInstance(cachedHost)
+	}
+	jsonBytes, _ := json.Marshal(host)
+	fmt.Fprint(w, string(jsonBytes))
+}
+
+//putDockerHostAPIHandler Handles PUT /api/v1/host/:hostid - Updates a host and reconnects if the connection details changed
+func putDockerHostAPIHandler(w http.ResponseWriter, r *http.Request) {
+	//Get user and error out if it didn't work
+	user, err := getUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	//Check permission
+	hasPerm, err := authProvider.CheckPermission(user.ID, ADMIN_UPDATE_HOST)
+	if err != nil || !hasPerm {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, "Unauthorized\n")
+		return
+	}
+
+	var host DockerInstance
+	if database.First(&host, pat.Param(r, "hostid")).RecordNotFound() {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "Host not found\n")
+		return
+	}
+
+	//Decode the request
+	var hostRequest DockerInstance
 	decoder := json.NewDecoder(r.Body)
-	var newKey UserPublicKey
-	err = decoder.Decode(&newKey)
-	//If there is a decode error, then 400
+	err = decoder.Decode(&hostRequest)
 	if err != nil {
-		log.Warningf("Bad request from user: %s\n", user.Username)
 		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Invalid Request: Error Decoding JSON\n")
 		return
 	}
 
-	//Make sure the user ids match up, if not, then the request is suspicious.
-	if newKey.OwnerID != user.ID {
-		log.Criticalf("Add Key Mismatch: %s attempted to add a key to another account.\n", user.Username)
-		w.WriteHeader(http.StatusForbidden)
+	//Copy the fields that may be changed
+	host.Name = hostRequest.Name
+	host.ConnectionType = hostRequest.ConnectionType
+	host.Endpoint = hostRequest.Endpoint
+	host.CaCertPath = hostRequest.CaCertPath
+	host.ClientCertPath = hostRequest.ClientCertPath
+	host.ClientKeyPath = hostRequest.ClientKeyPath
+	host.ExternalAddress = hostRequest.ExternalAddress
+	host.ExternalDisplayAddress = hostRequest.ExternalDisplayAddress
+	host.Draining = hostRequest.Draining
+
+	err = updateDockerInstance(database, &host)
+	if err != nil {
+		log.Warningf("Error updating host %s(%d): %s\n", host.Name, host.ID, err.Error())
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprint(w, "Error Updating Host: "+err.Error())
 		return
 	}
+	log.Infof("%s updated host %s(%d)\n", user.Username, host.Name, host.ID)
+	jsonBytes, _ := json.Marshal(host)
+	fmt.Fprint(w, string(jsonBytes))
+}
 
-	err = database.Save(&newKey).Error
+//deleteDockerHostAPIHandler Handles DELETE /api/v1/host/:hostid - Spaces on the host are only removed if force=true
+func deleteDockerHostAPIHandler(w http.ResponseWriter, r *http.Request) {
+	//Get user and error out if it didn't work
+	user, err := getUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	//Check permission
+	hasPerm, err := authProvider.CheckPermission(user.ID, ADMIN_DELETE_HOST)
+	if err != nil || !hasPerm {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, "Unauthorized\n")
+		return
+	}
+
+	var host DockerInstance
+	if database.First(&host, pat.Param(r, "hostid")).RecordNotFound() {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "Host not found\n")
+		return
+	}
+
+	spaceCount, err := countSpacesOnHost(database, host.ID)
 	if err != nil {
-		log.Criticalf("Error saving to database: %s\n", err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	force := r.FormValue("force") == "true"
+	if spaceCount > 0 && !force {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "%d Spaces still live on this host. Drain the host or set force=true to remove them.\n", spaceCount)
 		return
 	}
-}
 
-//pingAPIHandler Handles the ping test endpoint
-func pingAPIHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprint(w, "PONG")
+	err = removeDockerInstance(database, host.ID, force)
+	if err != nil {
+		log.Criticalf("Error removing host %s(%d): %s\n", host.Name, host.ID, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Error Removing Host: "+err.Error())
+		return
+	}
+	log.Warningf("%s removed host %s(%d)\n", user.Username, host.Name, host.ID)
 }
 
-//getImagesAPIHandler Get images
-func getImagesAPIHandler(w http.ResponseWriter, r *http.Request) {
-	images := []SpaceImage{}
-	database.Find(&images)
-	jsonBytes, _ := json.Marshal(images)
-	fmt.Fprint(w, string(jsonBytes))
-}
+//getHostPlacementsAPIHandler Handles GET /api/v1/placements - Shows admins why hosts were chosen for spaces
+func getHostPlacementsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	//Get user and error out if it didn't work
+	user, err := getUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, err.Error())
+		return
+	}
 
-//getCASHandler Handles CAS tickets sent from clients
-func getCASHandler(w http.ResponseWriter, r *http.Request) {
-	r.ParseForm()
-	ticket := r.FormValue("ticket")
-	valResp, err := casServer.ValidateTicket(ticket)
+	//Check permission
+	hasPerm, err := authProvider.CheckPermission(user.ID, ADMIN_READ_HOST)
+	if err != nil || !hasPerm {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, "Unauthorized\n")
+		return
+	}
+
+	//Only show the placements of a single space if requested
+	query := database.Order("created_at desc").Limit(100)
+	if spaceID := r.FormValue("space_id"); spaceID != "" {
+		query = query.Where("space_id = ?", spaceID)
+	}
+	placements := []HostPlacement{}
+	err = query.Find(&placements).Error
 	if err != nil {
-		log.Warning("Error handling CAS login: " + err.Error())
-		w.WriteHeader(http.StatusForbidden)
-		fmt.Fprint(w, "Error")
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err.Error())
 		return
 	}
-	if valResp.IsValid {
-		log.Infof("Authenticated %s using CAS\n", valResp.Username)
-		user, err := authProvider.GetUser(valResp.Username)
+	jsonBytes, _ := json.Marshal(placements)
+	fmt.Fprint(w, string(jsonBytes))
+}
+
+//maxUsageSteps Limits how many steps a usage history request may ask for
+const maxUsageSteps = 1000
+
+//getUsageRangeFromRequest Reads the from, to and step parameters of a usage request.
+//from and to are RFC3339 timestamps and default to the last day. step is a duration such as 1h and defaults to an hour.
+func getUsageRangeFromRequest(r *http.Request) (time.Time, time.Time, time.Duration, error) {
+	to := time.Now()
+	from := to.Add(-24 * time.Hour)
+	step := time.Hour
+	var err error
+	if value := r.FormValue("to"); value != "" {
+		to, err = time.Parse(time.RFC3339, value)
 		if err != nil {
-			//If the internal user does not exist, make it
-			if err.Error() == "record not found" {
-				var user auth.User
-				user.Username = valResp.Username
-				user.Permissions = []auth.Permission{
-					{Permission: "user.*"},
-				}
-				user, err = authProvider.CreateUser(user)
-				if err != nil {
-					w.WriteHeader(http.StatusInternalServerError)
-					log.Criticalf("Error Creating User: %s\n", err.Error())
-					fmt.Fprint(w, "Internal Server Error")
-					return
-				}
-			} else {
-				log.Warning("Error getting user for CAS login: " + err.Error())
-				w.WriteHeader(http.StatusForbidden)
-				fmt.Fprint(w, "Error")
-				return
-			}
+			return from, to, step, errors.New("Invalid to")
 		}
-		//Generate the Session
-		session, err := authProvider.GenerateSessionKey(user.ID, false)
+		from = to.Add(-24 * time.Hour)
+	}
+	if value := r.FormValue("from"); value != "" {
+		from, err = time.Parse(time.RFC3339, value)
 		if err != nil {
-			log.Critical("Error Generating Session: " + err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprint(w, "Internal Server Error")
-			return
+			return from, to, step, errors.New("Invalid from")
+		}
+	}
+	if value := r.FormValue("step"); value != "" {
+		step, err = time.ParseDuration(value)
+		if err != nil || step <= 0 {
+			return from, to, step, errors.New("Invalid step")
 		}
-		//JSONify and send our response
-		jsonBytes, _ := json.Marshal(session)
-		fmt.Fprint(w, string(jsonBytes))
-		return
-	} else {
-		fmt.Println("Invalid Ticket")
-		w.WriteHeader(http.StatusForbidden)
-		fmt.Fprint(w, "Error")
 	}
+	if !from.Before(to) {
+		return from, to, step, errors.New("from must be before to")
+	}
+	if to.Sub(from)/step > maxUsageSteps {
+		return from, to, step, fmt.Errorf("Too many steps, at most %d are allowed", maxUsageSteps)
+	}
+	return from, to, step, nil
 }
 
-var authProvider auth.AuthProvider
+//postExecAPIHandler Handles POST /api/v1/space/:spaceid/exec - Runs a command in a space and returns its output and exit code
+func postExecAPIHandler(w http.ResponseWriter, r *http.Request) {
+	//Get user and error out if it didn't work
+	user, err := getUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, err.Error())
+		return
+	}
 
-//startAPI Starts the API server and required services such as the AuthProvider
-func startAPI() {
-	//Start auth provider
-	authProvider.Database = database
-	authProvider.SessionExpireTimeSeconds = viper.GetInt64("SessionExpirationSeconds")
-	authProvider.Startup()
+	space, status, err := getExecSpaceFromRequest(r, user)
+	if err != nil {
+		w.WriteHeader(status)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	//Decode the request
+	var execRequest ExecRequest
+	jsonDecoder := json.NewDecoder(r.Body)
+	err = jsonDecoder.Decode(&execRequest)
+	//Ensure the request is valid JSON
+	if err != nil || len(execRequest.Command) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Invalid Request: command is required\n")
+		return
+	}
+	if space.SpaceState != "running" {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, "Space is not running\n")
+		return
+	}
+
+	log.Infof("User %s is running %s in Space %s(%d)\n", user.Username, execRequest.Command[0], space.FriendlyName, space.ID)
+	result, err := runInSpace(*space, execRequest)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Error running command: "+err.Error())
+		return
+	}
+	jsonBytes, _ := json.Marshal(result)
+	fmt.Fprint(w, string(jsonBytes))
+}
+
+//getSpaceUsageAPIHandler Handles GET /api/v1/space/:spaceid/usage - Returns how much the usage of a space grew in each step of a time range
+func getSpaceUsageAPIHandler(w http.ResponseWriter, r *http.Request) {
+	//Get user and error out if it didn't work
+	user, err := getUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	space, status, err := getSpaceFromRequest(r, user, ADMIN_READ_USAGE)
+	if err != nil {
+		w.WriteHeader(status)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	from, to, step, err := getUsageRangeFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	history, err := getSpaceUsageHistory(database, space.ID, from, to, step)
+	if err != nil {
+		log.Criticalf("Error retrieving usage of space %d: %s\n", space.ID, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Internal Server Error")
+		return
+	}
+	jsonBytes, _ := json.Marshal(history)
+	fmt.Fprint(w, string(jsonBytes))
+}
+
+//getUsageAPIHandler Handles GET /api/v1/usage - Returns the combined usage of the spaces of every user or host in a time range
+func getUsageAPIHandler(w http.ResponseWriter, r *http.Request) {
+	//Get user and error out if it didn't work
+	user, err := getUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	//Check permission
+	hasPerm, err := authProvider.CheckPermission(user.ID, ADMIN_READ_USAGE)
+	if err != nil || !hasPerm {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, "Unauthorized\n")
+		return
+	}
+
+	from, to, _, err := getUsageRangeFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	groupBy := r.FormValue("group_by")
+	if groupBy == "" {
+		groupBy = "user"
+	}
+	if groupBy != "user" && groupBy != "host" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "group_by must be user or host\n")
+		return
+	}
+
+	aggregates, err := getUsageAggregates(database, from, to, groupBy)
+	if err != nil {
+		log.Criticalf("Error aggregating usage: %s\n", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Internal Server Error")
+		return
+	}
+	jsonBytes, _ := json.Marshal(aggregates)
+	fmt.Fprint(w, string(jsonBytes))
+}
+
+//getQuotaAPIHandler Handles GET /api/v1/quota - Returns the quota and current usage of the user.
+//Admins may pass user_id to see the quota of another user.
+func getQuotaAPIHandler(w http.ResponseWriter, r *http.Request) {
+	//Get user and error out if it didn't work
+	user, err := getUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	//Figure out whose quota we are looking at
+	userID := user.ID
+	if requestedID := r.FormValue("user_id"); requestedID != "" {
+		hasPerm, err := authProvider.CheckPermission(user.ID, ADMIN_READ_QUOTA)
+		if err != nil || !hasPerm {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, "Unauthorized\n")
+			return
+		}
+		parsedID, err := strconv.ParseUint(requestedID, 10, 32)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, "Invalid user_id\n")
+			return
+		}
+		userID = uint(parsedID)
+	}
+
+	var report QuotaReport
+	report.Quota, err = getQuotaForUser(database, userID)
+	if err == nil {
+		report.Usage, err = getQuotaUsageForUser(database, userID)
+	}
+	if err != nil {
+		log.Criticalf("Error retrieving quota for user %d: %s\n", userID, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Internal Server Error")
+		return
+	}
+	jsonBytes, _ := json.Marshal(report)
+	fmt.Fprint(w, string(jsonBytes))
+}
+
+//getQuotasAPIHandler Handles GET /api/v1/quotas - Lists all quota records
+func getQuotasAPIHandler(w http.ResponseWriter, r *http.Request) {
+	//Get user and error out if it didn't work
+	user, err := getUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	//Check permission
+	hasPerm, err := authProvider.CheckPermission(user.ID, ADMIN_READ_QUOTA)
+	if err != nil || !hasPerm {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, "Unauthorized\n")
+		return
+	}
+
+	quotas := []SpaceQuota{}
+	err = database.Find(&quotas).Error
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	jsonBytes, _ := json.Marshal(quotas)
+	fmt.Fprint(w, string(jsonBytes))
+}
+
+//postQuotaAPIHandler Handles POST /api/v1/quotas - Creates a quota or updates it if quota_id is set or the user or
+//permission group already has one
+func postQuotaAPIHandler(w http.ResponseWriter, r *http.Request) {
+	//Get user and error out if it didn't work
+	user, err := getUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	//Check permission
+	hasPerm, err := authProvider.CheckPermission(user.ID, ADMIN_UPDATE_QUOTA)
+	if err != nil || !hasPerm {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, "Unauthorized\n")
+		return
+	}
+
+	//Decode the request
+	var quota SpaceQuota
+	decoder := json.NewDecoder(r.Body)
+	err = decoder.Decode(&quota)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Invalid Request: Error Decoding JSON\n")
+		return
+	}
+	//A quota has to apply to someone
+	if quota.UserID == 0 && quota.Permission == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Invalid Request: user_id or permission must be set\n")
+		return
+	}
+	//A user or permission group that already has a quota gets it updated
+	existingID, err := findQuotaToUpdate(database, quota)
+	if err != nil {
+		log.Criticalf("Error finding quota: %s\n", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Internal Server Error")
+		return
+	}
+	if quota.ID == 0 {
+		quota.ID = existingID
+	} else if existingID != 0 && existingID != quota.ID {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Quota %d already applies to this user or permission\n", existingID)
+		return
+	}
+	//Make sure we are updating a quota that exists
+	if quota.ID != 0 {
+		var existing SpaceQuota
+		if database.First(&existing, quota.ID).RecordNotFound() {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, "Quota not found\n")
+			return
+		}
+		quota.CreatedAt = existing.CreatedAt
+	}
+
+	err = database.Save(&quota).Error
+	if err != nil {
+		log.Criticalf("Error saving quota: %s\n", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Internal Server Error")
+		return
+	}
+	log.Infof("%s saved quota %d\n", user.Username, quota.ID)
+	jsonBytes, _ := json.Marshal(quota)
+	fmt.Fprint(w, string(jsonBytes))
+}
+
+//deleteQuotaAPIHandler Handles DELETE /api/v1/quota/:quotaid
+func deleteQuotaAPIHandler(w http.ResponseWriter, r *http.Request) {
+	//Get user and error out if it didn't work
+	user, err := getUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	//Check permission
+	hasPerm, err := authProvider.CheckPermission(user.ID, ADMIN_UPDATE_QUOTA)
+	if err != nil || !hasPerm {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, "Unauthorized\n")
+		return
+	}
+
+	var quota SpaceQuota
+	if database.First(&quota, pat.Param(r, "quotaid")).RecordNotFound() {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "Quota not found\n")
+		return
+	}
+	err = database.Delete(&quota).Error
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	log.Infof("%s deleted quota %d\n", user.Username, quota.ID)
+}
+
+//postKeyAPIHandler Handles POST /api/v1/keys - Adds a key to a user profile and installs it in their running spaces
+func postKeyAPIHandler(w http.ResponseWriter, r *http.Request) {
+	//Get user and error out if it didn't work
+	user, err := getUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	//Check permission
+	hasPerm, err := authProvider.CheckPermission(user.ID, USER_SPACE_CREATE)
+	if err != nil || !hasPerm {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	//Decode body of request
+	decoder := json.NewDecoder(r.Body)
+	var keyRequest UserPublicKey
+	err = decoder.Decode(&keyRequest)
+	//If there is a decode error, then 400
+	if err != nil {
+		log.Warningf("Bad request from user: %s\n", user.Username)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Invalid Request: Error Decoding JSON\n")
+		return
+	}
+
+	//Make sure the user ids match up, if not, then the request is suspicious.
+	if keyRequest.OwnerID != 0 && keyRequest.OwnerID != user.ID {
+		log.Criticalf("Add Key Mismatch: %s attempted to add a key to another account.\n", user.Username)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	publicKey, comment, fingerprint, err := parsePublicKey(keyRequest.PublicKey)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Invalid Request: "+err.Error()+"\n")
+		return
+	}
+	var count int
+	database.Model(&UserPublicKey{}).Where("owner_id = ? AND fingerprint = ?", user.ID, fingerprint).Count(&count)
+	if count > 0 {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, "Key has already been added: "+fingerprint+"\n")
+		return
+	}
+
+	//Let's copy the data we want. Excludes anything that does not belong.
+	var newKey UserPublicKey
+	newKey.OwnerID = user.ID
+	newKey.Name = keyRequest.Name
+	if newKey.Name == "" {
+		newKey.Name = comment
+	}
+	newKey.PublicKey = publicKey
+	newKey.Fingerprint = fingerprint
+	newKey.PublicID, err = newPublicID()
+	if err != nil {
+		log.Criticalf("Error generating key ID: %s\n", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	err = database.Save(&newKey).Error
+	if err != nil {
+		log.Criticalf("Error saving to database: %s\n", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Infof("%s added key %s\n", user.Username, fingerprint)
+	go syncKeysToSpaces(database, user.ID)
+
+	w.WriteHeader(http.StatusCreated)
+	jsonBytes, _ := json.Marshal(newKey)
+	fmt.Fprint(w, string(jsonBytes))
+}
+
+//getKeysAPIHandler Handles GET /api/v1/keys - Lists the keys of the user
+func getKeysAPIHandler(w http.ResponseWriter, r *http.Request) {
+	//Get user and error out if it didn't work
+	user, err := getUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	keys := []UserPublicKey{}
+	err = database.Where("owner_id = ?", user.ID).Order("id asc").Find(&keys).Error
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	jsonBytes, _ := json.Marshal(keys)
+	fmt.Fprint(w, string(jsonBytes))
+}
+
+//deleteKeyAPIHandler Handles DELETE /api/v1/key/:keyid - Removes a key from a user profile and from their running spaces
+func deleteKeyAPIHandler(w http.ResponseWriter, r *http.Request) {
+	//Get user and error out if it didn't work
+	user, err := getUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	var key UserPublicKey
+	query := database.Where("public_id = ? AND owner_id = ?", pat.Param(r, "keyid"), user.ID).First(&key)
+	if query.RecordNotFound() {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "Key not found\n")
+		return
+	}
+	if query.Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, query.Error.Error())
+		return
+	}
+	err = database.Delete(&key).Error
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	log.Infof("%s deleted key %s\n", user.Username, key.Fingerprint)
+	go syncKeysToSpaces(database, user.ID)
+}
+
+//pingAPIHandler Handles the ping test endpoint
+func pingAPIHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, "PONG")
+}
+
+//getImagesAPIHandler Get images
+func getImagesAPIHandler(w http.ResponseWriter, r *http.Request) {
+	images := []SpaceImage{}
+	database.Find(&images)
+	jsonBytes, _ := json.Marshal(images)
+	fmt.Fprint(w, string(jsonBytes))
+}
+
+//getCASHandler Handles CAS tickets sent from clients
+func getCASHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	ticket := r.FormValue("ticket")
+	//Validating with CAS 3.0 is the only way to get the attributes of the user
+	if viper.GetBool("CASReleaseAttributes") {
+		handleCASAttributeLogin(w, r, ticket)
+		return
+	}
+	valResp, err := casServer.ValidateTicket(ticket)
+	if err != nil {
+		log.Warning("Error handling CAS login: " + err.Error())
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "Error")
+		return
+	}
+	if !valResp.IsValid {
+		log.Warningf("Invalid CAS ticket from %s\n", r.RemoteAddr)
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "Error")
+		return
+	}
+	username, err := normalizeExternalUsername(valResp.Username)
+	if err != nil {
+		log.Warningf("CAS user %q has an invalid username\n", valResp.Username)
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, err.Error()+"\n")
+		return
+	}
+	log.Infof("Authenticated %s using CAS\n", username)
+	user, err := provisionExternalUser(ExternalUser{Username: username, Issuer: casIssuer, Subject: username})
+	if err != nil {
+		log.Warningf("Error provisioning CAS user %s: %s\n", valResp.Username, err.Error())
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "Error")
+		return
+	}
+	sendNewSession(w, user, false)
+}
+
+var authProvider auth.AuthProvider
+
+//startAPI Starts the API server and required services such as the AuthProvider
+func startAPI() {
+	//Start auth provider
+	authProvider.Database = database
+	authProvider.SessionExpireTimeSeconds = viper.GetInt64("SessionExpirationSeconds")
+	authProvider.Startup()
 
 	//Ensure admin user exists
 	ensureAdminUser()
@@ -432,14 +1236,41 @@ func startAPI() {
 	}
 
 	mux := goji.NewMux()
+	mux.Use(metricsMiddleware)
 	mux.HandleFunc(pat.Post("/api/v1/spaces"), postSpaceAPIHandler)
 	mux.HandleFunc(pat.Get("/api/v1/spaces"), getSpacesAPIHandler)
 	mux.HandleFunc(pat.Delete("/api/v1/space/:spaceid"), deleteSpaceAPIHandler)
+	mux.HandleFunc(pat.Post("/api/v1/space/:spaceid/pause"), postPauseSpaceAPIHandler)
+	mux.HandleFunc(pat.Post("/api/v1/space/:spaceid/resume"), postResumeSpaceAPIHandler)
+	mux.HandleFunc(pat.Get("/api/v1/space/:spaceid/usage"), getSpaceUsageAPIHandler)
+	mux.HandleFunc(pat.Get("/api/v1/space/:spaceid/terminal"), getTerminalAPIHandler)
+	mux.HandleFunc(pat.Post("/api/v1/space/:spaceid/exec"), postExecAPIHandler)
+	mux.HandleFunc(pat.Put("/api/v1/space/:spaceid/files"), putFilesAPIHandler)
+	mux.HandleFunc(pat.Get("/api/v1/space/:spaceid/files"), getFilesAPIHandler)
+	mux.HandleFunc(pat.Get("/api/v1/space/:spaceid/logs"), getSpaceLogsAPIHandler)
+	mux.HandleFunc(pat.Get("/api/v1/usage"), getUsageAPIHandler)
+	mux.HandleFunc(pat.Get("/api/v1/lifecycle"), getLifecycleAPIHandler)
 	mux.HandleFunc(pat.Post("/api/v1/hosts"), postDockerHostAPIHandler)
+	mux.HandleFunc(pat.Get("/api/v1/hosts"), getDockerHostsAPIHandler)
+	mux.HandleFunc(pat.Get("/api/v1/host/:hostid"), getDockerHostAPIHandler)
+	mux.HandleFunc(pat.Put("/api/v1/host/:hostid"), putDockerHostAPIHandler)
+	mux.HandleFunc(pat.Delete("/api/v1/host/:hostid"), deleteDockerHostAPIHandler)
+	mux.HandleFunc(pat.Get("/api/v1/placements"), getHostPlacementsAPIHandler)
 	mux.HandleFunc(pat.Get("/api/v1/images"), getImagesAPIHandler)
 	mux.HandleFunc(pat.Get("/api/v1/ping"), pingAPIHandler)
 	mux.HandleFunc(pat.Post("/api/v1/keys"), postKeyAPIHandler)
+	mux.HandleFunc(pat.Get("/api/v1/keys"), getKeysAPIHandler)
+	mux.HandleFunc(pat.Delete("/api/v1/key/:keyid"), deleteKeyAPIHandler)
+	mux.HandleFunc(pat.Get("/api/v1/quota"), getQuotaAPIHandler)
+	mux.HandleFunc(pat.Get("/api/v1/quotas"), getQuotasAPIHandler)
+	mux.HandleFunc(pat.Post("/api/v1/quotas"), postQuotaAPIHandler)
+	mux.HandleFunc(pat.Delete("/api/v1/quota/:quotaid"), deleteQuotaAPIHandler)
 	mux.HandleFunc(pat.Get("/caslogin"), getCASHandler)
+	mux.HandleFunc(pat.Post("/login"), postLoginHandler)
+	mux.HandleFunc(pat.Post("/register"), postRegisterHandler)
+	mux.HandleFunc(pat.Post("/ldaplogin"), postLDAPLoginHandler)
+	mux.HandleFunc(pat.Get("/oidclogin"), getOIDCLoginHandler)
+	mux.HandleFunc(pat.Get("/oidccallback"), getOIDCCallbackHandler)
 	mux.HandleFunc(pat.Get("/orchestratorinfo"), getOrchestratorInfoAPIHandler)
 	log.Info("Starting API Mux...")
 	srv := &http.Server{Addr: ":8080", Handler: mux}
@@ -457,21 +1288,3 @@ func startAPI() {
 
 	log.Info("Server gracefully stopped")
 }
-
-func ensureAdminUser() {
-	/*adminUser := auth.User{
-		FirstName: "Default",
-		LastName: "Administrator",
-		Username: "admin",
-		Permissions: []auth.Permission{
-			{Permission: "*.*"},
-		},
-	}*/
-
-}
-
-//checkQuotaRestrictions Returns true if the user has not yet hit their quota on Spaces
-func checkQuotaRestrictions(userID string) bool {
-	//TODO: This should do the thing
-	return true
-}
@@ -1,14 +1,208 @@
 package userspaced
 
 import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
 	"github.com/spf13/viper"
 	"github.com/twa16/go-cas/client"
 )
 
 var casServer gocas.CASServerConfig
 
+//errInvalidCASTicket Returned when CAS does not accept a ticket
+var errInvalidCASTicket = errors.New("Invalid Ticket")
+
+//casHTTPClient Used to validate tickets when attributes are released
+var casHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+//casServiceResponse The response of the CAS 3.0 /p3/serviceValidate endpoint
+type casServiceResponse struct {
+	XMLName xml.Name `xml:"serviceResponse"`
+	Success *struct {
+		User       string `xml:"user"`
+		Attributes struct {
+			Values []struct {
+				XMLName xml.Name
+				Value   string `xml:",chardata"`
+			} `xml:",any"`
+		} `xml:"attributes"`
+	} `xml:"authenticationSuccess"`
+	Failure *struct {
+		Code    string `xml:"code,attr"`
+		Message string `xml:",chardata"`
+	} `xml:"authenticationFailure"`
+}
+
 //initCAS Initializes connection to CAS server for ticket validation
 func initCAS() {
 	casServer.ServerHostname = viper.GetString("CASURL")
 	casServer.IgnoreSSLErrors = false
 }
+
+//validateCASTicketWithAttributes Validates a ticket with the CAS 3.0 protocol, which releases the attributes of the user.
+//The service has to be the one the ticket was issued for.
+func validateCASTicketWithAttributes(ticket string, service string) (*ExternalUser, map[string][]string, error) {
+	if ticket == "" {
+		return nil, nil, errInvalidCASTicket
+	}
+	query := url.Values{}
+	query.Set("ticket", ticket)
+	query.Set("service", service)
+	response, err := casHTTPClient.Get(strings.TrimRight(viper.GetString("CASURL"), "/") + "/p3/serviceValidate?" + query.Encode())
+	if err != nil {
+		return nil, nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, nil, errors.New("CAS returned " + response.Status)
+	}
+	var serviceResponse casServiceResponse
+	err = xml.NewDecoder(response.Body).Decode(&serviceResponse)
+	if err != nil {
+		return nil, nil, err
+	}
+	if serviceResponse.Failure != nil {
+		log.Debugf("CAS rejected ticket: %s %s\n", serviceResponse.Failure.Code, strings.TrimSpace(serviceResponse.Failure.Message))
+		return nil, nil, errInvalidCASTicket
+	}
+	if serviceResponse.Success == nil || strings.TrimSpace(serviceResponse.Success.User) == "" {
+		return nil, nil, errInvalidCASTicket
+	}
+
+	//Attributes with several values are sent as repeated elements
+	attributes := make(map[string][]string)
+	for _, attribute := range serviceResponse.Success.Attributes.Values {
+		name := strings.ToLower(attribute.XMLName.Local)
+		attributes[name] = append(attributes[name], strings.TrimSpace(attribute.Value))
+	}
+	username, err := normalizeExternalUsername(serviceResponse.Success.User)
+	if err != nil {
+		log.Warningf("CAS user %q has an invalid username\n", serviceResponse.Success.User)
+		return nil, nil, err
+	}
+	user := &ExternalUser{
+		Username:  username,
+		Issuer:    casIssuer,
+		Subject:   username,
+		Email:     getCASAttribute(attributes, viper.GetString("CASEmailAttribute")),
+		FirstName: getCASAttribute(attributes, viper.GetString("CASFirstNameAttribute")),
+		LastName:  getCASAttribute(attributes, viper.GetString("CASLastNameAttribute")),
+	}
+	//Fall back to splitting the display name if the names are not released on their own
+	displayName := getCASAttribute(attributes, viper.GetString("CASDisplayNameAttribute"))
+	if user.FirstName == "" && user.LastName == "" && displayName != "" {
+		separator := strings.LastIndex(displayName, " ")
+		if separator > 0 {
+			user.FirstName = displayName[:separator]
+			user.LastName = displayName[separator+1:]
+		} else {
+			user.FirstName = displayName
+		}
+	}
+	return user, attributes, nil
+}
+
+//getCASAttribute Returns the first value of an attribute or an empty string if it was not released
+func getCASAttribute(attributes map[string][]string, name string) string {
+	values := attributes[strings.ToLower(name)]
+	if name == "" || len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+//matchCASAttributePermissions Returns the permissions of the attribute=value pairs in a mapping that a set of attributes
+//matches, and every permission in the mapping. The pairs are compared without regard to case.
+func matchCASAttributePermissions(attributes map[string][]string, mapping map[string][]string) ([]string, []string) {
+	var all []string
+	var matched []string
+	for key, permissions := range mapping {
+		all = append(all, permissions...)
+		separator := strings.Index(key, "=")
+		if separator <= 0 {
+			continue
+		}
+		for _, value := range attributes[key[:separator]] {
+			if strings.ToLower(value) == key[separator+1:] {
+				matched = append(matched, permissions...)
+				break
+			}
+		}
+	}
+	return matched, all
+}
+
+//getCASAttributePermissions Returns the permissions that CAS logins manage, and which of them a set of attributes grants.
+//Users get CASDefaultPermissions plus whatever CASAttributePermissions grants them. Pairs in
+//CASAttributeDefaultPermissions replace the defaults instead, which is how guests are given less than user.*.
+func getCASAttributePermissions(attributes map[string][]string) ([]string, []string) {
+	//viper lower cases the keys of maps
+	defaults := viper.GetStringSlice("CASDefaultPermissions")
+	replacements, allReplacements := matchCASAttributePermissions(attributes, viper.GetStringMapStringSlice("CASAttributeDefaultPermissions"))
+	additions, allAdditions := matchCASAttributePermissions(attributes, viper.GetStringMapStringSlice("CASAttributePermissions"))
+
+	managed := append([]string{"user.*"}, defaults...)
+	managed = append(managed, allReplacements...)
+	managed = append(managed, allAdditions...)
+	if len(replacements) > 0 {
+		return managed, append(replacements, additions...)
+	}
+	//defaults may be the slice viper holds so it is not appended to
+	return managed, append(append([]string{}, defaults...), additions...)
+}
+
+//handleCASAttributeLogin Logs in with a CAS ticket and applies the released attributes to the profile and permissions
+//of the user. This happens on every login so changes in CAS, such as someone leaving a club, take effect.
+func handleCASAttributeLogin(w http.ResponseWriter, r *http.Request, ticket string) {
+	//Only the configured service is trusted. Taking it from the request would let a ticket issued to any other service
+	//that trusts the same CAS server be replayed here.
+	service := viper.GetString("CASServiceURL")
+	if service == "" {
+		log.Critical("CASServiceURL must be set to validate CAS tickets with attributes")
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "CAS login is not configured\n")
+		return
+	}
+	casUser, attributes, err := validateCASTicketWithAttributes(ticket, service)
+	if err == errInvalidExternalUsername {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, err.Error()+"\n")
+		return
+	}
+	if err == errInvalidCASTicket {
+		log.Warningf("Invalid CAS ticket from %s\n", r.RemoteAddr)
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "Error")
+		return
+	}
+	if err != nil {
+		log.Warning("Error handling CAS login: " + err.Error())
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprint(w, "Error contacting the CAS server\n")
+		return
+	}
+	log.Infof("Authenticated %s using CAS\n", casUser.Username)
+
+	user, err := provisionExternalUser(*casUser)
+	if err != nil {
+		log.Warningf("Error provisioning CAS user %s: %s\n", casUser.Username, err.Error())
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "Error")
+		return
+	}
+	managed, granted := getCASAttributePermissions(attributes)
+	err = syncManagedPermissions(user.ID, managed, granted)
+	if err != nil {
+		log.Criticalf("Error updating permissions of %s: %s\n", user.Username, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Internal Server Error")
+		return
+	}
+	sendNewSession(w, user, false)
+}
@@ -0,0 +1,161 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package userspaced
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	auth "github.com/twa16/go-auth"
+)
+
+func TestGetCASAttributePermissions(t *testing.T) {
+	viper.Set("CASDefaultPermissions", []string{"user.*"})
+	viper.Set("CASAttributePermissions", map[string][]string{
+		"edupersonaffiliation=faculty": {"admin.space.read"},
+		"groups=club-officers":         {"admin.usage.read"},
+	})
+	viper.Set("CASAttributeDefaultPermissions", map[string][]string{
+		"edupersonaffiliation=guest": {"user.space.exec"},
+	})
+	defer viper.Set("CASDefaultPermissions", nil)
+	defer viper.Set("CASAttributePermissions", nil)
+	defer viper.Set("CASAttributeDefaultPermissions", nil)
+
+	tests := []struct {
+		name       string
+		attributes map[string][]string
+		granted    []string
+	}{
+		{"no attributes", nil, []string{"user.*"}},
+		//Mapped permissions come on top of the defaults
+		{"faculty", map[string][]string{"edupersonaffiliation": {"Faculty"}}, []string{"admin.space.read", "user.*"}},
+		{"several values", map[string][]string{"edupersonaffiliation": {"staff", "faculty"}, "groups": {"club-officers"}}, []string{"admin.space.read", "admin.usage.read", "user.*"}},
+		//Guests get less than the defaults, plus anything else they match
+		{"guest", map[string][]string{"edupersonaffiliation": {"guest"}}, []string{"user.space.exec"}},
+		{"guest officer", map[string][]string{"edupersonaffiliation": {"guest"}, "groups": {"club-officers"}}, []string{"admin.usage.read", "user.space.exec"}},
+	}
+	for _, test := range tests {
+		managed, granted := getCASAttributePermissions(test.attributes)
+		sort.Strings(managed)
+		sort.Strings(granted)
+		if strings.Join(managed, ",") != "admin.space.read,admin.usage.read,user.*,user.*,user.space.exec" {
+			t.Errorf("%s: every mapped permission should be managed, got %v", test.name, managed)
+		}
+		if strings.Join(granted, ",") != strings.Join(test.granted, ",") {
+			t.Errorf("%s: expected %v to be granted, got %v", test.name, test.granted, granted)
+		}
+	}
+	//The defaults held by viper are left alone
+	if defaults := viper.GetStringSlice("CASDefaultPermissions"); strings.Join(defaults, ",") != "user.*" {
+		t.Errorf("CASDefaultPermissions changed to %v", defaults)
+	}
+}
+
+func TestHandleCASAttributeLogin(t *testing.T) {
+	db := newTestDatabase(t)
+	useTestAuthProvider(t, db)
+	//A CAS server that issued ST-1 for the daemon and ST-2 for another service
+	casServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tickets := map[string]string{"ST-1": "https://userspace.example.edu/", "ST-2": "https://other.example.edu/"}
+		query := r.URL.Query()
+		if r.URL.Path != "/p3/serviceValidate" || tickets[query.Get("ticket")] != query.Get("service") {
+			fmt.Fprint(w, `<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas"><cas:authenticationFailure code="INVALID_SERVICE">Invalid</cas:authenticationFailure></cas:serviceResponse>`)
+			return
+		}
+		fmt.Fprint(w, `<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas"><cas:authenticationSuccess><cas:user>alice</cas:user>`+
+			`<cas:attributes><cas:mail>alice@example.edu</cas:mail><cas:eduPersonAffiliation>faculty</cas:eduPersonAffiliation></cas:attributes>`+
+			`</cas:authenticationSuccess></cas:serviceResponse>`)
+	}))
+	defer casServer.Close()
+	viper.Set("CASURL", casServer.URL)
+	viper.Set("CASEmailAttribute", "mail")
+	viper.Set("CASDefaultPermissions", []string{"user.*"})
+	viper.Set("CASAttributePermissions", map[string][]string{"edupersonaffiliation=faculty": {"admin.space.read"}})
+	defer viper.Set("CASURL", nil)
+	defer viper.Set("CASEmailAttribute", nil)
+	defer viper.Set("CASDefaultPermissions", nil)
+	defer viper.Set("CASAttributePermissions", nil)
+	defer viper.Set("CASServiceURL", nil)
+
+	tests := []struct {
+		name       string
+		serviceURL string
+		query      string
+		status     int
+	}{
+		//Nothing is trusted until the service is configured
+		{"no service", "", "ticket=ST-1", http.StatusInternalServerError},
+		//A ticket for another service is not accepted even if the client names that service
+		{"other service", "https://userspace.example.edu/", "ticket=ST-2&service=https://other.example.edu/", http.StatusForbidden},
+		{"valid ticket", "https://userspace.example.edu/", "ticket=ST-1&service=https://other.example.edu/", http.StatusOK},
+	}
+	for _, test := range tests {
+		viper.Set("CASServiceURL", test.serviceURL)
+		request := httptest.NewRequest("GET", "/caslogin?"+test.query, nil)
+		recorder := httptest.NewRecorder()
+		handleCASAttributeLogin(recorder, request, request.FormValue("ticket"))
+		if recorder.Code != test.status {
+			t.Errorf("%s: expected %d, got %d %s", test.name, test.status, recorder.Code, recorder.Body.String())
+		}
+	}
+
+	user, err := authProvider.GetUser("alice")
+	if err != nil {
+		t.Fatalf("User was not created: %s", err.Error())
+	}
+	if user.Email != "alice@example.edu" {
+		t.Errorf("Email was not taken from the attributes: %q", user.Email)
+	}
+	var permissions []auth.Permission
+	db.Where("auth_user_id = ?", user.ID).Order("permission asc").Find(&permissions)
+	var held []string
+	for _, permission := range permissions {
+		held = append(held, permission.Permission)
+	}
+	if strings.Join(held, ",") != "admin.space.read,user.*" {
+		t.Errorf("Expected the defaults and the faculty permissions, got %v", held)
+	}
+}
+
+func TestValidateCASTicketNormalizesUsernames(t *testing.T) {
+	//Each ticket was issued to a different CAS user
+	users := map[string]string{"ST-1": "Alice", "ST-2": "bob smith", "ST-3": "carol@example.edu"}
+	casServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas"><cas:authenticationSuccess>`+
+			`<cas:user>%s</cas:user></cas:authenticationSuccess></cas:serviceResponse>`, users[r.URL.Query().Get("ticket")])
+	}))
+	defer casServer.Close()
+	viper.Set("CASURL", casServer.URL)
+	defer viper.Set("CASURL", nil)
+
+	user, _, err := validateCASTicketWithAttributes("ST-1", "https://userspace.example.edu/")
+	if err != nil || user.Username != "alice" || user.Subject != "alice" || user.Issuer != casIssuer {
+		t.Errorf("ST-1: got %+v, %v", user, err)
+	}
+	for _, ticket := range []string{"ST-2", "ST-3"} {
+		user, _, err = validateCASTicketWithAttributes(ticket, "https://userspace.example.edu/")
+		if err != errInvalidExternalUsername {
+			t.Errorf("%s: got %+v, %v", ticket, user, err)
+		}
+	}
+}
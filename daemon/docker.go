@@ -17,15 +17,19 @@
 package userspaced
 
 import (
+	"bytes"
 	"context"
+	"fmt"
 	"math/rand"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/fsouza/go-dockerclient"
 	"github.com/jinzhu/gorm"
-	"github.com/k0kubun/pp"
 	"github.com/pkg/errors"
+	"github.com/spf13/viper"
 )
 
 //Contains running instances of docker hosts
@@ -35,10 +39,13 @@ var DockerInstances []*DockerInstance
 func initDockerHosts(db *gorm.DB) {
 	instances := getAllDockerInstanceConfigurations(db)
 	log.Infof("Initiating Connections to %d Docker Host(s)\n", len(instances))
-	for _, instance := range instances {
-		_, err := addAndConnectToDockerInstance(db, &instance)
+	for i := range instances {
+		instance := &instances[i]
+		_, err := addAndConnectToDockerInstance(db, instance)
 		if err != nil {
-			log.Critical("Adding Docker Host %s Failed: %s\n", instance.Name, err.Error())
+			log.Criticalf("Adding Docker Host %s Failed: %s\n", instance.Name, err.Error())
+			//Keep the host in the cache so the health monitor can reconnect to it
+			cacheDisconnectedDockerInstance(instance, err)
 			continue
 		}
 		log.Infof("Connected to Docker Host: %s\n", instance.Name)
@@ -46,19 +53,19 @@ func initDockerHosts(db *gorm.DB) {
 	log.Info("Initialized All Docker Hosts!")
 }
 
-var dockerInstanceSliceLock sync.Mutex
+var dockerInstanceSliceLock sync.RWMutex
 
 //addAndConnectToDockerInstance Adds a new host to in-memory cache and establishes connection to it.
 func addAndConnectToDockerInstance(db *gorm.DB, instance *DockerInstance) (*DockerInstance, error) {
-	//It is technically possible for two hosts to be added at once, so let's lock the slice
-	dockerInstanceSliceLock.Lock()
-	defer dockerInstanceSliceLock.Unlock()
+	//Connecting can take as long as the dial timeout so the cache is only locked to add the host
 	_, err := startDockerClient(instance)
 	if err != nil {
-		log.Fatalf("Error Starting Docker Client: %s\n", err.Error())
+		log.Criticalf("Error Starting Docker Client: %s\n", err.Error())
 		return nil, err
 	}
 	db.Save(&instance)
+	dockerInstanceSliceLock.Lock()
+	defer dockerInstanceSliceLock.Unlock()
 	DockerInstances = append(DockerInstances, instance)
 	return instance, nil
 }
@@ -70,8 +77,10 @@ func getAllDockerInstanceConfigurations(db *gorm.DB) []DockerInstance {
 	return configs
 }
 
-//getHostByID Helper method that gets a host from the db by id
+//getHostByID Helper method that gets a host from the cache by id
 func getHostByID(hostID uint) *DockerInstance {
+	dockerInstanceSliceLock.RLock()
+	defer dockerInstanceSliceLock.RUnlock()
 	for i, instance := range DockerInstances {
 		if instance.ID == hostID {
 			return DockerInstances[i]
@@ -80,6 +89,124 @@ func getHostByID(hostID uint) *DockerInstance {
 	return nil
 }
 
+//getCachedDockerInstances Returns a copy of the host cache that is safe to iterate while hosts are being changed
+func getCachedDockerInstances() []*DockerInstance {
+	dockerInstanceSliceLock.RLock()
+	defer dockerInstanceSliceLock.RUnlock()
+	instances := make([]*DockerInstance, len(DockerInstances))
+	copy(instances, DockerInstances)
+	return instances
+}
+
+//updateDockerInstance Saves changes to a host. If the connection details changed, a new client is started and
+//swapped into the cache. The old configuration is kept if the new client cannot be started.
+func updateDockerInstance(db *gorm.DB, instance *DockerInstance) error {
+	err := updateCachedDockerInstance(instance)
+	if err != nil {
+		return err
+	}
+	err = db.Save(instance).Error
+	if err != nil {
+		return err
+	}
+	//Keep the addresses that users see in sync with the host. The cache is unlocked by now, which matters since
+	//moving the proxies looks the host up again.
+	var spaces []Space
+	db.Where("host_id = ?", instance.ID).Find(&spaces)
+	for _, space := range spaces {
+		err = db.Model(&SpacePortLink{}).Where("space_id = ?", space.ID).Updates(map[string]interface{}{
+			"external_address": instance.ExternalAddress,
+			"display_address":  instance.ExternalDisplayAddress,
+		}).Error
+		if err != nil {
+			return err
+		}
+		//The proxies listen on the external address so they have to be moved as well
+		if !space.Archived {
+			removeSpaceProxies(db, space.ID)
+			ensureSpaceProxies(db, space)
+		}
+	}
+	return nil
+}
+
+//updateCachedDockerInstance Puts the new configuration of a host into the cache. Connecting can take as long as the
+//dial timeout, so the new client is started before the cache is locked and the lock is only held for the swap.
+func updateCachedDockerInstance(instance *DockerInstance) error {
+	cached := getHostByID(instance.ID)
+	if cached == nil {
+		//The host is not connected, so any working configuration is an improvement
+		_, err := startDockerClient(instance)
+		if err != nil {
+			return err
+		}
+	} else if cached.ConnectionType != instance.ConnectionType ||
+		cached.Endpoint != instance.Endpoint ||
+		cached.CaCertPath != instance.CaCertPath ||
+		cached.ClientCertPath != instance.ClientCertPath ||
+		cached.ClientKeyPath != instance.ClientKeyPath {
+		log.Infof("Connection details of host %s(%d) changed. Reconnecting.\n", instance.Name, instance.ID)
+		_, err := startDockerClient(instance)
+		if err != nil {
+			return err
+		}
+	} else {
+		health := copyDockerInstance(cached)
+		instance.DockerClient = health.DockerClient
+		instance.IsConnected = health.IsConnected
+		instance.LastSeen = health.LastSeen
+		instance.LastError = health.LastError
+		instance.LastErrorMessage = health.LastErrorMessage
+	}
+
+	dockerInstanceSliceLock.Lock()
+	defer dockerInstanceSliceLock.Unlock()
+	for i, cached := range DockerInstances {
+		if cached.ID == instance.ID {
+			DockerInstances[i] = instance
+			return nil
+		}
+	}
+	DockerInstances = append(DockerInstances, instance)
+	return nil
+}
+
+//removeDockerInstance Removes a host from the cache and the database. If force is false, the host is only removed
+//if no spaces live on it. If force is true, the spaces on the host are removed first. Archived spaces keep their records.
+func removeDockerInstance(db *gorm.DB, hostID uint, force bool) error {
+	var spaces []Space
+	err := spacesOnHost(db, hostID).Find(&spaces).Error
+	if err != nil {
+		return err
+	}
+	if len(spaces) > 0 && !force {
+		return fmt.Errorf("%d Spaces still live on this host", len(spaces))
+	}
+	host := getHostByID(hostID)
+	for _, space := range spaces {
+		//The containers on a dead host cannot be removed so only drop the records
+		if !isHostConnected(host) {
+			log.Warningf("Dropping record of space %d from unreachable host %d\n", space.ID, hostID)
+			err = db.Delete(&space).Error
+		} else {
+			err = RemoveSpace(db, space)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	dockerInstanceSliceLock.Lock()
+	defer dockerInstanceSliceLock.Unlock()
+	for i, cached := range DockerInstances {
+		if cached.ID == hostID {
+			DockerInstances = append(DockerInstances[:i], DockerInstances[i+1:]...)
+			break
+		}
+	}
+	return db.Delete(&DockerInstance{ID: hostID}).Error
+}
+
 //getImageByID Helper method that gets an image by id
 func getImageByID(db *gorm.DB, imageID uint) SpaceImage {
 	var image SpaceImage
@@ -135,35 +262,123 @@ func isPortOpen(db *gorm.DB, externalAddress string, port uint16) bool {
 	return db.Where(&SpacePortLink{ExternalAddress: externalAddress, ExternalPort: port}).First(&holder).RecordNotFound()
 }
 
-//TODO: Make this do the thing. Returns first instance since when this was written spaces weren't created yet. This will probably be done with raw sql.
-//selectLeastOccupiedHost Returns the host that has the fewest number of instances.
-func selectLeastOccupiedHost(db *gorm.DB) (*DockerInstance, error) {
-	if len(DockerInstances) == 0 {
-		return nil, errors.New("No Hosts Have Been Added!")
+//spacesOnHost Selects the spaces that live on a host. Archived spaces have no container so they do not count.
+func spacesOnHost(db *gorm.DB, hostID uint) *gorm.DB {
+	return db.Model(&Space{}).Where("host_id = ? AND archived = ?", hostID, false)
+}
+
+//countSpacesOnHost Returns the number of spaces that are not archived and live on a host
+func countSpacesOnHost(db *gorm.DB, hostID uint) (int, error) {
+	var count int
+	err := spacesOnHost(db, hostID).Count(&count).Error
+	return count, err
+}
+
+//getHostCapacity Computes the relative capacity of a host using the weights in the config.
+//If both weights are zero or the host does not report its resources, every host has a capacity of 1.
+func getHostCapacity(instance *DockerInstance) (float64, string) {
+	cpuWeight := viper.GetFloat64("SchedulerCPUWeight")
+	memoryWeight := viper.GetFloat64("SchedulerMemoryWeight")
+	if cpuWeight <= 0 && memoryWeight <= 0 {
+		return 1, "resources not weighed"
+	}
+	client, _ := getHostClient(instance)
+	info, err := client.Info()
+	if err != nil {
+		log.Warningf("Could not get info from host %s: %s\n", instance.Name, err.Error())
+		return 1, "resources unavailable"
+	}
+	memoryGB := float64(info.MemTotal) / (1024 * 1024 * 1024)
+	capacity := cpuWeight*float64(info.NCPU) + memoryWeight*memoryGB
+	if capacity <= 0 {
+		return 1, "resources unavailable"
+	}
+	return capacity, fmt.Sprintf("%d cpus, %.1f GB memory", info.NCPU, memoryGB)
+}
+
+//selectLeastOccupiedHost Returns the connected host that has the lowest number of spaces relative to its capacity.
+//The returned HostPlacement describes why the host was chosen and is not yet saved.
+func selectLeastOccupiedHost(db *gorm.DB) (*DockerInstance, *HostPlacement, error) {
+	instances := getCachedDockerInstances()
+	if len(instances) == 0 {
+		return nil, nil, errors.New("No Hosts Have Been Added!")
+	}
+	var selectedHost *DockerInstance
+	var selectedScore float64
+	var candidates []string
+	var selectedReason string
+	for _, instance := range instances {
+		if !isHostConnected(instance) {
+			candidates = append(candidates, fmt.Sprintf("%s(%d): skipped, not connected", instance.Name, instance.ID))
+			continue
+		}
+		if instance.Draining {
+			candidates = append(candidates, fmt.Sprintf("%s(%d): skipped, draining", instance.Name, instance.ID))
+			continue
+		}
+		spaceCount, err := countSpacesOnHost(db, instance.ID)
+		if err != nil {
+			log.Warningf("Error counting spaces on host %s: %s\n", instance.Name, err.Error())
+			candidates = append(candidates, fmt.Sprintf("%s(%d): skipped, %s", instance.Name, instance.ID, err.Error()))
+			continue
+		}
+		capacity, resources := getHostCapacity(instance)
+		score := float64(spaceCount) / capacity
+		reason := fmt.Sprintf("%s(%d): %d spaces, %s, score %.3f", instance.Name, instance.ID, spaceCount, resources, score)
+		candidates = append(candidates, reason)
+		if selectedHost == nil || score < selectedScore {
+			selectedHost = instance
+			selectedScore = score
+			selectedReason = reason
+		}
+	}
+	if selectedHost == nil {
+		return nil, nil, errors.New("No Connected Hosts Available")
+	}
+	placement := HostPlacement{
+		HostID:     selectedHost.ID,
+		Score:      selectedScore,
+		Reason:     "Selected " + selectedReason,
+		Candidates: strings.Join(candidates, "; "),
 	}
-	return DockerInstances[0], nil
+	log.Infof("Scheduler: %s [%s]\n", placement.Reason, placement.Candidates)
+	return selectedHost, &placement, nil
 }
 
 //startSpace Creates and starts a new space
 func startSpace(db *gorm.DB, space *Space, creationStatusChan chan string) (error, *Space) {
+	//Closed so the reader knows that creation is over
+	defer close(creationStatusChan)
+	creationStart := time.Now()
 	//======Initialization Steps=====
 	//Check if the requested image exists
 	if !checkImageExists(db, space.ImageID) {
+		spaceCreationFailures.WithLabelValues("invalid image").Inc()
 		creationStatusChan <- "Error: Invalid Image"
 		return errors.New("Invalid Image Specified"), nil
 	}
 	//Pick a host
-	dockerHost, err := selectLeastOccupiedHost(db)
+	dockerHost, placement, err := selectLeastOccupiedHost(db)
 	if err != nil {
-		log.Critical("No hosts have been added.")
+		log.Critical("Unable to select a host: " + err.Error())
+		spaceCreationFailures.WithLabelValues("no host").Inc()
+		creationStatusChan <- "Error: " + err.Error()
 		return err, nil
 	}
 	space.HostID = dockerHost.ID
 	space.SpaceState = "creation started"
-	client := dockerHost.DockerClient
+	client, _ := getHostClient(dockerHost)
 	//Save it
-	db.Create(&space)
-	creationStatusChan <- "Host Chosen"
+	err = createSpaceRecord(db, space)
+	if err != nil {
+		spaceCreationFailures.WithLabelValues("save space").Inc()
+		creationStatusChan <- "Error: " + err.Error()
+		return err, nil
+	}
+	//Record why this host was picked
+	placement.SpaceID = space.ID
+	db.Create(placement)
+	creationStatusChan <- "Host Chosen: " + dockerHost.Name
 	log.Infof("Selected Host %d for space %d\n", space.HostID, space.ID)
 
 	//======Container Config=====
@@ -185,26 +400,42 @@ func startSpace(db *gorm.DB, space *Space, creationStatusChan chan string) (erro
 
 	//=====Host Config======
 	var hostConfig docker.HostConfig
+	//Resource limits that count against the quota of the owner
+	hostConfig.Memory = space.MemoryBytes
+	hostConfig.CPUShares = space.CPUShares
+	//Not every storage driver can limit the size of a container so this has to be turned on
+	if space.DiskBytes > 0 && viper.GetBool("ApplyDiskLimits") {
+		hostConfig.StorageOpt = map[string]string{"size": strconv.FormatInt(space.DiskBytes, 10)}
+	}
 
 	//Secure Ports in DB
-	sshPortLink := securePortForSpace(db, space, 22)
+	//SSH does not need a port of its own if users come in through the SSH gateway
+	publishSSHPort := viper.GetBool("PublishSSHPorts")
+	var sshPortLink *SpacePortLink
+	if publishSSHPort {
+		sshPortLink = securePortForSpace(db, space, 22)
+	}
 	servicePortLink := securePortForSpace(db, space, 1337)
 	//Setup Port Maps
 	//Forward a dynamic host port to container. Listen on localhost so that nginx can proxy.
 	hostConfig.PortBindings = make(map[docker.Port][]docker.PortBinding)
-	hostConfig.PortBindings["22/tcp"] = append(hostConfig.PortBindings["22/tcp"], docker.PortBinding{HostIP: "127.0.0.1", HostPort: strconv.Itoa(int(sshPortLink.ExternalPort))})
+	if publishSSHPort {
+		hostConfig.PortBindings["22/tcp"] = append(hostConfig.PortBindings["22/tcp"], docker.PortBinding{HostIP: "127.0.0.1", HostPort: strconv.Itoa(int(sshPortLink.ExternalPort))})
+	}
 	hostConfig.PortBindings["1337/tcp"] = append(hostConfig.PortBindings["1337/tcp"], docker.PortBinding{HostIP: "127.0.0.1", HostPort: strconv.Itoa(int(servicePortLink.ExternalPort))})
 	hostConfig.PortBindings["1337/udp"] = append(hostConfig.PortBindings["1337/udp"], docker.PortBinding{HostIP: "127.0.0.1", HostPort: strconv.Itoa(int(servicePortLink.ExternalPort))})
 	//Save PortLinks
-	sshPortLink.ExternalAddress = dockerHost.ExternalAddress
-	sshPortLink.DisplayAddress = dockerHost.ExternalDisplayAddress
-	sshPortLink.SpacePort = 22
+	if publishSSHPort {
+		sshPortLink.ExternalAddress = dockerHost.ExternalAddress
+		sshPortLink.DisplayAddress = dockerHost.ExternalDisplayAddress
+		sshPortLink.SpacePort = 22
+		space.PortLinks = append(space.PortLinks, *sshPortLink)
+	}
 
 	servicePortLink.ExternalAddress = dockerHost.ExternalAddress
 	servicePortLink.DisplayAddress = dockerHost.ExternalDisplayAddress
 	servicePortLink.SpacePort = 1337
 
-	space.PortLinks = append(space.PortLinks, *sshPortLink)
 	space.PortLinks = append(space.PortLinks, *servicePortLink)
 	//======Network Config=====
 	var networkConfig docker.NetworkingConfig
@@ -216,7 +447,7 @@ func startSpace(db *gorm.DB, space *Space, creationStatusChan chan string) (erro
 	config.HostConfig = &hostConfig
 	config.NetworkingConfig = &networkConfig
 	config.Context = context.Background()
-	config.Name = "userspace_space_" + strconv.Itoa(int(space.ID))
+	config.Name = spaceContainerPrefix + strconv.Itoa(int(space.ID))
 
 	//Create Container
 	c, err := client.CreateContainer(config)
@@ -225,6 +456,7 @@ func startSpace(db *gorm.DB, space *Space, creationStatusChan chan string) (erro
 		log.Debug(err)
 		space.SpaceState = "Error Creating"
 		db.Save(&space)
+		spaceCreationFailures.WithLabelValues("create container").Inc()
 		creationStatusChan <- "Error: Error Creating Container"
 		return err, nil
 	}
@@ -243,6 +475,7 @@ func startSpace(db *gorm.DB, space *Space, creationStatusChan chan string) (erro
 		log.Criticalf("Error starting container for space %d: %s\n", space.ID, err.Error())
 		space.SpaceState = "error starting"
 		db.Save(&space)
+		spaceCreationFailures.WithLabelValues("start container").Inc()
 		creationStatusChan <- "Error Starting Container"
 		return err, nil
 	} else {
@@ -252,64 +485,179 @@ func startSpace(db *gorm.DB, space *Space, creationStatusChan chan string) (erro
 	}
 	creationStatusChan <- "Started Container"
 
-	err, keyCount := AddPublicKeysToSpace(db, *space)
+	ensureSpaceProxies(db, *space)
+
+	err, keyResults := AddPublicKeysToSpace(db, *space)
 	if err != nil {
 		log.Criticalf("Error adding keys for space %d: %s\n", space.ID, err.Error())
-		space.SpaceState = "error no keys"
-		creationStatusChan <- "Error Adding Keys"
-		db.Save(&space)
+		//The container is left running so the keys can be added again when the space is next synced
+		space.KeysPending = true
+		db.Model(&Space{ID: space.ID}).Update("keys_pending", true)
+		spaceCreationFailures.WithLabelValues("add keys").Inc()
+		creationStatusChan <- "Error Adding Keys: " + err.Error() + ". They will be added again when the space is next synced."
+		return err, nil
+	}
+	keyCount := 0
+	for _, keyResult := range keyResults {
+		if keyResult.Err != nil {
+			creationStatusChan <- "Skipped Key " + keyResult.Name + ": " + keyResult.Err.Error()
+			continue
+		}
+		keyCount++
+		creationStatusChan <- "Added Key: " + keyResult.Name
 	}
-
 	creationStatusChan <- "Added " + strconv.Itoa(keyCount) + " Keys"
 
 	creationStatusChan <- "Creation Complete"
+	spaceCreationSeconds.Observe(time.Since(creationStart).Seconds())
 
 	return nil, space
 }
 
-func AddPublicKeysToSpace(db *gorm.DB, space Space) (error, int) {
-	//Get all keys
-	var keys []UserPublicKey
-	err := db.Where(&UserPublicKey{OwnerID: space.OwnerID}).Find(&keys).Error
+//execInSpace Executes a command in a space. Returns an error if the command could not be run or did not exit with 0.
+func execInSpace(db *gorm.DB, space Space, command []string) error {
+	result, err := runInSpace(space, ExecRequest{Command: command})
 	if err != nil {
-		return err, 0
+		return err
 	}
-	//Ensure .ssh exists in container
-	//execInSpace(database, space, []string{"mkdir", "/root/.ssh"})
-	//Remove existing file if it is there
-	//execInSpace(database, space, []string{"rm", "/root/.ssh/authorized_keys"})
-	//Create authorized_keys file
-	//execInSpace(database, space, []string{"touch", "/root/.ssh/authorized_keys"})
-	//Iterate through keys and add
-	for _, key := range keys {
-		execInSpace(database, space, []string{"sed", "-i", "'$ a " + key.PublicKey + "'", "/root/.ssh/authorized_keys"})
+	return checkExecResult(command, result)
+}
+
+//checkExecResult Returns an error if a command timed out or did not exit with 0
+func checkExecResult(command []string, result *ExecResult) error {
+	if result.TimedOut {
+		return fmt.Errorf("%s timed out", command[0])
 	}
-	return nil, len(keys)
+	if result.ExitCode != 0 {
+		return fmt.Errorf("%s exited with %d: %s", command[0], result.ExitCode, strings.TrimSpace(result.Stderr))
+	}
+	return nil
 }
 
-//execInSpace Executes a command in a space
-func execInSpace(db *gorm.DB, space Space, command []string) error {
-	pp.Println(command)
+//getExecTimeout Returns how long a command may run. ExecDefaultTimeoutSeconds is used if the request does not set one
+//and requests can not ask for more than ExecMaxTimeoutSeconds.
+func getExecTimeout(request ExecRequest) time.Duration {
+	seconds := request.TimeoutSeconds
+	if seconds <= 0 {
+		seconds = viper.GetInt("ExecDefaultTimeoutSeconds")
+	}
+	if maxSeconds := viper.GetInt("ExecMaxTimeoutSeconds"); maxSeconds > 0 && seconds > maxSeconds {
+		seconds = maxSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+//limitedBuffer Keeps the first max bytes written to it and drops the rest
+type limitedBuffer struct {
+	buffer    bytes.Buffer
+	max       int
+	truncated bool
+}
+
+//Write Stores as much of data as fits. Never fails so the command is not interrupted.
+func (b *limitedBuffer) Write(data []byte) (int, error) {
+	remaining := b.max - b.buffer.Len()
+	if len(data) > remaining {
+		b.truncated = true
+		if remaining > 0 {
+			b.buffer.Write(data[:remaining])
+		}
+		return len(data), nil
+	}
+	return b.buffer.Write(data)
+}
+
+//runInSpace Runs a command in a space and waits for it to finish. Every exec the daemon does goes through here.
+func runInSpace(space Space, request ExecRequest) (*ExecResult, error) {
+	if len(request.Command) == 0 {
+		return nil, errors.New("No command given")
+	}
 	dockerHost := getHostByID(space.HostID)
+	dockerClient, connected := getHostClient(dockerHost)
+	if !connected {
+		return nil, errors.New("Host of space is not connected")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), getExecTimeout(request))
+	defer cancel()
 
 	execOptions := docker.CreateExecOptions{}
-	execOptions.Cmd = command
-	execOptions.AttachStderr = false
-	execOptions.AttachStdin = false
-	execOptions.AttachStdout = false
+	execOptions.Cmd = request.Command
+	execOptions.Env = request.Env
+	execOptions.WorkingDir = request.WorkingDir
+	execOptions.AttachStdin = request.Stdin != ""
+	execOptions.AttachStdout = true
+	execOptions.AttachStderr = true
 	execOptions.Tty = false
 	execOptions.Container = space.ContainerID
-	exec, err := dockerHost.DockerClient.CreateExec(execOptions)
+	execOptions.Context = ctx
+	exec, err := dockerClient.CreateExec(execOptions)
 	if err != nil {
 		log.Warningf("Error Executing Command on Host %s: %s\n", dockerHost.Name, err.Error())
-		return err
+		return nil, err
+	}
+
+	maxOutput := viper.GetInt("ExecMaxOutputBytes")
+	stdout := &limitedBuffer{max: maxOutput}
+	stderr := &limitedBuffer{max: maxOutput}
+	startOptions := docker.StartExecOptions{
+		OutputStream: stdout,
+		ErrorStream:  stderr,
+		Context:      ctx,
+	}
+	if request.Stdin != "" {
+		startOptions.InputStream = strings.NewReader(request.Stdin)
+	}
+	err = dockerClient.StartExec(exec.ID, startOptions)
+	result := &ExecResult{
+		Stdout:    stdout.buffer.String(),
+		Stderr:    stderr.buffer.String(),
+		Truncated: stdout.truncated || stderr.truncated,
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		//Docker has no way to kill an exec so the command may still be running
+		result.TimedOut = true
+		result.ExitCode = -1
+		return result, nil
 	}
-	err = dockerHost.DockerClient.StartExec(exec.ID, docker.StartExecOptions{})
 	if err != nil {
 		log.Warningf("Error Executing Command on Host %s: %s\n", dockerHost.Name, err.Error())
-		return err
+		return nil, err
 	}
-	return nil
+
+	inspect, err := dockerClient.InspectExec(exec.ID)
+	if err != nil {
+		return nil, err
+	}
+	result.ExitCode = inspect.ExitCode
+	return result, nil
+}
+
+//getSpaceIPAddress Returns the address of the container of a space on its docker network.
+//The docker network can only be reached from the machine it is on, so spaces on other hosts are rejected.
+func getSpaceIPAddress(space Space) (string, error) {
+	dockerHost := getHostByID(space.HostID)
+	dockerClient, connected := getHostClient(dockerHost)
+	if !connected {
+		return "", errors.New("Host of space is not connected")
+	}
+	if dockerHost.ConnectionType != "local" {
+		return "", fmt.Errorf("Host %s(%d) of space is not local so its containers cannot be reached", dockerHost.Name, dockerHost.ID)
+	}
+	container, err := dockerClient.InspectContainer(space.ContainerID)
+	if err != nil {
+		return "", err
+	}
+	address := container.NetworkSettings.IPAddress
+	for _, network := range container.NetworkSettings.Networks {
+		if address == "" {
+			address = network.IPAddress
+		}
+	}
+	if address == "" {
+		return "", errors.New("Container has no IP address")
+	}
+	return address, nil
 }
 
 //startDockerClient Opens a connection to a docker instance
@@ -332,9 +680,14 @@ func startDockerClient(instance *DockerInstance) (*docker.Client, error) {
 		log.Criticalf("Failed to start docker client for %s: %s\n", instance.Name, err.Error())
 		return nil, err
 	}
+	//Make sure the host is actually there
+	err = cli.Ping()
+	if err != nil {
+		log.Criticalf("Failed to reach docker host %s: %s\n", instance.Name, err.Error())
+		return nil, err
+	}
 	//Put new connection data into the struct
-	instance.IsConnected = true
-	instance.DockerClient = cli
+	setHostConnected(instance, cli)
 
 	env, _ := cli.Version()
 	log.Info("Connection Suceeded! API Version: " + env.Get("ApiVersion"))
@@ -361,9 +714,9 @@ func downloadDockerImages(db *gorm.DB) {
 	images := []SpaceImage{}
 	db.Find(&images)
 	for _, image := range images {
-		for _, instance := range DockerInstances {
-			if instance.IsConnected {
-				pullDockerImage(instance.DockerClient, image.DockerImage, image.DockerImageTag)
+		for _, instance := range getCachedDockerInstances() {
+			if client, connected := getHostClient(instance); connected {
+				pullDockerImage(client, image.DockerImage, image.DockerImageTag)
 				log.Infof("Downloaded image to %s\n", instance.Name)
 			} else {
 				log.Warningf("Skipping %s as it is not connected!\n", instance.Name)
@@ -380,13 +733,118 @@ func pullDockerImage(dClient *docker.Client, image string, tag string) error {
 	return err
 }
 
+//PauseSpace Freezes the container of a space. The space keeps its memory but uses no CPU.
+func PauseSpace(db *gorm.DB, space Space) error {
+	dockerHost := getHostByID(space.HostID)
+	dockerClient, connected := getHostClient(dockerHost)
+	if !connected {
+		return errors.New("Host of space is not connected")
+	}
+	if space.SpaceState != "running" {
+		return errors.New("Only running spaces can be paused")
+	}
+	err := dockerClient.PauseContainer(space.ContainerID)
+	if err != nil {
+		log.Criticalf("Error pausing container %s: %s\n", space.ContainerID, err.Error())
+		return err
+	}
+	log.Infof("Paused Space %s(%d)\n", space.FriendlyName, space.ID)
+	//Only the columns that change are written so access times recorded in the meantime are kept.
+	//The lifecycle engine marks the spaces it pauses itself.
+	return db.Model(&Space{ID: space.ID}).Updates(map[string]interface{}{
+		"space_state":         "paused",
+		"paused_by_lifecycle": false,
+	}).Error
+}
+
+//ResumeSpace Unfreezes the container of a paused space
+func ResumeSpace(db *gorm.DB, space Space) error {
+	dockerHost := getHostByID(space.HostID)
+	dockerClient, connected := getHostClient(dockerHost)
+	if !connected {
+		return errors.New("Host of space is not connected")
+	}
+	if space.SpaceState != "paused" {
+		return errors.New("Only paused spaces can be resumed")
+	}
+	err := dockerClient.UnpauseContainer(space.ContainerID)
+	if err != nil {
+		log.Criticalf("Error resuming container %s: %s\n", space.ContainerID, err.Error())
+		return err
+	}
+	log.Infof("Resumed Space %s(%d)\n", space.FriendlyName, space.ID)
+	space.SpaceState = "running"
+	space.PausedByLifecycle = false
+	space.ResumedAt = time.Now()
+	err = db.Model(&Space{ID: space.ID}).Updates(map[string]interface{}{
+		"space_state":         space.SpaceState,
+		"paused_by_lifecycle": false,
+		"resumed_at":          space.ResumedAt,
+	}).Error
+	if err != nil {
+		return err
+	}
+	//Keys may have changed while the space was paused
+	err, _ = AddPublicKeysToSpace(db, space)
+	if err != nil {
+		log.Warningf("Error updating keys of Space %d after resuming: %s\n", space.ID, err.Error())
+	}
+	return nil
+}
+
+//resumeIdleSpace Resumes a space that the lifecycle engine paused for being idle. Spaces that their owner or an admin
+//paused on purpose are left alone.
+func resumeIdleSpace(db *gorm.DB, space Space) error {
+	if !space.PausedByLifecycle {
+		return errors.New("Space is paused")
+	}
+	return ResumeSpace(db, space)
+}
+
+//ArchiveSpace Removes the container of a space but keeps its record. All data in the space is lost.
+func ArchiveSpace(db *gorm.DB, space Space) error {
+	dockerHost := getHostByID(space.HostID)
+	dockerClient, connected := getHostClient(dockerHost)
+	if !connected {
+		return errors.New("Host of space is not connected")
+	}
+	db.Model(&Space{ID: space.ID}).Update("space_state", "archiving")
+
+	removeOptions := docker.RemoveContainerOptions{
+		ID:            space.ContainerID,
+		RemoveVolumes: true,
+		Force:         true,
+		Context:       context.Background(),
+	}
+	err := dockerClient.RemoveContainer(removeOptions)
+	if err != nil {
+		log.Criticalf("Error removing container %s: %s\n", space.ContainerID, err.Error())
+		db.Model(&Space{ID: space.ID}).Update("space_state", "error")
+		return err
+	}
+
+	//Free the ports so other spaces can use them
+	db.Where("space_id = ?", space.ID).Delete(&SpacePortLink{})
+	forgetSSHSessions(space.ID)
+	forgetSpaceMetrics(space.ID)
+	removeSpaceProxies(db, space.ID)
+	log.Infof("Archived Space %s(%d)\n", space.FriendlyName, space.ID)
+	return db.Model(&Space{ID: space.ID}).Updates(map[string]interface{}{
+		"archived":     true,
+		"archive_date": time.Now(),
+		"space_state":  "archived",
+		"ssh_sessions": 0,
+	}).Error
+}
+
 //RemoveSpace Removes a Space's container and DB entry
 func RemoveSpace(db *gorm.DB, space Space) error {
 	//Get Host Docker Connection
 	hostID := space.HostID
 	dockerHost := getHostByID(hostID)
 	//Ensure the host is connected
-	if !dockerHost.IsConnected {
+	dockerClient, connected := getHostClient(dockerHost)
+	if !connected {
 		log.Critical("Attempted to remove container %s from disconnected host.")
 		return errors.New("Attempted to remove contaienr from disconnected host.")
 	}
@@ -397,7 +855,7 @@ func RemoveSpace(db *gorm.DB, space Space) error {
 	//Only remove the container if the container is not already dead
 	if space.SpaceState != "error" {
 		//Stop the container
-		dClient := dockerHost.DockerClient
+		dClient := dockerClient
 		err := dClient.StopContainer(space.ContainerID, 30)
 		//Catch any errors
 		if err != nil {
@@ -424,5 +882,8 @@ func RemoveSpace(db *gorm.DB, space Space) error {
 		log.Criticalf("Error removing space record for %d\n", space.ID, err.Error())
 		return err
 	}
+	forgetSSHSessions(space.ID)
+	forgetSpaceMetrics(space.ID)
+	removeSpaceProxies(db, space.ID)
 	return nil
 }
@@ -0,0 +1,415 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package userspaced
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/spf13/viper"
+)
+
+//setTestDockerInstances Replaces the cached hosts for the length of a test
+func setTestDockerInstances(t *testing.T, instances ...*DockerInstance) {
+	dockerInstanceSliceLock.Lock()
+	previous := DockerInstances
+	DockerInstances = instances
+	dockerInstanceSliceLock.Unlock()
+	t.Cleanup(func() {
+		dockerInstanceSliceLock.Lock()
+		DockerInstances = previous
+		dockerInstanceSliceLock.Unlock()
+	})
+}
+
+func TestSelectLeastOccupiedHost(t *testing.T) {
+	db := newTestDatabase(t)
+	setTestDockerInstances(t,
+		&DockerInstance{ID: 1, Name: "busy", IsConnected: true},
+		&DockerInstance{ID: 2, Name: "quiet", IsConnected: true},
+		&DockerInstance{ID: 3, Name: "down"},
+		&DockerInstance{ID: 4, Name: "drained", IsConnected: true, Draining: true},
+	)
+	db.Create(&Space{HostID: 1})
+	db.Create(&Space{HostID: 1})
+	db.Create(&Space{HostID: 2})
+	//Archived spaces do not take up room
+	db.Create(&Space{HostID: 2, Archived: true})
+	db.Create(&Space{HostID: 2, Archived: true})
+
+	host, placement, err := selectLeastOccupiedHost(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host.ID != 2 {
+		t.Errorf("Selected host %d, want 2 (%s)", host.ID, placement.Candidates)
+	}
+	if placement.HostID != 2 || placement.Score != 1 {
+		t.Errorf("Placement = %+v", placement)
+	}
+}
+
+func TestSelectLeastOccupiedHostWithoutHosts(t *testing.T) {
+	db := newTestDatabase(t)
+	setTestDockerInstances(t, &DockerInstance{ID: 1, Name: "down"})
+	_, _, err := selectLeastOccupiedHost(db)
+	if err == nil {
+		t.Error("Expected an error when no host is connected")
+	}
+}
+
+//startTestInfoHost Starts a docker API that reports the resources given and returns a connected host for it.
+//A host with no CPUs fails the info call.
+func startTestInfoHost(t *testing.T, id uint, cpus int, memoryBytes int64) *DockerInstance {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cpus == 0 || !strings.HasSuffix(r.URL.Path, "/info") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, `{"NCPU":%d,"MemTotal":%d}`, cpus, memoryBytes)
+	}))
+	t.Cleanup(server.Close)
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := &DockerInstance{ID: id, Name: fmt.Sprintf("host%d", id)}
+	setHostConnected(host, client)
+	return host
+}
+
+func TestGetHostCapacity(t *testing.T) {
+	defer viper.Set("SchedulerCPUWeight", nil)
+	defer viper.Set("SchedulerMemoryWeight", nil)
+	const gigabyte = 1024 * 1024 * 1024
+	tests := []struct {
+		name         string
+		cpuWeight    float64
+		memoryWeight float64
+		cpus         int
+		capacity     float64
+	}{
+		{"not weighed", 0, 0, 4, 1},
+		{"cpu", 1, 0, 4, 4},
+		{"memory", 0, 0.5, 4, 4},
+		{"both", 1, 0.5, 4, 8},
+		//Hosts that do not answer are treated as if resources were not weighed
+		{"info fails", 1, 0.5, 0, 1},
+	}
+	for _, test := range tests {
+		viper.Set("SchedulerCPUWeight", test.cpuWeight)
+		viper.Set("SchedulerMemoryWeight", test.memoryWeight)
+		host := startTestInfoHost(t, 1, test.cpus, 8*gigabyte)
+		capacity, resources := getHostCapacity(host)
+		if capacity != test.capacity {
+			t.Errorf("%s: capacity = %f (%s), want %f", test.name, capacity, resources, test.capacity)
+		}
+	}
+}
+
+func TestSelectLeastOccupiedHostWeighsResources(t *testing.T) {
+	db := newTestDatabase(t)
+	viper.Set("SchedulerCPUWeight", 1)
+	defer viper.Set("SchedulerCPUWeight", nil)
+	setTestDockerInstances(t, startTestInfoHost(t, 1, 2, 0), startTestInfoHost(t, 2, 8, 0))
+	//The small host has fewer spaces but more of them per CPU
+	db.Create(&Space{HostID: 1})
+	db.Create(&Space{HostID: 1})
+	for i := 0; i < 4; i++ {
+		db.Create(&Space{HostID: 2})
+	}
+
+	host, placement, err := selectLeastOccupiedHost(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host.ID != 2 || placement.Score != 0.5 {
+		t.Errorf("Selected host %d with score %f, want host 2 with 0.5 (%s)", host.ID, placement.Score, placement.Candidates)
+	}
+	if !strings.Contains(placement.Candidates, "host1(1): 2 spaces, 2 cpus") {
+		t.Errorf("Candidates do not explain the other host: %s", placement.Candidates)
+	}
+}
+
+func TestRemoveDockerInstanceIgnoresArchivedSpaces(t *testing.T) {
+	db := newTestDatabase(t)
+	host := DockerInstance{Name: "old"}
+	db.Create(&host)
+	setTestDockerInstances(t, &host)
+	archived := Space{HostID: host.ID, Archived: true}
+	db.Create(&archived)
+
+	count, err := countSpacesOnHost(db, host.ID)
+	if err != nil || count != 0 {
+		t.Fatalf("countSpacesOnHost = %d, %v", count, err)
+	}
+	err = removeDockerInstance(db, host.ID, false)
+	if err != nil {
+		t.Fatalf("Host with only archived spaces was not removed: %s", err.Error())
+	}
+	if len(getCachedDockerInstances()) != 0 {
+		t.Error("Host is still cached")
+	}
+	if db.First(&Space{}, archived.ID).RecordNotFound() {
+		t.Error("Record of the archived space was deleted")
+	}
+}
+
+func TestRemoveDockerInstanceRefusesLiveSpaces(t *testing.T) {
+	db := newTestDatabase(t)
+	host := DockerInstance{Name: "busy"}
+	db.Create(&host)
+	setTestDockerInstances(t, &host)
+	db.Create(&Space{HostID: host.ID})
+	if err := removeDockerInstance(db, host.ID, false); err == nil {
+		t.Error("Host with a live space was removed")
+	}
+}
+
+//startTestDockerHost Starts a docker API that knows any container by the address given and caches a local host for it
+func startTestDockerHost(t *testing.T, containerAddress string) *DockerInstance {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/json"):
+			fmt.Fprintf(w, `{"Id":"container","NetworkSettings":{"IPAddress":"%s"}}`, containerAddress)
+		case r.Method == http.MethodPost && (strings.HasSuffix(r.URL.Path, "/pause") || strings.HasSuffix(r.URL.Path, "/unpause")):
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := &DockerInstance{ID: 1, ConnectionType: "local", Name: "local"}
+	setHostConnected(host, client)
+	setTestDockerInstances(t, host)
+	return host
+}
+
+func TestGetSpaceIPAddressRejectsRemoteHosts(t *testing.T) {
+	host := startTestDockerHost(t, "172.17.0.2")
+	space := Space{ID: 1, HostID: host.ID, ContainerID: "container"}
+
+	address, err := getSpaceIPAddress(space)
+	if err != nil || address != "172.17.0.2" {
+		t.Fatalf("Expected the address of the container on a local host, got %q (%v)", address, err)
+	}
+	host.ConnectionType = "tls"
+	address, err = getSpaceIPAddress(space)
+	if err == nil {
+		t.Errorf("Address %s of a space on a remote host was returned", address)
+	}
+}
+
+func TestPauseAndResumeSpaceKeepOtherColumns(t *testing.T) {
+	db := newTestDatabase(t)
+	host := startTestDockerHost(t, "172.17.0.2")
+	space := Space{HostID: host.ID, ContainerID: "container", SpaceState: "running"}
+	db.Create(&space)
+	//Written by the SSH tracker after the space was read
+	accessed := time.Now().Add(-time.Minute)
+	db.Model(&Space{ID: space.ID}).Update("last_net_access", accessed)
+
+	err := PauseSpace(db, space)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paused Space
+	db.First(&paused, space.ID)
+	if paused.SpaceState != "paused" || paused.LastNetAccess.Unix() != accessed.Unix() {
+		t.Errorf("Paused space is %s with last access %s, want paused with %s", paused.SpaceState, paused.LastNetAccess, accessed)
+	}
+	if err = PauseSpace(db, paused); err == nil {
+		t.Error("A paused space was paused again")
+	}
+
+	db.Model(&Space{ID: space.ID}).Update("paused_by_lifecycle", true)
+	db.First(&paused, space.ID)
+	err = ResumeSpace(db, paused)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resumed Space
+	db.First(&resumed, space.ID)
+	if resumed.SpaceState != "running" || resumed.PausedByLifecycle || resumed.ResumedAt.IsZero() {
+		t.Errorf("Resumed space is %s with PausedByLifecycle %t and ResumedAt %s", resumed.SpaceState, resumed.PausedByLifecycle, resumed.ResumedAt)
+	}
+	if resumed.LastNetAccess.Unix() != accessed.Unix() {
+		t.Errorf("Last access changed to %s", resumed.LastNetAccess)
+	}
+	if err = ResumeSpace(db, resumed); err == nil {
+		t.Error("A running space was resumed")
+	}
+}
+
+func TestUpdateDockerInstanceMovesProxies(t *testing.T) {
+	db := newTestDatabase(t)
+	db.AutoMigrate(&ProxyInstance{})
+	cached := &DockerInstance{ConnectionType: "local", Name: "local"}
+	db.Create(cached)
+	setTestDockerInstances(t, cached)
+	space := Space{HostID: cached.ID, SpaceState: "running"}
+	db.Create(&space)
+	portLink := SpacePortLink{SpaceID: space.ID, SpacePort: 1337, ExternalPort: uint16(getFreePort(t))}
+	db.Create(&portLink)
+	defer removeSpaceProxies(db, space.ID)
+
+	updated := DockerInstance{ID: cached.ID, ConnectionType: "local", Name: "renamed", ExternalAddress: "127.0.0.1"}
+	finished := make(chan error, 1)
+	go func() {
+		finished <- updateDockerInstance(db, &updated)
+	}()
+	select {
+	case err := <-finished:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Updating a host with a running space did not finish")
+	}
+
+	if host := getHostByID(cached.ID); host == nil || host.Name != "renamed" {
+		t.Errorf("Cached host = %+v", host)
+	}
+	db.First(&portLink, portLink.ID)
+	if portLink.ExternalAddress != "127.0.0.1" || !portLink.Proxied {
+		t.Errorf("Port link is at %q with Proxied %t", portLink.ExternalAddress, portLink.Proxied)
+	}
+	var count int
+	db.Model(&ProxyInstance{}).Where("space_id = ? AND listen_address = ?", space.ID, "127.0.0.1").Count(&count)
+	if count != 2 {
+		t.Errorf("%d proxies listen on the new address, want 2", count)
+	}
+}
+
+func TestUpdateCachedDockerInstanceConnectsWithoutLock(t *testing.T) {
+	cached := &DockerInstance{ID: 1, ConnectionType: "local", Name: "local"}
+	setTestDockerInstances(t, cached)
+	//A host that only answers once the test lets it
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		if strings.HasSuffix(r.URL.Path, "/version") {
+			fmt.Fprint(w, `{"ApiVersion":"1.41"}`)
+		}
+	}))
+	defer server.Close()
+	var releaseOnce sync.Once
+	releaseHost := func() {
+		releaseOnce.Do(func() { close(release) })
+	}
+	defer releaseHost()
+
+	updated := &DockerInstance{ID: cached.ID, ConnectionType: "local", Name: "moved", Endpoint: server.URL}
+	finished := make(chan error, 1)
+	go func() {
+		finished <- updateCachedDockerInstance(updated)
+	}()
+	looked := make(chan *DockerInstance, 1)
+	go func() {
+		//Give the update time to start connecting
+		time.Sleep(100 * time.Millisecond)
+		looked <- getHostByID(cached.ID)
+	}()
+	select {
+	case host := <-looked:
+		if host != cached {
+			t.Errorf("The host was replaced before it connected: %+v", host)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Looking up a host waited for another host to connect")
+	}
+
+	releaseHost()
+	select {
+	case err := <-finished:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The update did not finish")
+	}
+	if host := getHostByID(cached.ID); host != updated || !isHostConnected(host) {
+		t.Errorf("Cached host = %+v", host)
+	}
+}
+
+func TestLimitedBufferTruncates(t *testing.T) {
+	buffer := &limitedBuffer{max: 5}
+	for _, chunk := range []string{"abc", "def", "ghi"} {
+		n, err := buffer.Write([]byte(chunk))
+		if n != len(chunk) || err != nil {
+			t.Fatalf("Write(%q) = %d, %v", chunk, n, err)
+		}
+	}
+	if buffer.buffer.String() != "abcde" || !buffer.truncated {
+		t.Errorf("buffer = %q, truncated = %t", buffer.buffer.String(), buffer.truncated)
+	}
+
+	buffer = &limitedBuffer{max: 3}
+	buffer.Write([]byte("abc"))
+	if buffer.buffer.String() != "abc" || buffer.truncated {
+		t.Errorf("Exact fit: buffer = %q, truncated = %t", buffer.buffer.String(), buffer.truncated)
+	}
+}
+
+func TestGetExecTimeout(t *testing.T) {
+	viper.Set("ExecDefaultTimeoutSeconds", 60)
+	viper.Set("ExecMaxTimeoutSeconds", 600)
+	defer viper.Set("ExecDefaultTimeoutSeconds", nil)
+	defer viper.Set("ExecMaxTimeoutSeconds", nil)
+
+	tests := []struct {
+		requested int
+		want      time.Duration
+	}{
+		{0, time.Minute},
+		{-5, time.Minute},
+		{30, 30 * time.Second},
+		{600, 10 * time.Minute},
+		{3600, 10 * time.Minute},
+	}
+	for _, test := range tests {
+		if got := getExecTimeout(ExecRequest{TimeoutSeconds: test.requested}); got != test.want {
+			t.Errorf("getExecTimeout(%d) = %s, want %s", test.requested, got, test.want)
+		}
+	}
+}
+
+func TestCheckExecResult(t *testing.T) {
+	command := []string{"chown", "root"}
+	if err := checkExecResult(command, &ExecResult{Stdout: "ok"}); err != nil {
+		t.Errorf("Exit code 0: %v", err)
+	}
+	err := checkExecResult(command, &ExecResult{ExitCode: 2, Stderr: "no such user\n"})
+	if err == nil || err.Error() != "chown exited with 2: no such user" {
+		t.Errorf("Exit code 2: %v", err)
+	}
+	err = checkExecResult(command, &ExecResult{ExitCode: -1, TimedOut: true})
+	if err == nil || err.Error() != "chown timed out" {
+		t.Errorf("Timed out: %v", err)
+	}
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package userspaced
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/jinzhu/gorm"
+)
+
+//spaceContainerPrefix Every container that belongs to a space is named with this prefix
+const spaceContainerPrefix = "userspace_space_"
+
+//spaceEventListener An event subscription on the client of a host
+type spaceEventListener struct {
+	client *docker.Client         //Client the listener is registered with
+	events chan *docker.APIEvents //Channel the client sends events to
+	stop   chan struct{}          //Closed when the listener is replaced
+}
+
+var spaceEventListeners = make(map[uint]*spaceEventListener)
+var spaceEventListenersLock sync.Mutex
+
+//ensureSpaceEventListener Subscribes to the events of a host if it is not already subscribed with its current client.
+//Hosts get a new client when they reconnect or are updated so this is called on every health check.
+func ensureSpaceEventListener(db *gorm.DB, instance *DockerInstance) {
+	spaceEventListenersLock.Lock()
+	defer spaceEventListenersLock.Unlock()
+	client, connected := getHostClient(instance)
+	if !connected {
+		return
+	}
+	existing, exists := spaceEventListeners[instance.ID]
+	if exists && existing.client == client {
+		return
+	}
+	if exists {
+		existing.client.RemoveEventListener(existing.events)
+		close(existing.stop)
+		delete(spaceEventListeners, instance.ID)
+	}
+
+	listener := &spaceEventListener{
+		client: client,
+		events: make(chan *docker.APIEvents, 64),
+		stop:   make(chan struct{}),
+	}
+	err := listener.client.AddEventListener(listener.events)
+	if err != nil {
+		log.Warningf("Failed to subscribe to events of host %s(%d): %s\n", instance.Name, instance.ID, err.Error())
+		return
+	}
+	spaceEventListeners[instance.ID] = listener
+	log.Infof("Subscribed to events of host %s(%d)\n", instance.Name, instance.ID)
+	go watchSpaceEvents(db, instance.ID, listener)
+}
+
+//watchSpaceEvents Handles events from a host until the listener is replaced or the client gives up
+func watchSpaceEvents(db *gorm.DB, hostID uint, listener *spaceEventListener) {
+	for true {
+		select {
+		case event, ok := <-listener.events:
+			if !ok {
+				//The client closes the channel when it can no longer reach the host
+				log.Warningf("Event stream of host %d closed\n", hostID)
+				spaceEventListenersLock.Lock()
+				if spaceEventListeners[hostID] == listener {
+					delete(spaceEventListeners, hostID)
+				}
+				spaceEventListenersLock.Unlock()
+				return
+			}
+			handleSpaceEvent(db, event)
+		case <-listener.stop:
+			return
+		}
+	}
+}
+
+//handleSpaceEvent Updates the state of the space that an event refers to
+func handleSpaceEvent(db *gorm.DB, event *docker.APIEvents) {
+	if event.Type != "container" || !strings.HasPrefix(event.Actor.Attributes["name"], spaceContainerPrefix) {
+		return
+	}
+	var space Space
+	if db.Where("container_id = ?", event.Actor.ID).First(&space).RecordNotFound() {
+		return
+	}
+	//These are managed by startSpace, RemoveSpace and ArchiveSpace
+	if space.SpaceState == "creation started" || space.SpaceState == "deleting" ||
+		space.SpaceState == "archiving" || space.Archived {
+		return
+	}
+
+	//Only the columns that the event changes are written. Other goroutines update the access times and SSH
+	//counters of the space, and saving the whole row would put back the values that were read here.
+	updates := make(map[string]interface{})
+	switch event.Action {
+	case "start":
+		//oom_killed is kept until the next die so the OOM kill can still be seen after a keep alive restart
+		updates["space_state"] = "running"
+	case "unpause":
+		updates["space_state"] = "running"
+	case "pause":
+		updates["space_state"] = "paused"
+	case "oom":
+		updates["oom_killed"] = true
+		log.Warningf("Space %s(%d) ran out of memory\n", space.FriendlyName, space.ID)
+	case "die":
+		updates["space_state"] = "exited"
+		updates["last_exit_time"] = time.Unix(event.Time, 0)
+		exitCode, err := strconv.Atoi(event.Actor.Attributes["exitCode"])
+		if err == nil {
+			updates["last_exit_code"] = exitCode
+		}
+		log.Infof("Space %s(%d) exited with code %s\n", space.FriendlyName, space.ID, event.Actor.Attributes["exitCode"])
+	case "destroy":
+		updates["space_state"] = "error"
+	default:
+		return
+	}
+	if state, changed := updates["space_state"]; changed && state != space.SpaceState {
+		log.Infof("Updated Space %s(%d) to state %s from %s\n", space.FriendlyName, space.ID, state, space.SpaceState)
+	}
+	err := db.Model(&Space{ID: space.ID}).Updates(updates).Error
+	if err != nil {
+		log.Warningf("Error saving event for Space %d: %s\n", space.ID, err.Error())
+		return
+	}
+
+	//Let the usual logic decide if the space should be restarted. It also sets oom_killed from the container so an
+	//OOM kill of an earlier run is cleared once the space exits for another reason.
+	if event.Action == "die" {
+		db.First(&space, space.ID)
+		updateSpaceState(db, space)
+	}
+}
@@ -0,0 +1,136 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package userspaced
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+//newTestContainerEvent Builds an event for the container of a space
+func newTestContainerEvent(containerID string, action string, attributes map[string]string) *docker.APIEvents {
+	if attributes == nil {
+		attributes = make(map[string]string)
+	}
+	attributes["name"] = spaceContainerPrefix + "1"
+	return &docker.APIEvents{
+		Type:   "container",
+		Action: action,
+		Actor:  docker.APIActor{ID: containerID, Attributes: attributes},
+	}
+}
+
+//startTestStateHost Starts a fake docker host whose containers report the state given and can be started
+func startTestStateHost(t *testing.T, state string) *DockerInstance {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/json"):
+			fmt.Fprintf(w, `{"Id":"abc","State":%s}`, state)
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/start"):
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := &DockerInstance{ID: 1, ConnectionType: "local", Name: "local"}
+	setHostConnected(host, client)
+	setTestDockerInstances(t, host)
+	return host
+}
+
+func TestHandleSpaceEventKeepsOOMKillsAfterRestart(t *testing.T) {
+	db := newTestDatabase(t)
+	host := startTestStateHost(t, `{"Status":"exited","OOMKilled":true,"ExitCode":137}`)
+	space := Space{HostID: host.ID, ContainerID: "abc", SpaceState: "running", KeepAlive: true}
+	db.Create(&space)
+
+	handleSpaceEvent(db, newTestContainerEvent("abc", "oom", nil))
+	db.First(&space, space.ID)
+	if !space.OOMKilled {
+		t.Fatal("oom event was not recorded")
+	}
+	//The die is followed by the keep alive restart and then the start event of the new run
+	handleSpaceEvent(db, newTestContainerEvent("abc", "die", map[string]string{"exitCode": "137"}))
+	handleSpaceEvent(db, newTestContainerEvent("abc", "start", nil))
+	db.First(&space, space.ID)
+	if !space.OOMKilled || space.SpaceState != "running" || space.LastExitCode != 137 {
+		t.Errorf("After restart: oom_killed = %t, state = %s, last_exit_code = %d", space.OOMKilled, space.SpaceState, space.LastExitCode)
+	}
+}
+
+func TestHandleSpaceEventClearsOOMKillsOnNextDie(t *testing.T) {
+	db := newTestDatabase(t)
+	host := startTestStateHost(t, `{"Status":"exited","OOMKilled":false,"ExitCode":0}`)
+	space := Space{HostID: host.ID, ContainerID: "abc", SpaceState: "running", OOMKilled: true}
+	db.Create(&space)
+
+	handleSpaceEvent(db, newTestContainerEvent("abc", "die", map[string]string{"exitCode": "0"}))
+	db.First(&space, space.ID)
+	if space.OOMKilled || space.SpaceState != "exited" {
+		t.Errorf("oom_killed = %t, state = %s", space.OOMKilled, space.SpaceState)
+	}
+}
+
+func TestHandleSpaceEventOnlyWritesChangedColumns(t *testing.T) {
+	db := newTestDatabase(t)
+	space := Space{ContainerID: "abc", SpaceState: "running"}
+	db.Create(&space)
+	//Stands in for the SSH tracker updating the space while the event is handled
+	db.Model(&Space{ID: space.ID}).Update("ssh_sessions_in", 7)
+
+	handleSpaceEvent(db, newTestContainerEvent("abc", "pause", nil))
+	db.First(&space, space.ID)
+	if space.SpaceState != "paused" || space.SSHSessionsIn != 7 {
+		t.Errorf("state = %s, ssh_sessions_in = %d", space.SpaceState, space.SSHSessionsIn)
+	}
+}
+
+func TestHandleSpaceEventRecordsExit(t *testing.T) {
+	db := newTestDatabase(t)
+	setTestDockerInstances(t)
+	space := Space{ContainerID: "abc", SpaceState: "running"}
+	db.Create(&space)
+
+	handleSpaceEvent(db, newTestContainerEvent("abc", "die", map[string]string{"exitCode": "137"}))
+	db.First(&space, space.ID)
+	if space.LastExitCode != 137 {
+		t.Errorf("last_exit_code = %d, want 137", space.LastExitCode)
+	}
+}
+
+func TestHandleSpaceEventIgnoresOtherContainers(t *testing.T) {
+	db := newTestDatabase(t)
+	space := Space{ContainerID: "abc", SpaceState: "running"}
+	db.Create(&space)
+	event := newTestContainerEvent("abc", "pause", nil)
+	event.Actor.Attributes["name"] = "something-else"
+	handleSpaceEvent(db, event)
+	db.First(&space, space.ID)
+	if space.SpaceState != "running" {
+		t.Errorf("state = %s, want running", space.SpaceState)
+	}
+}
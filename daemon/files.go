@@ -0,0 +1,297 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package userspaced
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/spf13/viper"
+)
+
+//tarContentType Uploads with this content type are extracted into the path instead of being written to it
+const tarContentType = "application/x-tar"
+
+//errTransferTooLarge Returned once a transfer goes over its size limit
+var errTransferTooLarge = errors.New("transfer is larger than the limit")
+
+//transferLimitReader Fails reads once more than the limit has been read
+type transferLimitReader struct {
+	reader    io.Reader
+	remaining int64
+	exceeded  bool //Set once the limit has been passed
+}
+
+//Read Reads from the underlying reader until the limit is passed
+func (r *transferLimitReader) Read(data []byte) (int, error) {
+	n, err := r.reader.Read(data)
+	r.remaining -= int64(n)
+	if r.remaining < 0 {
+		r.exceeded = true
+		return n, errTransferTooLarge
+	}
+	return n, err
+}
+
+//transferLimitWriter Sends a download to the client. The headers are only written once docker starts sending the archive
+//so that a missing path can still be reported with a proper status.
+type transferLimitWriter struct {
+	w         http.ResponseWriter
+	filename  string
+	remaining int64 //Bytes that may still be sent. Negative means no limit.
+	started   bool
+}
+
+//Write Sends a chunk of the archive to the client
+func (w *transferLimitWriter) Write(data []byte) (int, error) {
+	if !w.started {
+		w.w.Header().Set("Content-Type", tarContentType)
+		w.w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", w.filename))
+		w.w.WriteHeader(http.StatusOK)
+		w.started = true
+	}
+	if w.remaining >= 0 {
+		if int64(len(data)) > w.remaining {
+			return 0, errTransferTooLarge
+		}
+		w.remaining -= int64(len(data))
+	}
+	return w.w.Write(data)
+}
+
+//getSpaceUploadLimit Returns how many bytes may be uploaded to a space. Uploads are limited by FileUploadMaxBytes and
+//by the disk that the space has left of its allotment. A negative limit means there is no limit.
+func getSpaceUploadLimit(space Space) (int64, error) {
+	limit := viper.GetInt64("FileUploadMaxBytes")
+	if limit <= 0 {
+		limit = -1
+	}
+	if space.DiskBytes <= 0 {
+		return limit, nil
+	}
+	dockerHost := getHostByID(space.HostID)
+	dockerClient, connected := getHostClient(dockerHost)
+	if !connected {
+		return 0, errors.New("Host of space is not connected")
+	}
+	container, err := dockerClient.InspectContainerWithOptions(docker.InspectContainerOptions{ID: space.ContainerID, Size: true})
+	if err != nil {
+		return 0, err
+	}
+	remaining := space.DiskBytes - container.SizeRw
+	if remaining < 0 {
+		remaining = 0
+	}
+	if limit < 0 || remaining < limit {
+		limit = remaining
+	}
+	return limit, nil
+}
+
+//getTransferPath Returns the path parameter of a file request if it is an absolute path
+func getTransferPath(r *http.Request) (string, error) {
+	transferPath := r.URL.Query().Get("path")
+	if !path.IsAbs(transferPath) {
+		return "", errors.New("path must be an absolute path")
+	}
+	return transferPath, nil
+}
+
+//putFilesAPIHandler Handles PUT /api/v1/space/:spaceid/files - Uploads to a space. A tar archive is extracted into the
+//directory given by path, anything else is written to the file given by path.
+func putFilesAPIHandler(w http.ResponseWriter, r *http.Request) {
+	//Get user and error out if it didn't work
+	user, err := getUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	//Uploads can overwrite any file in the space so they need the same permissions as exec
+	space, status, err := getExecSpaceFromRequest(r, user)
+	if err != nil {
+		w.WriteHeader(status)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	transferPath, err := getTransferPath(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Invalid Request: "+err.Error()+"\n")
+		return
+	}
+	isArchive := strings.HasPrefix(r.Header.Get("Content-Type"), tarContentType)
+	if !isArchive && (strings.HasSuffix(transferPath, "/") || path.Clean(transferPath) == "/") {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Invalid Request: path must name a file\n")
+		return
+	}
+	//The size of a single file has to be known up front since it goes into the tar header
+	if !isArchive && r.ContentLength < 0 {
+		w.WriteHeader(http.StatusLengthRequired)
+		fmt.Fprint(w, "Content-Length is required\n")
+		return
+	}
+
+	dockerHost := getHostByID(space.HostID)
+	dockerClient, connected := getHostClient(dockerHost)
+	if !connected {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, "Host of space is not connected\n")
+		return
+	}
+	limit, err := getSpaceUploadLimit(*space)
+	if err != nil {
+		log.Warningf("Error getting upload limit of Space %d: %s\n", space.ID, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Error checking disk usage of space\n")
+		return
+	}
+	if limit >= 0 && r.ContentLength > limit {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprintf(w, "Upload is larger than the %d bytes allowed\n", limit)
+		return
+	}
+
+	var body io.Reader = r.Body
+	var limitedBody *transferLimitReader
+	if limit >= 0 {
+		limitedBody = &transferLimitReader{reader: r.Body, remaining: limit}
+		body = limitedBody
+	}
+	uploadPath := transferPath
+	if !isArchive {
+		//Wrap the file in an archive with a single entry
+		uploadPath = path.Dir(path.Clean(transferPath))
+		archiveReader, archiveWriter := io.Pipe()
+		//Unblocks the writer if docker stops reading early
+		defer archiveReader.Close()
+		go func(fileBody io.Reader, size int64, name string) {
+			tarWriter := tar.NewWriter(archiveWriter)
+			err := tarWriter.WriteHeader(&tar.Header{
+				Name:    name,
+				Mode:    0644,
+				Size:    size,
+				ModTime: time.Now(),
+			})
+			if err == nil {
+				_, err = io.Copy(tarWriter, fileBody)
+			}
+			if err == nil {
+				err = tarWriter.Close()
+			}
+			archiveWriter.CloseWithError(err)
+		}(body, r.ContentLength, path.Base(transferPath))
+		body = archiveReader
+	}
+
+	err = dockerClient.UploadToContainer(space.ContainerID, docker.UploadToContainerOptions{
+		InputStream: body,
+		Path:        uploadPath,
+		Context:     r.Context(),
+	})
+	//The docker client wraps errors from the body so ask the reader if it stopped the upload
+	if err != nil && limitedBody != nil && limitedBody.exceeded {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprintf(w, "Upload is larger than the %d bytes allowed\n", limit)
+		return
+	}
+	if dockerErr, ok := err.(*docker.Error); ok && dockerErr.Status == http.StatusNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "Directory does not exist in space\n")
+		return
+	}
+	if err != nil {
+		log.Warningf("Error uploading to %s in Space %d: %s\n", uploadPath, space.ID, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Error uploading: "+err.Error())
+		return
+	}
+	log.Infof("User %s uploaded to %s in Space %s(%d)\n", user.Username, transferPath, space.FriendlyName, space.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//getFilesAPIHandler Handles GET /api/v1/space/:spaceid/files - Downloads a file or directory from a space as a tar archive
+func getFilesAPIHandler(w http.ResponseWriter, r *http.Request) {
+	//Get user and error out if it didn't work
+	user, err := getUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	space, status, err := getSpaceFromRequest(r, user, ADMIN_READ_SPACE)
+	if err != nil {
+		w.WriteHeader(status)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	transferPath, err := getTransferPath(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Invalid Request: "+err.Error()+"\n")
+		return
+	}
+	dockerHost := getHostByID(space.HostID)
+	dockerClient, connected := getHostClient(dockerHost)
+	if !connected {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, "Host of space is not connected\n")
+		return
+	}
+
+	filename := path.Base(path.Clean(transferPath))
+	if filename == "/" {
+		filename = space.FriendlyName
+	}
+	limit := viper.GetInt64("FileDownloadMaxBytes")
+	if limit <= 0 {
+		limit = -1
+	}
+	output := &transferLimitWriter{w: w, filename: filename + ".tar", remaining: limit}
+	err = dockerClient.DownloadFromContainer(space.ContainerID, docker.DownloadFromContainerOptions{
+		OutputStream: output,
+		Path:         transferPath,
+		Context:      r.Context(),
+	})
+	if err != nil && output.started {
+		//The status has been sent so all that can be done is to cut the archive short
+		log.Warningf("Download of %s from Space %d stopped: %s\n", transferPath, space.ID, err.Error())
+		return
+	}
+	if dockerErr, ok := err.(*docker.Error); ok && dockerErr.Status == http.StatusNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "Path does not exist in space\n")
+		return
+	}
+	if err != nil {
+		log.Warningf("Error downloading %s from Space %d: %s\n", transferPath, space.ID, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Error downloading: "+err.Error())
+		return
+	}
+	log.Infof("User %s downloaded %s from Space %s(%d)\n", user.Username, transferPath, space.FriendlyName, space.ID)
+}
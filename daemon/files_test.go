@@ -0,0 +1,138 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package userspaced
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/spf13/viper"
+)
+
+func TestTransferLimitReader(t *testing.T) {
+	reader := &transferLimitReader{reader: strings.NewReader("abcdef"), remaining: 6}
+	data, err := io.ReadAll(reader)
+	if err != nil || string(data) != "abcdef" || reader.exceeded {
+		t.Errorf("At the limit: %q, %v, exceeded = %t", data, err, reader.exceeded)
+	}
+
+	reader = &transferLimitReader{reader: strings.NewReader("abcdef"), remaining: 5}
+	_, err = io.ReadAll(reader)
+	if err != errTransferTooLarge || !reader.exceeded {
+		t.Errorf("Over the limit: %v, exceeded = %t", err, reader.exceeded)
+	}
+}
+
+func TestTransferLimitWriter(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	writer := &transferLimitWriter{w: recorder, filename: "home.tar", remaining: 4}
+	if n, err := writer.Write([]byte("abc")); n != 3 || err != nil {
+		t.Fatalf("First write = %d, %v", n, err)
+	}
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != tarContentType ||
+		recorder.Header().Get("Content-Disposition") != `attachment; filename="home.tar"` {
+		t.Errorf("Headers were not sent with the first write: %d %v", recorder.Code, recorder.Header())
+	}
+	if _, err := writer.Write([]byte("de")); err != errTransferTooLarge {
+		t.Errorf("Write over the limit = %v", err)
+	}
+	if recorder.Body.String() != "abc" {
+		t.Errorf("Body = %q, want the writes under the limit", recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	writer = &transferLimitWriter{w: recorder, filename: "home.tar", remaining: -1}
+	if _, err := writer.Write(make([]byte, 1024)); err != nil || recorder.Body.Len() != 1024 {
+		t.Errorf("Unlimited write = %v, %d bytes sent", err, recorder.Body.Len())
+	}
+}
+
+func TestGetTransferPath(t *testing.T) {
+	tests := []struct {
+		query string
+		path  string
+		valid bool
+	}{
+		{"path=/root/file.txt", "/root/file.txt", true},
+		{"path=/", "/", true},
+		{"path=root/file.txt", "", false},
+		{"path=../etc/passwd", "", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		transferPath, err := getTransferPath(httptest.NewRequest("GET", "/files?"+test.query, nil))
+		if (err == nil) != test.valid || transferPath != test.path {
+			t.Errorf("getTransferPath(%q) = %q, %v", test.query, transferPath, err)
+		}
+	}
+}
+
+//startTestSizeHost Starts a fake docker host whose containers have written sizeRw bytes
+func startTestSizeHost(t *testing.T, sizeRw int64) *DockerInstance {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/json") || r.URL.Query().Get("size") == "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, `{"Id":"container","SizeRw":%d}`, sizeRw)
+	}))
+	t.Cleanup(server.Close)
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := &DockerInstance{ID: 1, ConnectionType: "local", Name: "local"}
+	setHostConnected(host, client)
+	setTestDockerInstances(t, host)
+	return host
+}
+
+func TestGetSpaceUploadLimit(t *testing.T) {
+	defer viper.Set("FileUploadMaxBytes", nil)
+	host := startTestSizeHost(t, 700)
+	tests := []struct {
+		name      string
+		maxBytes  int64
+		diskBytes int64
+		limit     int64
+	}{
+		{"no limits", 0, 0, -1},
+		{"upload limit only", 500, 0, 500},
+		{"disk left is lower", 500, 1000, 300},
+		{"upload limit is lower", 200, 1000, 200},
+		{"disk only", 0, 1000, 300},
+		{"disk is full", 500, 600, 0},
+	}
+	for _, test := range tests {
+		viper.Set("FileUploadMaxBytes", test.maxBytes)
+		space := Space{HostID: host.ID, ContainerID: "container", DiskBytes: test.diskBytes}
+		limit, err := getSpaceUploadLimit(space)
+		if err != nil || limit != test.limit {
+			t.Errorf("%s: limit = %d (%v), want %d", test.name, limit, err, test.limit)
+		}
+	}
+
+	host.ID = 2
+	if _, err := getSpaceUploadLimit(Space{HostID: 1, ContainerID: "container", DiskBytes: 1000}); err == nil {
+		t.Error("No error when the host of the space is not connected")
+	}
+}
@@ -0,0 +1,195 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package userspaced
+
+import (
+	"sync"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/jinzhu/gorm"
+	"github.com/spf13/viper"
+)
+
+//hostReconnectState Tracks the reconnection attempts for a host that is down
+type hostReconnectState struct {
+	failures    uint      //Number of reconnection attempts that failed in a row
+	nextAttempt time.Time //Reconnection will not be attempted before this time
+}
+
+var hostReconnectStates = make(map[uint]*hostReconnectState)
+var hostReconnectStatesLock sync.Mutex
+
+//hostHealthLock Guards IsConnected, DockerClient, LastSeen, LastError and LastErrorMessage of hosts. The health
+//monitor changes them while API requests, proxies and the scheduler read them.
+var hostHealthLock sync.RWMutex
+
+//getHostClient Returns the client of a host and whether the host is connected
+func getHostClient(instance *DockerInstance) (*docker.Client, bool) {
+	if instance == nil {
+		return nil, false
+	}
+	hostHealthLock.RLock()
+	defer hostHealthLock.RUnlock()
+	return instance.DockerClient, instance.IsConnected
+}
+
+//isHostConnected Returns true if a host is connected
+func isHostConnected(instance *DockerInstance) bool {
+	_, connected := getHostClient(instance)
+	return connected
+}
+
+//copyDockerInstance Returns a copy of a host that can be read or marshalled while the health monitor runs
+func copyDockerInstance(instance *DockerInstance) DockerInstance {
+	hostHealthLock.RLock()
+	defer hostHealthLock.RUnlock()
+	return *instance
+}
+
+//setHostConnected Records that a host is reachable with a client
+func setHostConnected(instance *DockerInstance, client *docker.Client) {
+	hostHealthLock.Lock()
+	defer hostHealthLock.Unlock()
+	instance.IsConnected = true
+	instance.DockerClient = client
+	instance.LastSeen = time.Now()
+}
+
+//setHostError Records an error talking to a host. The host is marked as disconnected if disconnect is true.
+func setHostError(instance *DockerInstance, err error, disconnect bool) {
+	hostHealthLock.Lock()
+	defer hostHealthLock.Unlock()
+	if disconnect {
+		instance.IsConnected = false
+	}
+	instance.LastError = time.Now()
+	instance.LastErrorMessage = err.Error()
+}
+
+//cacheDisconnectedDockerInstance Adds a host that could not be reached to the cache so that it can be reconnected later
+func cacheDisconnectedDockerInstance(instance *DockerInstance, err error) {
+	setHostError(instance, err, true)
+	dockerInstanceSliceLock.Lock()
+	defer dockerInstanceSliceLock.Unlock()
+	DockerInstances = append(DockerInstances, instance)
+}
+
+//startHostHealthMonitor Periodically checks every host and reconnects to the ones that went down
+func startHostHealthMonitor(db *gorm.DB) {
+	interval := getClampedInterval("HostHealthCheckIntervalSeconds", minLoopInterval)
+	log.Infof("Host Health Monitor Started. Checking every %s\n", interval)
+	for true {
+		for _, instance := range getCachedDockerInstances() {
+			checkDockerHostHealth(db, instance)
+		}
+		time.Sleep(interval)
+	}
+}
+
+//checkDockerHostHealth Pings a connected host or tries to reconnect to a disconnected host
+func checkDockerHostHealth(db *gorm.DB, instance *DockerInstance) {
+	if client, connected := getHostClient(instance); connected {
+		err := client.Ping()
+		if err != nil {
+			markDockerHostDown(db, instance, err)
+			return
+		}
+		hostHealthLock.Lock()
+		instance.LastSeen = time.Now()
+		hostHealthLock.Unlock()
+		ensureSpaceEventListener(db, instance)
+		return
+	}
+
+	//Wait for the backoff to pass before trying again
+	hostReconnectStatesLock.Lock()
+	state, exists := hostReconnectStates[instance.ID]
+	if !exists {
+		state = &hostReconnectState{}
+		hostReconnectStates[instance.ID] = state
+	}
+	hostReconnectStatesLock.Unlock()
+	if time.Now().Before(state.nextAttempt) {
+		return
+	}
+
+	log.Infof("Attempting to reconnect to host %s(%d)\n", instance.Name, instance.ID)
+	_, err := startDockerClient(instance)
+	if err != nil {
+		state.failures++
+		backoff := getReconnectBackoff(state.failures)
+		state.nextAttempt = time.Now().Add(backoff)
+		setHostError(instance, err, false)
+		saveDockerHostHealth(db, instance)
+		log.Warningf("Reconnection to host %s(%d) failed. Retrying in %s\n", instance.Name, instance.ID, backoff)
+		return
+	}
+	hostReconnectStatesLock.Lock()
+	delete(hostReconnectStates, instance.ID)
+	hostReconnectStatesLock.Unlock()
+	saveDockerHostHealth(db, instance)
+	log.Infof("Reconnected to host %s(%d)\n", instance.Name, instance.ID)
+	ensureSpaceEventListener(db, instance)
+	resyncSpacesOnHost(db, instance.ID)
+}
+
+//markDockerHostDown Flags a host as disconnected after a failed health check
+func markDockerHostDown(db *gorm.DB, instance *DockerInstance, err error) {
+	log.Criticalf("Host %s(%d) failed health check: %s\n", instance.Name, instance.ID, err.Error())
+	setHostError(instance, err, true)
+	saveDockerHostHealth(db, instance)
+}
+
+//getReconnectBackoff Doubles the wait between reconnection attempts up to the maximum in the config
+func getReconnectBackoff(failures uint) time.Duration {
+	maxBackoff := time.Duration(viper.GetInt("HostReconnectMaxBackoffSeconds")) * time.Second
+	backoff := getClampedInterval("HostHealthCheckIntervalSeconds", minLoopInterval)
+	for i := uint(1); i < failures && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	return backoff
+}
+
+//saveDockerHostHealth Stores the health fields of a host without touching its configuration
+func saveDockerHostHealth(db *gorm.DB, instance *DockerInstance) {
+	health := copyDockerInstance(instance)
+	err := db.Model(&DockerInstance{ID: health.ID}).Updates(map[string]interface{}{
+		"is_connected":       health.IsConnected,
+		"last_seen":          health.LastSeen,
+		"last_error":         health.LastError,
+		"last_error_message": health.LastErrorMessage,
+	}).Error
+	if err != nil {
+		log.Warningf("Error saving health of host %s(%d): %s\n", instance.Name, instance.ID, err.Error())
+	}
+}
+
+//resyncSpacesOnHost Inspects the spaces of a host that came back so they do not stay in "host error"
+func resyncSpacesOnHost(db *gorm.DB, hostID uint) {
+	var spaces []Space
+	db.Where("host_id = ?", hostID).Find(&spaces)
+	for _, space := range spaces {
+		if space.SpaceState == "host error" {
+			space.SpaceState = "recovering"
+		}
+		updateSpaceState(db, space)
+	}
+}
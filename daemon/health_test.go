@@ -0,0 +1,76 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package userspaced
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestGetReconnectBackoff(t *testing.T) {
+	viper.Set("HostHealthCheckIntervalSeconds", 10)
+	viper.Set("HostReconnectMaxBackoffSeconds", 60)
+	defer viper.Set("HostHealthCheckIntervalSeconds", nil)
+	defer viper.Set("HostReconnectMaxBackoffSeconds", nil)
+	tests := []struct {
+		failures uint
+		want     time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{4, 60 * time.Second},
+		{20, 60 * time.Second},
+	}
+	for _, test := range tests {
+		if backoff := getReconnectBackoff(test.failures); backoff != test.want {
+			t.Errorf("Backoff after %d failures = %s, want %s", test.failures, backoff, test.want)
+		}
+	}
+}
+
+//TestHostHealthIsGuarded Run with -race to catch unguarded access to the health fields
+func TestHostHealthIsGuarded(t *testing.T) {
+	instance := &DockerInstance{ID: 1}
+	var wait sync.WaitGroup
+	wait.Add(2)
+	go func() {
+		defer wait.Done()
+		for i := 0; i < 100; i++ {
+			setHostConnected(instance, nil)
+			setHostError(instance, errors.New("down"), true)
+		}
+	}()
+	go func() {
+		defer wait.Done()
+		for i := 0; i < 100; i++ {
+			isHostConnected(instance)
+			copyDockerInstance(instance)
+		}
+	}()
+	wait.Wait()
+	if isHostConnected(instance) {
+		t.Error("Host should be disconnected after the last error")
+	}
+	if isHostConnected(nil) {
+		t.Error("A missing host cannot be connected")
+	}
+}
@@ -0,0 +1,258 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package userspaced
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/spf13/viper"
+)
+
+//spaceServicePort Port on the space that the HTTP proxy forwards to
+const spaceServicePort = "1337"
+
+//httpProxyCacheTime How long the address of a space is remembered before it is looked up again
+const httpProxyCacheTime = 30 * time.Second
+
+//httpProxyAccessInterval LastNetAccess is written at most this often for a space so busy spaces do not hammer the database
+const httpProxyAccessInterval = time.Minute
+
+//routedSpaceNamePattern Names that are valid DNS labels. Only spaces with such a name can be reached through the HTTP
+//proxy, which matches them regardless of case.
+var routedSpaceNamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+//routedSpaceNameLock Makes the check that a routed name is free and the save of the space that takes it happen together
+var routedSpaceNameLock sync.Mutex
+
+//httpProxyTarget Where requests for a subdomain are sent
+type httpProxyTarget struct {
+	spaceID    uint      //Space that owns the subdomain
+	address    string    //host:port of the service port of the space
+	expires    time.Time //The target is looked up again after this time
+	lastAccess time.Time //Last time LastNetAccess was written
+}
+
+//spaceHTTPProxy Routes <spacename>.<domain> to the service port of the space
+type spaceHTTPProxy struct {
+	db      *gorm.DB
+	domain  string
+	targets map[string]*httpProxyTarget
+	lock    sync.Mutex
+	proxy   *httputil.ReverseProxy
+}
+
+//targetContextKey Carries the target of a request from ServeHTTP to the director
+type targetContextKey struct{}
+
+//startHTTPProxy Starts the HTTP and, if configured, HTTPS listeners of the proxy
+func startHTTPProxy(db *gorm.DB) {
+	domain := strings.ToLower(strings.Trim(viper.GetString("HTTPProxyDomain"), "."))
+	if domain == "" {
+		log.Critical("HTTPProxyDomain must be set to use the HTTP proxy")
+		return
+	}
+	spaceProxy := &spaceHTTPProxy{
+		db:      db,
+		domain:  domain,
+		targets: make(map[string]*httpProxyTarget),
+	}
+	spaceProxy.proxy = &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			target := r.Context().Value(targetContextKey{}).(string)
+			r.URL.Scheme = "http"
+			r.URL.Host = target
+			//Leave the Host header alone so the space can see which name it was reached by
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Debugf("HTTP proxy error for %s: %s\n", r.Host, err.Error())
+			w.WriteHeader(http.StatusBadGateway)
+			fmt.Fprint(w, "The space is not responding\n")
+		},
+	}
+
+	tlsListenAddress := viper.GetString("HTTPProxyTLSListenAddress")
+	if tlsListenAddress != "" {
+		certFile := viper.GetString("HTTPProxyCertificate")
+		keyFile := viper.GetString("HTTPProxyKey")
+		err := ensureWildcardCertificate(domain, certFile, keyFile)
+		if err != nil {
+			log.Criticalf("Error creating HTTP proxy certificate: %s\n", err.Error())
+		} else {
+			go func() {
+				log.Infof("HTTPS Proxy listening on %s for *.%s\n", tlsListenAddress, domain)
+				err := http.ListenAndServeTLS(tlsListenAddress, certFile, keyFile, spaceProxy)
+				log.Criticalf("HTTPS proxy stopped: %s\n", err.Error())
+			}()
+		}
+	}
+
+	listenAddress := viper.GetString("HTTPProxyListenAddress")
+	if listenAddress != "" {
+		log.Infof("HTTP Proxy listening on %s for *.%s\n", listenAddress, domain)
+		err := http.ListenAndServe(listenAddress, spaceProxy)
+		log.Criticalf("HTTP proxy stopped: %s\n", err.Error())
+	}
+}
+
+//ensureWildcardCertificate Creates a self-signed certificate for *.domain unless the admin supplied one
+func ensureWildcardCertificate(domain string, certFile string, keyFile string) error {
+	_, errKey := os.Stat(keyFile)
+	_, errCert := os.Stat(certFile)
+	if !os.IsNotExist(errKey) && !os.IsNotExist(errCert) {
+		return nil
+	}
+	log.Warningf("Generating self-signed certificate for *.%s\n", domain)
+	privateKey, certificate, err := CreateSelfSignedCertificate("*." + domain)
+	if err != nil {
+		return err
+	}
+	err = WriteCertificateToFile(certificate, certFile)
+	if err != nil {
+		return err
+	}
+	return WritePrivateKeyToFile(privateKey, keyFile)
+}
+
+//ServeHTTP Forwards a request to the space named by the subdomain
+func (p *spaceHTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := strings.ToLower(r.Host)
+	if splitHost, _, err := net.SplitHostPort(host); err == nil {
+		host = splitHost
+	}
+	if !strings.HasSuffix(host, "."+p.domain) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "Unknown host\n")
+		return
+	}
+	subdomain := strings.TrimSuffix(host, "."+p.domain)
+	if strings.Contains(subdomain, ".") {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "Unknown host\n")
+		return
+	}
+
+	target, err := p.getTarget(subdomain)
+	if err != nil {
+		log.Debugf("HTTP proxy could not route %s: %s\n", host, err.Error())
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "Space not found\n")
+		return
+	}
+	p.recordAccess(target)
+
+	//WebSocket upgrades are passed through by the reverse proxy
+	p.proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), targetContextKey{}, target.address)))
+}
+
+//getTarget Returns where requests for a subdomain go. The subdomain is the name of the space.
+func (p *spaceHTTPProxy) getTarget(subdomain string) (*httpProxyTarget, error) {
+	p.lock.Lock()
+	target, cached := p.targets[subdomain]
+	p.lock.Unlock()
+	if cached && time.Now().Before(target.expires) {
+		return target, nil
+	}
+
+	if !routedSpaceNamePattern.MatchString(subdomain) {
+		return nil, errors.New("Not a valid space name")
+	}
+	//Names are unique from when a space is created. Older databases may still hold a name more than once and it is
+	//not up to the proxy to pick one of them.
+	var spaces []Space
+	err := p.db.Where("lower(friendly_name) = ? AND archived = ?", subdomain, false).Limit(2).Find(&spaces).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(spaces) == 0 {
+		return nil, errors.New("No space with this name")
+	}
+	if len(spaces) > 1 {
+		log.Warningf("HTTP proxy is not routing %s since more than one space has that name\n", subdomain)
+		return nil, errors.New("More than one space has this name")
+	}
+	space := spaces[0]
+	//Look the address up first so that a space that cannot be reached is not resumed for nothing
+	address, err := getSpaceIPAddress(space)
+	if err != nil {
+		return nil, err
+	}
+	//Anyone can send a request so only spaces that went idle are woken up, and only if the admin allows it
+	if space.SpaceState == "paused" {
+		if !viper.GetBool("HTTPProxyResumeSpaces") {
+			return nil, errors.New("Space is paused")
+		}
+		err = resumeIdleSpace(p.db, space)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	newTarget := &httpProxyTarget{
+		spaceID: space.ID,
+		address: net.JoinHostPort(address, spaceServicePort),
+		expires: time.Now().Add(httpProxyCacheTime),
+	}
+	p.lock.Lock()
+	if cached {
+		newTarget.lastAccess = target.lastAccess
+	}
+	p.targets[subdomain] = newTarget
+	p.lock.Unlock()
+	return newTarget, nil
+}
+
+//createSpaceRecord Saves a new space. Names that the HTTP proxy routes have to be unique among the live spaces, so the
+//name is checked and the space saved under a lock.
+func createSpaceRecord(db *gorm.DB, space *Space) error {
+	if viper.GetBool("HTTPProxyEnabled") && routedSpaceNamePattern.MatchString(strings.ToLower(space.FriendlyName)) {
+		routedSpaceNameLock.Lock()
+		defer routedSpaceNameLock.Unlock()
+		var count int
+		err := db.Model(&Space{}).Where("lower(friendly_name) = ? AND archived = ?", strings.ToLower(space.FriendlyName), false).Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return errors.New("Space name is already in use")
+		}
+	}
+	return db.Create(space).Error
+}
+
+//recordAccess Updates LastNetAccess of the space behind a target
+func (p *spaceHTTPProxy) recordAccess(target *httpProxyTarget) {
+	p.lock.Lock()
+	now := time.Now()
+	if now.Sub(target.lastAccess) < httpProxyAccessInterval {
+		p.lock.Unlock()
+		return
+	}
+	target.lastAccess = now
+	p.lock.Unlock()
+	p.db.Model(&Space{ID: target.spaceID}).Update("last_net_access", now)
+}
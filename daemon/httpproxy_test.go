@@ -0,0 +1,124 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package userspaced
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestCreateSpaceRecordKeepsRoutedNamesUnique(t *testing.T) {
+	db := newTestDatabase(t)
+	viper.Set("HTTPProxyEnabled", true)
+	defer viper.Set("HTTPProxyEnabled", nil)
+
+	tests := []struct {
+		space Space
+		valid bool
+	}{
+		{Space{OwnerID: 1, FriendlyName: "web"}, true},
+		//Another user cannot take the name, not even with different case
+		{Space{OwnerID: 2, FriendlyName: "Web"}, false},
+		{Space{OwnerID: 1, FriendlyName: "web"}, false},
+		//Names that are not DNS labels are never routed so they may repeat
+		{Space{OwnerID: 1, FriendlyName: "my space"}, true},
+		{Space{OwnerID: 2, FriendlyName: "my space"}, true},
+	}
+	for _, test := range tests {
+		space := test.space
+		err := createSpaceRecord(db, &space)
+		if (err == nil) != test.valid {
+			t.Errorf("Creating %q for user %d: expected success to be %t, got %v", space.FriendlyName, space.OwnerID, test.valid, err)
+		}
+	}
+
+	//Archived spaces give their name up
+	db.Model(&Space{}).Where("friendly_name = ?", "web").Update("archived", true)
+	err := createSpaceRecord(db, &Space{OwnerID: 2, FriendlyName: "web"})
+	if err != nil {
+		t.Errorf("The name of an archived space could not be reused: %s", err.Error())
+	}
+}
+
+func TestHTTPProxyGetTarget(t *testing.T) {
+	db := newTestDatabase(t)
+	host := startTestDockerHost(t, "172.17.0.2")
+	db.Create(&Space{ID: 1, OwnerID: 1, HostID: host.ID, ContainerID: "container", FriendlyName: "Web", SpaceState: "running"})
+	db.Create(&Space{ID: 42, OwnerID: 1, HostID: host.ID, ContainerID: "container", FriendlyName: "api", SpaceState: "running"})
+	db.Create(&Space{ID: 3, OwnerID: 1, HostID: host.ID, ContainerID: "container", FriendlyName: "twice", SpaceState: "running"})
+	db.Create(&Space{ID: 4, OwnerID: 2, HostID: host.ID, ContainerID: "container", FriendlyName: "twice", SpaceState: "running"})
+	db.Create(&Space{ID: 5, OwnerID: 1, HostID: host.ID, ContainerID: "container", FriendlyName: "held", SpaceState: "paused"})
+	db.Create(&Space{ID: 6, OwnerID: 1, HostID: host.ID, ContainerID: "container", FriendlyName: "idle", SpaceState: "paused", PausedByLifecycle: true})
+
+	tests := []struct {
+		subdomain string
+		spaceID   uint
+	}{
+		{"web", 1},
+		{"api", 42},
+		//Spaces are not reachable by ID
+		{"42", 0},
+		{"missing", 0},
+		//Names held by more than one space are not routed
+		{"twice", 0},
+		//Nothing is resumed unless the admin allows it
+		{"held", 0},
+		{"idle", 0},
+	}
+	for _, test := range tests {
+		proxy := &spaceHTTPProxy{db: db, domain: "example.edu", targets: make(map[string]*httpProxyTarget)}
+		target, err := proxy.getTarget(test.subdomain)
+		if test.spaceID == 0 {
+			if err == nil {
+				t.Errorf("%s was routed to Space %d", test.subdomain, target.spaceID)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s was not routed: %s", test.subdomain, err.Error())
+			continue
+		}
+		if target.spaceID != test.spaceID || target.address != "172.17.0.2:1337" {
+			t.Errorf("%s was routed to Space %d at %s", test.subdomain, target.spaceID, target.address)
+		}
+	}
+}
+
+func TestHTTPProxyResumesOnlyIdleSpaces(t *testing.T) {
+	db := newTestDatabase(t)
+	host := startTestDockerHost(t, "172.17.0.2")
+	viper.Set("HTTPProxyResumeSpaces", true)
+	defer viper.Set("HTTPProxyResumeSpaces", nil)
+	db.Create(&Space{ID: 1, OwnerID: 1, HostID: host.ID, ContainerID: "container", FriendlyName: "held", SpaceState: "paused"})
+	db.Create(&Space{ID: 2, OwnerID: 1, HostID: host.ID, ContainerID: "container", FriendlyName: "idle", SpaceState: "paused", PausedByLifecycle: true})
+	proxy := &spaceHTTPProxy{db: db, domain: "example.edu", targets: make(map[string]*httpProxyTarget)}
+
+	_, err := proxy.getTarget("held")
+	if err == nil {
+		t.Error("A space paused by its owner was resumed")
+	}
+	_, err = proxy.getTarget("idle")
+	if err != nil {
+		t.Fatalf("An idle space was not resumed: %s", err.Error())
+	}
+	var space Space
+	db.First(&space, 2)
+	if space.SpaceState != "running" || space.PausedByLifecycle {
+		t.Errorf("Resumed space is %s with PausedByLifecycle %t", space.SpaceState, space.PausedByLifecycle)
+	}
+}
@@ -0,0 +1,210 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package userspaced
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/jinzhu/gorm"
+	"golang.org/x/crypto/ssh"
+)
+
+//spaceSSHHome Home directory of the user that keys are installed for
+const spaceSSHHome = "/root"
+
+//KeyProvisionResult Whether a key made it into the authorized_keys file of a space
+type KeyProvisionResult struct {
+	Name string //Friendly name of the key
+	Err  error  //Why the key was left out. Nil if it was installed.
+}
+
+//getKeysForSpace Returns the keys that should be able to log into a space. This is the selected key if SSHKeyID
+//is set and every key of the owner otherwise.
+func getKeysForSpace(db *gorm.DB, space Space) ([]UserPublicKey, error) {
+	var keys []UserPublicKey
+	if space.SSHKeyID != 0 {
+		var key UserPublicKey
+		query := db.Where("id = ? AND owner_id = ?", space.SSHKeyID, space.OwnerID).First(&key)
+		//Deleting the selected key revokes access rather than falling back to every key of the owner
+		if query.RecordNotFound() {
+			log.Warningf("The selected SSH key of Space %d no longer exists\n", space.ID)
+			return keys, nil
+		}
+		if query.Error != nil {
+			return nil, query.Error
+		}
+		return append(keys, key), nil
+	}
+	err := db.Where("owner_id = ?", space.OwnerID).Order("id asc").Find(&keys).Error
+	return keys, err
+}
+
+//buildAuthorizedKeys Builds an authorized_keys file from a set of keys. Keys that do not parse are left out so a single
+//bad key cannot break the file, and the returned results say which ones.
+func buildAuthorizedKeys(keys []UserPublicKey) (string, []KeyProvisionResult) {
+	var authorizedKeys bytes.Buffer
+	var results []KeyProvisionResult
+	for _, key := range keys {
+		//Write the key back out so that options or extra lines in the stored text cannot end up in the file
+		line, _, _, err := parsePublicKey(key.PublicKey)
+		if err != nil {
+			results = append(results, KeyProvisionResult{Name: key.Name, Err: err})
+			continue
+		}
+		authorizedKeys.WriteString(line + "\n")
+		results = append(results, KeyProvisionResult{Name: key.Name})
+	}
+	return authorizedKeys.String(), results
+}
+
+//AddPublicKeysToSpace Replaces the authorized_keys file of a space with the keys that should be able to log into it.
+//The key of the SSH gateway is always included. The results only cover the keys of the user.
+func AddPublicKeysToSpace(db *gorm.DB, space Space) (error, []KeyProvisionResult) {
+	keys, err := getKeysForSpace(db, space)
+	if err != nil {
+		return err, nil
+	}
+	authorizedKeys, results := buildAuthorizedKeys(keys)
+	//The SSH gateway logs into the space with its own key
+	if gatewayKey, enabled := getSSHGatewayAuthorizedKey(); enabled {
+		authorizedKeys += gatewayKey + "\n"
+	}
+
+	dockerHost := getHostByID(space.HostID)
+	dockerClient, connected := getHostClient(dockerHost)
+	if !connected {
+		return errors.New("Host of space is not connected"), nil
+	}
+	//Upload .ssh and the file in one archive so the permissions that sshd insists on are set from the start
+	var archive bytes.Buffer
+	tarWriter := tar.NewWriter(&archive)
+	now := time.Now()
+	err = tarWriter.WriteHeader(&tar.Header{Name: ".ssh/", Typeflag: tar.TypeDir, Mode: 0700, ModTime: now})
+	if err != nil {
+		return err, nil
+	}
+	err = tarWriter.WriteHeader(&tar.Header{Name: ".ssh/authorized_keys", Mode: 0600, Size: int64(len(authorizedKeys)), ModTime: now})
+	if err != nil {
+		return err, nil
+	}
+	_, err = tarWriter.Write([]byte(authorizedKeys))
+	if err != nil {
+		return err, nil
+	}
+	err = tarWriter.Close()
+	if err != nil {
+		return err, nil
+	}
+	err = dockerClient.UploadToContainer(space.ContainerID, docker.UploadToContainerOptions{
+		InputStream: &archive,
+		Path:        spaceSSHHome,
+	})
+	if err != nil {
+		return err, nil
+	}
+	log.Infof("Updated authorized_keys of Space %d\n", space.ID)
+	return nil, results
+}
+
+//addPendingKeys Adds the keys of a space whose keys could not be added when it was created. Returns true if they were added.
+func addPendingKeys(db *gorm.DB, space Space) bool {
+	err, _ := AddPublicKeysToSpace(db, space)
+	if err != nil {
+		log.Warningf("Still unable to add keys to Space %s(%d): %s\n", space.FriendlyName, space.ID, err.Error())
+		return false
+	}
+	db.Model(&Space{ID: space.ID}).Update("keys_pending", false)
+	log.Infof("Added the pending keys of Space %s(%d)\n", space.FriendlyName, space.ID)
+	return true
+}
+
+//syncKeysToSpaces Rewrites authorized_keys in the running spaces of a user after their keys change.
+//Paused spaces are brought up to date when they are resumed.
+func syncKeysToSpaces(db *gorm.DB, ownerID uint) {
+	var spaces []Space
+	db.Where("owner_id = ? AND space_state = ? AND archived = ?", ownerID, "running", false).Find(&spaces)
+	for _, space := range spaces {
+		err, results := AddPublicKeysToSpace(db, space)
+		if err != nil {
+			log.Warningf("Error updating keys of Space %s(%d): %s\n", space.FriendlyName, space.ID, err.Error())
+			continue
+		}
+		for _, result := range results {
+			if result.Err != nil {
+				log.Warningf("Skipped key %s for Space %d: %s\n", result.Name, space.ID, result.Err.Error())
+			}
+		}
+	}
+}
+
+//parsePublicKey Checks that a key is a single valid authorized_keys line. Returns the key in a normalized form,
+//its comment and its SHA256 fingerprint.
+func parsePublicKey(publicKey string) (string, string, string, error) {
+	parsedKey, comment, options, rest, err := ssh.ParseAuthorizedKey([]byte(publicKey))
+	if err != nil {
+		return "", "", "", errors.New("Not a valid SSH public key")
+	}
+	if len(options) > 0 {
+		return "", "", "", errors.New("Key options are not allowed")
+	}
+	if len(bytes.TrimSpace(rest)) > 0 {
+		return "", "", "", errors.New("Only one key may be added at a time")
+	}
+	normalizedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(parsedKey)))
+	if comment != "" {
+		normalizedKey += " " + comment
+	}
+	return normalizedKey, comment, ssh.FingerprintSHA256(parsedKey), nil
+}
+
+//assignKeyPublicIDs Gives keys that were added before keys had public IDs and fingerprints their own
+func assignKeyPublicIDs(db *gorm.DB) {
+	var keys []UserPublicKey
+	db.Where("public_id = ? OR public_id IS NULL", "").Find(&keys)
+	for _, key := range keys {
+		publicID, err := newPublicID()
+		if err != nil {
+			log.Warningf("Error generating ID for key %d: %s\n", key.ID, err.Error())
+			return
+		}
+		updates := map[string]interface{}{"public_id": publicID}
+		if _, _, fingerprint, err := parsePublicKey(key.PublicKey); err == nil {
+			updates["fingerprint"] = fingerprint
+		}
+		db.Model(&UserPublicKey{ID: key.ID}).Updates(updates)
+	}
+}
+
+//newPublicID Generates a random UUID to identify a record in the API
+func newPublicID() (string, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	//Version 4, variant 1
+	id[6] = (id[6] & 0x0f) | 0x40
+	id[8] = (id[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:]), nil
+}
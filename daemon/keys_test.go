@@ -0,0 +1,149 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package userspaced
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	auth "github.com/twa16/go-auth"
+	"golang.org/x/crypto/ssh"
+)
+
+//newTestPublicKey Generates a key and returns it along with its authorized_keys line
+func newTestPublicKey(t *testing.T) (ssh.PublicKey, string) {
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sshKey, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshKey)))
+}
+
+func TestParsePublicKey(t *testing.T) {
+	_, authorizedKey := newTestPublicKey(t)
+	_, otherKey := newTestPublicKey(t)
+	tests := []struct {
+		name       string
+		publicKey  string
+		normalized string
+		comment    string
+		valid      bool
+	}{
+		{"bare key", authorizedKey, authorizedKey, "", true},
+		{"comment", authorizedKey + " user@laptop", authorizedKey + " user@laptop", "user@laptop", true},
+		{"surrounding whitespace", "  " + authorizedKey + " user@laptop\n", authorizedKey + " user@laptop", "user@laptop", true},
+		{"options", `command="/bin/sh" ` + authorizedKey, "", "", false},
+		{"two keys", authorizedKey + "\n" + otherKey, "", "", false},
+		{"garbage", "ssh-ed25519 not-a-key", "", "", false},
+		{"empty", "", "", "", false},
+	}
+	for _, test := range tests {
+		normalized, comment, fingerprint, err := parsePublicKey(test.publicKey)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: expected valid to be %t, got %v", test.name, test.valid, err)
+			continue
+		}
+		if !test.valid {
+			continue
+		}
+		if normalized != test.normalized || comment != test.comment {
+			t.Errorf("%s: got key %q with comment %q", test.name, normalized, comment)
+		}
+		if !strings.HasPrefix(fingerprint, "SHA256:") {
+			t.Errorf("%s: fingerprint %q is not a SHA256 fingerprint", test.name, fingerprint)
+		}
+	}
+}
+
+func TestGetKeysForSpace(t *testing.T) {
+	db := newTestDatabase(t)
+	first := UserPublicKey{OwnerID: 1, Name: "first"}
+	second := UserPublicKey{OwnerID: 1, Name: "second"}
+	other := UserPublicKey{OwnerID: 2, Name: "other"}
+	db.Create(&first)
+	db.Create(&second)
+	db.Create(&other)
+
+	tests := []struct {
+		name  string
+		space Space
+		keys  []string
+	}{
+		{"every key of the owner", Space{OwnerID: 1}, []string{"first", "second"}},
+		{"selected key", Space{OwnerID: 1, SSHKeyID: second.ID}, []string{"second"}},
+		//A key of another user is never used even if it was selected
+		{"key of another user", Space{OwnerID: 1, SSHKeyID: other.ID}, nil},
+		{"deleted key", Space{OwnerID: 1, SSHKeyID: 99}, nil},
+	}
+	for _, test := range tests {
+		keys, err := getKeysForSpace(db, test.space)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+		var names []string
+		for _, key := range keys {
+			names = append(names, key.Name)
+		}
+		if strings.Join(names, ",") != strings.Join(test.keys, ",") {
+			t.Errorf("%s: expected keys %v, got %v", test.name, test.keys, names)
+		}
+	}
+}
+
+func TestAuthenticateGatewayUserHonoursSelectedKey(t *testing.T) {
+	db := newTestDatabase(t)
+	useTestAuthProvider(t, db)
+	user, err := authProvider.CreateUser(auth.User{Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	selectedKey, selectedLine := newTestPublicKey(t)
+	otherKey, otherLine := newTestPublicKey(t)
+	selected := UserPublicKey{OwnerID: user.ID, PublicKey: selectedLine}
+	db.Create(&selected)
+	db.Create(&UserPublicKey{OwnerID: user.ID, PublicKey: otherLine})
+	db.Create(&Space{OwnerID: user.ID, FriendlyName: "pinned", SSHKeyID: selected.ID})
+	db.Create(&Space{OwnerID: user.ID, FriendlyName: "open"})
+
+	tests := []struct {
+		login string
+		key   ssh.PublicKey
+		valid bool
+	}{
+		{"alice+pinned", selectedKey, true},
+		{"alice+pinned", otherKey, false},
+		{"alice+open", selectedKey, true},
+		{"alice+open", otherKey, true},
+		{"alice+missing", selectedKey, false},
+		//Spaces are only found by name
+		{"alice+2", selectedKey, false},
+		{"bob+open", selectedKey, false},
+	}
+	for _, test := range tests {
+		_, err := authenticateGatewayUser(db, test.login, test.key)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: expected access to be %t, got %v", test.login, test.valid, err)
+		}
+	}
+}
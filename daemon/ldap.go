@@ -0,0 +1,221 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package userspaced
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/spf13/viper"
+)
+
+//errInvalidLDAPLogin Returned for every kind of failed login so that callers cannot tell which part was wrong
+var errInvalidLDAPLogin = errors.New("Invalid username or password")
+
+//connectLDAP Connects to the LDAP server, upgrades the connection with StartTLS if configured and binds as the service account
+func connectLDAP() (*ldap.Conn, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: viper.GetBool("LDAPInsecureSkipVerify")}
+	conn, err := ldap.DialURL(viper.GetString("LDAPURL"), ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(time.Duration(viper.GetInt("LDAPTimeoutSeconds")) * time.Second)
+	if viper.GetBool("LDAPStartTLS") {
+		err = conn.StartTLS(tlsConfig)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	err = bindLDAPServiceAccount(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+//bindLDAPServiceAccount Binds as the account that searches for users. Searches are anonymous if no bind DN is set.
+func bindLDAPServiceAccount(conn *ldap.Conn) error {
+	bindDN := viper.GetString("LDAPBindDN")
+	if bindDN == "" {
+		return nil
+	}
+	return conn.Bind(bindDN, viper.GetString("LDAPBindPassword"))
+}
+
+//authenticateLDAP Finds a user in the directory and checks their password by binding as them
+func authenticateLDAP(username string, password string) (*ExternalUser, error) {
+	//An empty password would be an unauthenticated bind, which many servers accept
+	if username == "" || password == "" {
+		return nil, errInvalidLDAPLogin
+	}
+	conn, err := connectLDAP()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	usernameAttribute := viper.GetString("LDAPUsernameAttribute")
+	groupAttribute := viper.GetString("LDAPGroupAttribute")
+	search := ldap.NewSearchRequest(
+		viper.GetString("LDAPSearchBase"),
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(viper.GetString("LDAPUserFilter"), ldap.EscapeFilter(username)),
+		[]string{usernameAttribute, "mail", "givenName", "sn", groupAttribute},
+		nil,
+	)
+	result, err := conn.Search(search)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Entries) != 1 {
+		log.Debugf("LDAP search for %s returned %d entries\n", username, len(result.Entries))
+		return nil, errInvalidLDAPLogin
+	}
+	entry := result.Entries[0]
+	err = conn.Bind(entry.DN, password)
+	if err != nil {
+		log.Debugf("LDAP bind as %s failed: %s\n", entry.DN, err.Error())
+		return nil, errInvalidLDAPLogin
+	}
+
+	ldapUsername, err := getLDAPUsername(entry.GetAttributeValue(usernameAttribute), username)
+	if err != nil {
+		log.Warningf("LDAP user %s has an invalid username\n", entry.DN)
+		return nil, err
+	}
+	user := &ExternalUser{
+		Username:  ldapUsername,
+		Issuer:    ldapIssuer,
+		Subject:   ldapUsername,
+		Email:     entry.GetAttributeValue("mail"),
+		FirstName: entry.GetAttributeValue("givenName"),
+		LastName:  entry.GetAttributeValue("sn"),
+		Groups:    entry.GetAttributeValues(groupAttribute),
+	}
+
+	//Directories without memberOf list the members on the groups instead
+	groupSearchBase := viper.GetString("LDAPGroupSearchBase")
+	if groupSearchBase != "" {
+		//The user may not be allowed to search for groups
+		err = bindLDAPServiceAccount(conn)
+		if err != nil {
+			return nil, err
+		}
+		groupSearch := ldap.NewSearchRequest(
+			groupSearchBase,
+			ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+			fmt.Sprintf(viper.GetString("LDAPGroupFilter"), ldap.EscapeFilter(entry.DN)),
+			[]string{"dn"},
+			nil,
+		)
+		groupResult, err := conn.Search(groupSearch)
+		if err != nil {
+			return nil, err
+		}
+		for _, group := range groupResult.Entries {
+			user.Groups = append(user.Groups, group.DN)
+		}
+	}
+	return user, nil
+}
+
+//getLDAPUsername Returns the username of a directory user. The username attribute is used if the entry has it, otherwise
+//the name that was given at login.
+func getLDAPUsername(attributeValue string, loginName string) (string, error) {
+	if attributeValue == "" {
+		return normalizeExternalUsername(loginName)
+	}
+	return normalizeExternalUsername(attributeValue)
+}
+
+//getLDAPGroupPermissions Returns the permissions that come from LDAPGroupPermissions, and which of them a set of groups grants.
+//Group DNs are compared without regard to case.
+func getLDAPGroupPermissions(groups []string) ([]string, []string) {
+	//viper lower cases the keys of maps
+	groupPermissions := viper.GetStringMapStringSlice("LDAPGroupPermissions")
+	var managed []string
+	for _, permissions := range groupPermissions {
+		managed = append(managed, permissions...)
+	}
+	var granted []string
+	for _, group := range groups {
+		granted = append(granted, groupPermissions[strings.ToLower(group)]...)
+	}
+	return managed, granted
+}
+
+//postLDAPLoginHandler Handles POST /ldaplogin - Logs in with a username and password from the LDAP directory
+func postLDAPLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if !viper.GetBool("LDAPEnabled") {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "LDAP login is disabled\n")
+		return
+	}
+
+	var loginRequest LoginRequest
+	err := json.NewDecoder(r.Body).Decode(&loginRequest)
+	if err != nil || loginRequest.Username == "" || loginRequest.Password == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Invalid Request: username and password are required\n")
+		return
+	}
+
+	ldapUser, err := authenticateLDAP(loginRequest.Username, loginRequest.Password)
+	if err == errInvalidExternalUsername {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, err.Error()+"\n")
+		return
+	}
+	if err == errInvalidLDAPLogin {
+		log.Warningf("Failed LDAP login for %s from %s\n", loginRequest.Username, r.RemoteAddr)
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, err.Error()+"\n")
+		return
+	}
+	if err != nil {
+		log.Warningf("Error handling LDAP login: %s\n", err.Error())
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprint(w, "Error contacting the LDAP server\n")
+		return
+	}
+	log.Infof("Authenticated %s using LDAP\n", ldapUser.Username)
+
+	user, err := provisionExternalUser(*ldapUser)
+	if err != nil {
+		log.Warningf("Error provisioning LDAP user %s: %s\n", ldapUser.Username, err.Error())
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "Error")
+		return
+	}
+	managed, granted := getLDAPGroupPermissions(ldapUser.Groups)
+	err = syncManagedPermissions(user.ID, managed, granted)
+	if err != nil {
+		log.Criticalf("Error updating permissions of %s: %s\n", user.Username, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Internal Server Error")
+		return
+	}
+	sendNewSession(w, user, loginRequest.Persistent)
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package userspaced
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestGetLDAPGroupPermissions(t *testing.T) {
+	viper.Set("LDAPGroupPermissions", map[string][]string{
+		"cn=admins,ou=groups,dc=example,dc=com": {"admin.*"},
+		"cn=club,ou=groups,dc=example,dc=com":   {"space.create", "space.gpu"},
+	})
+	defer viper.Set("LDAPGroupPermissions", nil)
+
+	tests := []struct {
+		name    string
+		groups  []string
+		granted []string
+	}{
+		{"no groups", nil, nil},
+		{"unmapped group", []string{"cn=staff,ou=groups,dc=example,dc=com"}, nil},
+		{"one group", []string{"cn=club,ou=groups,dc=example,dc=com"}, []string{"space.create", "space.gpu"}},
+		//Directories do not agree on the case of DNs
+		{"different case", []string{"CN=Admins,OU=Groups,DC=example,DC=com"}, []string{"admin.*"}},
+		{"several groups", []string{"cn=admins,ou=groups,dc=example,dc=com", "cn=club,ou=groups,dc=example,dc=com"}, []string{"admin.*", "space.create", "space.gpu"}},
+	}
+	for _, test := range tests {
+		managed, granted := getLDAPGroupPermissions(test.groups)
+		sort.Strings(managed)
+		sort.Strings(granted)
+		if strings.Join(managed, ",") != "admin.*,space.create,space.gpu" {
+			t.Errorf("%s: every mapped permission should be managed, got %v", test.name, managed)
+		}
+		if strings.Join(granted, ",") != strings.Join(test.granted, ",") {
+			t.Errorf("%s: expected %v to be granted, got %v", test.name, test.granted, granted)
+		}
+	}
+}
+
+func TestGetLDAPUsername(t *testing.T) {
+	tests := []struct {
+		attribute string
+		login     string
+		username  string
+		valid     bool
+	}{
+		{"alice", "alice", "alice", true},
+		//Directories match names without case so both spellings have to end up as the same user
+		{"Alice", "ALICE", "alice", true},
+		{"", "Bob.Smith", "bob.smith", true},
+		//The attribute is preferred over what was typed
+		{"carol", "carol@example.com", "carol", true},
+		{"", "carol@example.com", "", false},
+		{"dave smith", "dave", "", false},
+		{"x", "x", "", false},
+		{"-admin", "-admin", "", false},
+		{"", "", "", false},
+	}
+	for _, test := range tests {
+		username, err := getLDAPUsername(test.attribute, test.login)
+		if (err == nil) != test.valid || username != test.username {
+			t.Errorf("getLDAPUsername(%q, %q) = %q, %v", test.attribute, test.login, username, err)
+		}
+	}
+}
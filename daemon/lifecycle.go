@@ -0,0 +1,194 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package userspaced
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/spf13/viper"
+)
+
+//LifecyclePolicy How long a space may be idle before it is paused and then archived. A value of 0 disables the step.
+type LifecyclePolicy struct {
+	PauseAfterMinutes   int //Minutes of inactivity before a running space is paused
+	ArchiveAfterMinutes int //Minutes of inactivity before a space is archived
+}
+
+//LifecycleOverride Replaces parts of the global policy for the spaces of an image or a user.
+//Fields that are not set are inherited. User overrides win over image overrides.
+type LifecycleOverride struct {
+	ImageID             uint   //Image the override applies to
+	Username            string //User the override applies to
+	PauseAfterMinutes   *int   //Replaces PauseAfterMinutes if set
+	ArchiveAfterMinutes *int   //Replaces ArchiveAfterMinutes if set
+}
+
+//LifecycleAction Something the lifecycle engine did or would do to a space
+type LifecycleAction struct {
+	SpaceID      uint      `json:"space_id"`      //ID of the space
+	FriendlyName string    `json:"space_name"`    //Friendly name of the space
+	OwnerID      uint      `json:"owner_id"`      //Owner of the space
+	Action       string    `json:"action"`        //pause or archive
+	LastActivity time.Time `json:"last_activity"` //Last time the space was used
+	Reason       string    `json:"reason"`        //Why the action was chosen
+	Applied      bool      `json:"applied"`       //False if this was a dry run
+	Error        string    `json:"error"`         //Set if applying the action failed
+}
+
+//getLifecycleOverrides Reads the overrides from the config
+func getLifecycleOverrides() []LifecycleOverride {
+	var overrides []LifecycleOverride
+	err := viper.UnmarshalKey("LifecycleOverrides", &overrides)
+	if err != nil {
+		log.Warningf("Error reading LifecycleOverrides: %s\n", err.Error())
+	}
+	return overrides
+}
+
+//getLifecyclePolicy Works out the policy for a space by layering the image and user overrides on the global policy
+func getLifecyclePolicy(space Space, ownerName string, overrides []LifecycleOverride) LifecyclePolicy {
+	policy := LifecyclePolicy{
+		PauseAfterMinutes:   viper.GetInt("LifecyclePauseAfterMinutes"),
+		ArchiveAfterMinutes: viper.GetInt("LifecycleArchiveAfterMinutes"),
+	}
+	apply := func(override LifecycleOverride) {
+		if override.PauseAfterMinutes != nil {
+			policy.PauseAfterMinutes = *override.PauseAfterMinutes
+		}
+		if override.ArchiveAfterMinutes != nil {
+			policy.ArchiveAfterMinutes = *override.ArchiveAfterMinutes
+		}
+	}
+	for _, override := range overrides {
+		if override.ImageID != 0 && override.ImageID == space.ImageID {
+			apply(override)
+		}
+	}
+	for _, override := range overrides {
+		if override.Username != "" && override.Username == ownerName {
+			apply(override)
+		}
+	}
+	return policy
+}
+
+//getLastSpaceActivity Returns the last time anyone used a space
+func getLastSpaceActivity(space Space) time.Time {
+	lastActivity := space.CreatedAt
+	for _, activity := range []time.Time{space.LastSSHAccess, space.LastNetAccess, space.ResumedAt} {
+		if activity.After(lastActivity) {
+			lastActivity = activity
+		}
+	}
+	return lastActivity
+}
+
+//evaluateLifecyclePolicies Decides what should happen to every space without doing it
+func evaluateLifecyclePolicies(db *gorm.DB) ([]LifecycleAction, error) {
+	actions := []LifecycleAction{}
+	var spaces []Space
+	err := db.Where("archived = ?", false).Find(&spaces).Error
+	if err != nil {
+		return actions, err
+	}
+	overrides := getLifecycleOverrides()
+	usernames := make(map[uint]string)
+	for _, space := range spaces {
+		//Only spaces that are settled are touched
+		if space.SpaceState != "running" && space.SpaceState != "paused" {
+			continue
+		}
+		//Look up the owner once since user overrides are by name
+		if _, exists := usernames[space.OwnerID]; !exists {
+			owner, err := authProvider.GetUserByID(space.OwnerID)
+			if err == nil {
+				usernames[space.OwnerID] = owner.Username
+			} else {
+				usernames[space.OwnerID] = ""
+			}
+		}
+		policy := getLifecyclePolicy(space, usernames[space.OwnerID], overrides)
+		lastActivity := getLastSpaceActivity(space)
+		idle := time.Since(lastActivity)
+
+		action := LifecycleAction{
+			SpaceID:      space.ID,
+			FriendlyName: space.FriendlyName,
+			OwnerID:      space.OwnerID,
+			LastActivity: lastActivity,
+		}
+		if policy.ArchiveAfterMinutes > 0 && idle > time.Duration(policy.ArchiveAfterMinutes)*time.Minute {
+			action.Action = "archive"
+			action.Reason = fmt.Sprintf("idle for %s, archive after %d minutes", idle.Truncate(time.Minute), policy.ArchiveAfterMinutes)
+		} else if space.SpaceState == "running" && policy.PauseAfterMinutes > 0 && idle > time.Duration(policy.PauseAfterMinutes)*time.Minute {
+			action.Action = "pause"
+			action.Reason = fmt.Sprintf("idle for %s, pause after %d minutes", idle.Truncate(time.Minute), policy.PauseAfterMinutes)
+		} else {
+			continue
+		}
+		actions = append(actions, action)
+	}
+	return actions, nil
+}
+
+//applyLifecyclePolicies Pauses and archives idle spaces. Nothing is changed if dryRun is true.
+func applyLifecyclePolicies(db *gorm.DB, dryRun bool) []LifecycleAction {
+	actions, err := evaluateLifecyclePolicies(db)
+	if err != nil {
+		log.Criticalf("Error evaluating lifecycle policies: %s\n", err.Error())
+		return actions
+	}
+	for i, action := range actions {
+		if dryRun {
+			log.Infof("Lifecycle (dry run): would %s Space %s(%d): %s\n", action.Action, action.FriendlyName, action.SpaceID, action.Reason)
+			continue
+		}
+		log.Infof("Lifecycle: %s Space %s(%d): %s\n", action.Action, action.FriendlyName, action.SpaceID, action.Reason)
+		var space Space
+		err = db.First(&space, action.SpaceID).Error
+		if err == nil {
+			if action.Action == "archive" {
+				err = ArchiveSpace(db, space)
+			} else {
+				err = PauseSpace(db, space)
+				//Lets the HTTP proxy tell idle spaces from ones the owner paused
+				if err == nil {
+					err = db.Model(&Space{ID: space.ID}).Update("paused_by_lifecycle", true).Error
+				}
+			}
+		}
+		if err != nil {
+			log.Warningf("Lifecycle: failed to %s Space %d: %s\n", action.Action, action.SpaceID, err.Error())
+			actions[i].Error = err.Error()
+			continue
+		}
+		actions[i].Applied = true
+	}
+	return actions
+}
+
+//startLifecycleEngine Periodically applies the lifecycle policies
+func startLifecycleEngine(db *gorm.DB) {
+	interval := getClampedInterval("LifecycleCheckIntervalSeconds", minLoopInterval)
+	log.Infof("Lifecycle Policy Engine Started. Checking every %s\n", interval)
+	for true {
+		time.Sleep(interval)
+		applyLifecyclePolicies(db, viper.GetBool("LifecycleDryRun"))
+	}
+}
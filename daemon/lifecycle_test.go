@@ -0,0 +1,107 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package userspaced
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestGetLifecyclePolicy(t *testing.T) {
+	viper.Set("LifecyclePauseAfterMinutes", 60)
+	viper.Set("LifecycleArchiveAfterMinutes", 600)
+	defer viper.Set("LifecyclePauseAfterMinutes", nil)
+	defer viper.Set("LifecycleArchiveAfterMinutes", nil)
+	minutes := func(value int) *int {
+		return &value
+	}
+	overrides := []LifecycleOverride{
+		{ImageID: 2, PauseAfterMinutes: minutes(30)},
+		{Username: "jdoe", PauseAfterMinutes: minutes(0)},
+		{Username: "alice", ArchiveAfterMinutes: minutes(0)},
+	}
+	tests := []struct {
+		name    string
+		imageID uint
+		owner   string
+		want    LifecyclePolicy
+	}{
+		{"global", 1, "bob", LifecyclePolicy{60, 600}},
+		{"image", 2, "bob", LifecyclePolicy{30, 600}},
+		{"user wins over image", 2, "jdoe", LifecyclePolicy{0, 600}},
+		{"fields are inherited", 2, "alice", LifecyclePolicy{30, 0}},
+	}
+	for _, test := range tests {
+		policy := getLifecyclePolicy(Space{ImageID: test.imageID}, test.owner, overrides)
+		if policy != test.want {
+			t.Errorf("%s: policy = %+v, want %+v", test.name, policy, test.want)
+		}
+	}
+}
+
+func TestGetLastSpaceActivity(t *testing.T) {
+	created := time.Now().Add(-10 * time.Hour)
+	ssh := time.Now().Add(-5 * time.Hour)
+	net := time.Now().Add(-time.Hour)
+	space := Space{CreatedAt: created, LastSSHAccess: ssh, LastNetAccess: net}
+	if activity := getLastSpaceActivity(space); !activity.Equal(net) {
+		t.Errorf("Last activity = %s, want %s", activity, net)
+	}
+	if activity := getLastSpaceActivity(Space{CreatedAt: created}); !activity.Equal(created) {
+		t.Errorf("Last activity of an unused space = %s, want %s", activity, created)
+	}
+}
+
+func TestApplyLifecyclePoliciesDryRun(t *testing.T) {
+	db := newTestDatabase(t)
+	useTestAuthProvider(t, db)
+	viper.Set("LifecyclePauseAfterMinutes", 60)
+	viper.Set("LifecycleArchiveAfterMinutes", 600)
+	defer viper.Set("LifecyclePauseAfterMinutes", nil)
+	defer viper.Set("LifecycleArchiveAfterMinutes", nil)
+
+	idle := Space{FriendlyName: "idle", SpaceState: "running", CreatedAt: time.Now().Add(-2 * time.Hour)}
+	abandoned := Space{FriendlyName: "abandoned", SpaceState: "paused", CreatedAt: time.Now().Add(-24 * time.Hour)}
+	busy := Space{FriendlyName: "busy", SpaceState: "running", CreatedAt: time.Now().Add(-24 * time.Hour), LastSSHAccess: time.Now()}
+	creating := Space{FriendlyName: "creating", SpaceState: "creation started", CreatedAt: time.Now().Add(-24 * time.Hour)}
+	for _, space := range []*Space{&idle, &abandoned, &busy, &creating} {
+		db.Create(space)
+	}
+
+	actions := applyLifecyclePolicies(db, true)
+	got := make(map[uint]string)
+	for _, action := range actions {
+		if action.Applied {
+			t.Errorf("Dry run applied %s to Space %d", action.Action, action.SpaceID)
+		}
+		got[action.SpaceID] = action.Action
+	}
+	want := map[uint]string{idle.ID: "pause", abandoned.ID: "archive"}
+	if len(got) != len(want) || got[idle.ID] != "pause" || got[abandoned.ID] != "archive" {
+		t.Errorf("Actions = %v, want %v", got, want)
+	}
+	//Nothing may change in a dry run
+	for _, space := range []Space{idle, abandoned} {
+		var stored Space
+		db.First(&stored, space.ID)
+		if stored.SpaceState != space.SpaceState || stored.Archived {
+			t.Errorf("Space %s changed to %s in a dry run", space.FriendlyName, stored.SpaceState)
+		}
+	}
+}
@@ -0,0 +1,347 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package userspaced
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/jinzhu/gorm"
+	"github.com/spf13/viper"
+	auth "github.com/twa16/go-auth"
+	"golang.org/x/crypto/bcrypt"
+)
+
+//bcryptMaxPasswordBytes bcrypt ignores everything past this many bytes
+const bcryptMaxPasswordBytes = 72
+
+//usernamePattern Usernames end up in SSH logins and subdomains so they are kept to a safe set of characters
+var usernamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{1,31}$`)
+
+//adminPasswordEnv Environment variable that sets the password of the bootstrapped admin
+const adminPasswordEnv = "USERSPACE_ADMIN_PASSWORD"
+
+//generatedPasswordChars Characters that generated passwords are made of. Easily confused characters are left out.
+const generatedPasswordChars = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+//loginFailedHash Compared against when the user does not exist so that unknown users take as long as wrong passwords
+var loginFailedHash, _ = bcrypt.GenerateFromPassword([]byte("userspace"), bcrypt.DefaultCost)
+
+//hashPassword Hashes a password with bcrypt at the configured cost
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), viper.GetInt("BcryptCost"))
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+//checkPasswordPolicy Returns an error describing why a password is not allowed
+func checkPasswordPolicy(username string, password string) error {
+	minLength := viper.GetInt("PasswordMinLength")
+	if len(password) < minLength {
+		return fmt.Errorf("Password must be at least %d characters", minLength)
+	}
+	if len(password) > bcryptMaxPasswordBytes {
+		return fmt.Errorf("Password must be at most %d bytes", bcryptMaxPasswordBytes)
+	}
+	if username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		return errors.New("Password must not contain the username")
+	}
+	hasLetter := false
+	hasOther := false
+	for _, char := range password {
+		if unicode.IsLetter(char) {
+			hasLetter = true
+		} else {
+			hasOther = true
+		}
+	}
+	if !hasLetter || !hasOther {
+		return errors.New("Password must contain letters and at least one number or symbol")
+	}
+	return nil
+}
+
+//checkUserPassword Returns the user if the password matches. Users without a password, such as CAS users, cannot log in this way.
+func checkUserPassword(username string, password string) (*auth.User, error) {
+	invalidLogin := errors.New("Invalid username or password")
+	user, err := authProvider.GetUser(username)
+	if err != nil || user.PasswordHash == "" {
+		bcrypt.CompareHashAndPassword(loginFailedHash, []byte(password))
+		return nil, invalidLogin
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		return nil, invalidLogin
+	}
+	return &user, nil
+}
+
+//sendNewSession Starts a session for a user and sends it the same way CAS logins do
+func sendNewSession(w http.ResponseWriter, user auth.User, persistent bool) {
+	session, err := authProvider.GenerateSessionKey(user.ID, persistent)
+	if err != nil {
+		log.Critical("Error Generating Session: " + err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Internal Server Error")
+		return
+	}
+	//JSONify and send our response
+	jsonBytes, _ := json.Marshal(session)
+	fmt.Fprint(w, string(jsonBytes))
+}
+
+//postLoginHandler Handles POST /login - Logs in a local user with a username and password
+func postLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if !viper.GetBool("AllowLocalLogin") {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "Local login is disabled\n")
+		return
+	}
+
+	var loginRequest LoginRequest
+	err := json.NewDecoder(r.Body).Decode(&loginRequest)
+	if err != nil || loginRequest.Username == "" || loginRequest.Password == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Invalid Request: username and password are required\n")
+		return
+	}
+
+	user, err := checkUserPassword(loginRequest.Username, loginRequest.Password)
+	if err != nil {
+		log.Warningf("Failed local login for %s from %s\n", loginRequest.Username, r.RemoteAddr)
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, err.Error()+"\n")
+		return
+	}
+	log.Infof("Authenticated %s using a password\n", user.Username)
+	sendNewSession(w, *user, loginRequest.Persistent)
+}
+
+//postRegisterHandler Handles POST /register - Creates a local user and logs them in
+func postRegisterHandler(w http.ResponseWriter, r *http.Request) {
+	if !viper.GetBool("AllowLocalLogin") || !viper.GetBool("AllowRegistration") {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "Registration is disabled\n")
+		return
+	}
+
+	var registration RegistrationRequest
+	err := json.NewDecoder(r.Body).Decode(&registration)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Invalid Request: Error Decoding JSON\n")
+		return
+	}
+	if !usernamePattern.MatchString(registration.Username) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Invalid Request: usernames are 2 to 32 lowercase letters, numbers, dots, dashes or underscores\n")
+		return
+	}
+	//Keeps registered names apart from the names that CAS, LDAP and OIDC users log in with
+	if prefix := getRegistrationUsernamePrefix(); prefix != "" && !strings.HasPrefix(registration.Username, prefix) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Invalid Request: usernames of registered users start with "+prefix+"\n")
+		return
+	}
+	err = checkPasswordPolicy(registration.Username, registration.Password)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Invalid Request: "+err.Error()+"\n")
+		return
+	}
+	_, err = authProvider.GetUser(registration.Username)
+	if err == nil {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, "Username is taken\n")
+		return
+	}
+	if err.Error() != "record not found" {
+		log.Warning("Error checking username for registration: " + err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Internal Server Error")
+		return
+	}
+
+	var user auth.User
+	user.Username = registration.Username
+	user.Email = registration.Email
+	user.FirstName = registration.FirstName
+	user.LastName = registration.LastName
+	user.PasswordHash, err = hashPassword(registration.Password)
+	if err != nil {
+		log.Criticalf("Error hashing password: %s\n", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Internal Server Error")
+		return
+	}
+	//Same permissions that users who log in with CAS start with
+	user.Permissions = []auth.Permission{
+		{Permission: "user.*"},
+	}
+	user, err = authProvider.CreateUser(user)
+	if err != nil {
+		log.Criticalf("Error Creating User: %s\n", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Internal Server Error")
+		return
+	}
+	log.Infof("Registered local user %s\n", user.Username)
+	sendNewSession(w, user, false)
+}
+
+//generatePassword Generates a random password of the given length
+func generatePassword(length int) (string, error) {
+	password := make([]byte, length)
+	max := big.NewInt(int64(len(generatedPasswordChars)))
+	for i := range password {
+		index, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		password[i] = generatedPasswordChars[index.Int64()]
+	}
+	return string(password), nil
+}
+
+//getAdminPassword Returns the admin password from the environment or the config. A random password is generated
+//if neither set one, in which case the second value is true.
+func getAdminPassword() (string, bool, error) {
+	if password := os.Getenv(adminPasswordEnv); password != "" {
+		return password, false, nil
+	}
+	if password := viper.GetString("AdminPassword"); password != "" {
+		return password, false, nil
+	}
+	password, err := generatePassword(24)
+	return password, true, err
+}
+
+//logAdminPassword Prints a generated password. This is the only time it is shown.
+func logAdminPassword(username string, password string) {
+	log.Warningf(
+		"\n====================================\n"+
+			"== Admin user: %s\n"+
+			"== Password:   %s\n"+
+			"== This password will not be shown again\n"+
+			"====================================\n", username, password)
+}
+
+//ensureAdminUser Creates the admin user on first start so that someone can manage hosts and spaces
+func ensureAdminUser() {
+	username := viper.GetString("AdminUsername")
+	_, err := authProvider.GetUser(username)
+	if err == nil {
+		return
+	}
+	if err.Error() != "record not found" {
+		log.Criticalf("Error checking for admin user: %s\n", err.Error())
+		return
+	}
+
+	password, generated, err := getAdminPassword()
+	if err != nil {
+		log.Criticalf("Error generating admin password: %s\n", err.Error())
+		return
+	}
+	if !generated {
+		if err := checkPasswordPolicy(username, password); err != nil {
+			log.Warningf("The configured admin password does not meet the password policy: %s\n", err.Error())
+		}
+	}
+	adminUser := auth.User{
+		FirstName: "Default",
+		LastName:  "Administrator",
+		Username:  username,
+		Permissions: []auth.Permission{
+			{Permission: "*.*"},
+		},
+	}
+	adminUser.PasswordHash, err = hashPassword(password)
+	if err != nil {
+		log.Criticalf("Error hashing admin password: %s\n", err.Error())
+		return
+	}
+	_, err = authProvider.CreateUser(adminUser)
+	if err != nil {
+		log.Criticalf("Error creating admin user: %s\n", err.Error())
+		return
+	}
+	log.Warningf("Created admin user %s\n", username)
+	if generated {
+		logAdminPassword(username, password)
+	}
+	if !viper.GetBool("AllowLocalLogin") {
+		log.Warning("AllowLocalLogin is off so the admin user cannot log in with its password")
+	}
+}
+
+//ResetAdminPassword Sets a new password for the admin user. The admin is created if it does not exist.
+//The password is read from the environment or the config, or generated and printed if neither set one.
+func ResetAdminPassword() {
+	initLogging()
+	loadConfig()
+	db, err := openDatabase()
+	if err != nil {
+		log.Fatalf("Failed to connect to database. Error: %s\n", err.Error())
+	}
+	defer db.Close()
+	database = db
+	authProvider.Database = db
+	authProvider.Startup()
+
+	err = resetAdminPassword(db)
+	if err != nil {
+		log.Fatalf("Error resetting admin password: %s\n", err.Error())
+	}
+}
+
+//resetAdminPassword Does the work of ResetAdminPassword once the database is open
+func resetAdminPassword(db *gorm.DB) error {
+	username := viper.GetString("AdminUsername")
+	adminUser, err := authProvider.GetUser(username)
+	if err != nil {
+		log.Warningf("Admin user %s does not exist, creating it\n", username)
+		ensureAdminUser()
+		return nil
+	}
+	password, generated, err := getAdminPassword()
+	if err != nil {
+		return err
+	}
+	passwordHash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	err = db.Model(&adminUser).Update("password_hash", passwordHash).Error
+	if err != nil {
+		return err
+	}
+	log.Warningf("Reset the password of admin user %s\n", username)
+	if generated {
+		logAdminPassword(username, password)
+	}
+	return nil
+}
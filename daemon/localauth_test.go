@@ -0,0 +1,281 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package userspaced
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/spf13/viper"
+	auth "github.com/twa16/go-auth"
+	"golang.org/x/crypto/bcrypt"
+)
+
+//setUpLocalAuthTest Turns on local login and registration with a fast bcrypt cost for the length of a test
+func setUpLocalAuthTest(t *testing.T) {
+	db := newTestDatabase(t)
+	useTestAuthProvider(t, db)
+	settings := map[string]interface{}{
+		"AllowLocalLogin":   true,
+		"AllowRegistration": true,
+		"PasswordMinLength": 10,
+		"BcryptCost":        bcrypt.MinCost,
+	}
+	for key, value := range settings {
+		viper.Set(key, value)
+	}
+	t.Cleanup(func() {
+		for key := range settings {
+			viper.Set(key, nil)
+		}
+	})
+}
+
+//createTestLocalUser Creates a user that logs in with a password
+func createTestLocalUser(t *testing.T, username string, password string) auth.User {
+	passwordHash, err := hashPassword(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := authProvider.CreateUser(auth.User{Username: username, PasswordHash: passwordHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+//postJSONToHandler Sends a value as the JSON body of a POST request to a handler
+func postJSONToHandler(handler http.HandlerFunc, body interface{}) *httptest.ResponseRecorder {
+	jsonBytes, _ := json.Marshal(body)
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("POST", "/", bytes.NewReader(jsonBytes)))
+	return recorder
+}
+
+func TestCheckPasswordPolicy(t *testing.T) {
+	viper.Set("PasswordMinLength", 10)
+	defer viper.Set("PasswordMinLength", nil)
+	tests := []struct {
+		username string
+		password string
+		valid    bool
+	}{
+		{"alice", "correct-horse", true},
+		{"alice", "battery staple 9", true},
+		{"alice", "short-1", false},
+		//bcrypt would ignore everything after 72 bytes
+		{"alice", "a1" + string(bytes.Repeat([]byte("x"), 70)), true},
+		{"alice", "a1" + string(bytes.Repeat([]byte("x"), 71)), false},
+		{"alice", "ALICE-rocks-1", false},
+		{"alice", "onlylettershere", false},
+		{"alice", "1234567890123", false},
+		{"", "no-user-given", true},
+	}
+	for _, test := range tests {
+		err := checkPasswordPolicy(test.username, test.password)
+		if (err == nil) != test.valid {
+			t.Errorf("checkPasswordPolicy(%q, %q) = %v", test.username, test.password, err)
+		}
+	}
+}
+
+func TestCheckUserPassword(t *testing.T) {
+	setUpLocalAuthTest(t)
+	createTestLocalUser(t, "alice", "correct-horse")
+	//Users from CAS, LDAP and OIDC have no password
+	_, err := authProvider.CreateUser(auth.User{Username: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		username string
+		password string
+		valid    bool
+	}{
+		{"alice", "correct-horse", true},
+		{"alice", "wrong-horse1", false},
+		{"bob", "", false},
+		{"bob", "anything-1", false},
+		{"carol", "correct-horse", false},
+	}
+	for _, test := range tests {
+		user, err := checkUserPassword(test.username, test.password)
+		if (err == nil) != test.valid {
+			t.Errorf("%s with %q: %v", test.username, test.password, err)
+			continue
+		}
+		if test.valid && user.Username != test.username {
+			t.Errorf("%s: logged in as %s", test.username, user.Username)
+		}
+	}
+}
+
+func TestPostLoginHandler(t *testing.T) {
+	setUpLocalAuthTest(t)
+	createTestLocalUser(t, "alice", "correct-horse")
+	_, err := authProvider.CreateUser(auth.User{Username: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		localAllowed bool
+		request      LoginRequest
+		status       int
+	}{
+		{"valid", true, LoginRequest{Username: "alice", Password: "correct-horse"}, http.StatusOK},
+		{"local login disabled", false, LoginRequest{Username: "alice", Password: "correct-horse"}, http.StatusForbidden},
+		{"no password", true, LoginRequest{Username: "alice"}, http.StatusBadRequest},
+		{"wrong password", true, LoginRequest{Username: "alice", Password: "wrong-horse1"}, http.StatusForbidden},
+		{"external user", true, LoginRequest{Username: "bob", Password: "anything-1"}, http.StatusForbidden},
+		{"unknown user", true, LoginRequest{Username: "carol", Password: "correct-horse"}, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		viper.Set("AllowLocalLogin", test.localAllowed)
+		recorder := postJSONToHandler(postLoginHandler, test.request)
+		if recorder.Code != test.status {
+			t.Errorf("%s: expected %d, got %d %s", test.name, test.status, recorder.Code, recorder.Body.String())
+		}
+	}
+}
+
+func TestPostRegisterHandler(t *testing.T) {
+	setUpLocalAuthTest(t)
+	createTestLocalUser(t, "local-taken", "correct-horse")
+	defer viper.Set("SupportsCAS", nil)
+	defer viper.Set("RegistrationUsernamePrefix", nil)
+
+	tests := []struct {
+		name                string
+		registrationAllowed bool
+		casEnabled          bool
+		username            string
+		password            string
+		status              int
+	}{
+		{"valid", true, false, "alice", "correct-horse", http.StatusOK},
+		{"registration disabled", false, false, "bob", "correct-horse", http.StatusForbidden},
+		{"invalid username", true, false, "Bob Smith", "correct-horse", http.StatusBadRequest},
+		{"weak password", true, false, "bob", "horse", http.StatusBadRequest},
+		{"password with the username", true, false, "bob", "bob-is-great-1", http.StatusBadRequest},
+		//With an external provider registered names have to carry the prefix
+		{"name without the prefix", true, true, "carol", "correct-horse", http.StatusBadRequest},
+		{"name with the prefix", true, true, "local-carol", "correct-horse", http.StatusOK},
+		{"taken username", true, true, "local-taken", "correct-horse", http.StatusConflict},
+	}
+	for _, test := range tests {
+		viper.Set("AllowRegistration", test.registrationAllowed)
+		viper.Set("SupportsCAS", test.casEnabled)
+		viper.Set("RegistrationUsernamePrefix", "local-")
+		recorder := postJSONToHandler(postRegisterHandler, RegistrationRequest{Username: test.username, Password: test.password})
+		if recorder.Code != test.status {
+			t.Errorf("%s: expected %d, got %d %s", test.name, test.status, recorder.Code, recorder.Body.String())
+		}
+	}
+
+	//Registered users log in with the password they chose and start with the usual permissions
+	user, err := checkUserPassword("local-carol", "correct-horse")
+	if err != nil {
+		t.Fatalf("Registered user cannot log in: %v", err)
+	}
+	var permissions []auth.Permission
+	database.Where("auth_user_id = ?", user.ID).Find(&permissions)
+	if len(permissions) != 1 || permissions[0].Permission != "user.*" {
+		t.Errorf("Registered user holds %v, want user.*", permissions)
+	}
+	if _, err := authProvider.GetUser("bob"); err == nil {
+		t.Error("A rejected registration created a user")
+	}
+}
+
+func TestEnsureAdminUser(t *testing.T) {
+	setUpLocalAuthTest(t)
+	viper.Set("AdminUsername", "admin")
+	viper.Set("AdminPassword", "config-password-1")
+	defer viper.Set("AdminUsername", nil)
+	defer viper.Set("AdminPassword", nil)
+
+	ensureAdminUser()
+	admin, err := checkUserPassword("admin", "config-password-1")
+	if err != nil {
+		t.Fatalf("Admin cannot log in with the configured password: %v", err)
+	}
+	var permissions []auth.Permission
+	database.Where("auth_user_id = ?", admin.ID).Find(&permissions)
+	if len(permissions) != 1 || permissions[0].Permission != "*.*" {
+		t.Errorf("Admin holds %v, want *.*", permissions)
+	}
+	//An existing admin is left alone even if the configured password changes
+	viper.Set("AdminPassword", "other-password-1")
+	ensureAdminUser()
+	if _, err := checkUserPassword("admin", "config-password-1"); err != nil {
+		t.Errorf("Admin password was replaced on a later start: %v", err)
+	}
+}
+
+func TestEnsureAdminUserPrefersTheEnvironment(t *testing.T) {
+	setUpLocalAuthTest(t)
+	viper.Set("AdminUsername", "admin")
+	viper.Set("AdminPassword", "config-password-1")
+	defer viper.Set("AdminUsername", nil)
+	defer viper.Set("AdminPassword", nil)
+	os.Setenv(adminPasswordEnv, "env-password-1")
+	defer os.Unsetenv(adminPasswordEnv)
+
+	ensureAdminUser()
+	if _, err := checkUserPassword("admin", "env-password-1"); err != nil {
+		t.Errorf("Admin cannot log in with the password from %s: %v", adminPasswordEnv, err)
+	}
+	if _, err := checkUserPassword("admin", "config-password-1"); err == nil {
+		t.Error("The config password was used over the environment")
+	}
+}
+
+func TestResetAdminPassword(t *testing.T) {
+	setUpLocalAuthTest(t)
+	viper.Set("AdminUsername", "admin")
+	defer viper.Set("AdminUsername", nil)
+	defer viper.Set("AdminPassword", nil)
+
+	//The admin is created if it does not exist yet
+	viper.Set("AdminPassword", "first-password-1")
+	err := resetAdminPassword(database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkUserPassword("admin", "first-password-1"); err != nil {
+		t.Fatalf("Missing admin was not created: %v", err)
+	}
+
+	viper.Set("AdminPassword", "second-password-1")
+	err = resetAdminPassword(database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkUserPassword("admin", "second-password-1"); err != nil {
+		t.Errorf("Admin cannot log in with the new password: %v", err)
+	}
+	if _, err := checkUserPassword("admin", "first-password-1"); err == nil {
+		t.Error("Admin can still log in with the old password")
+	}
+}
@@ -0,0 +1,148 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package userspaced
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+//logWriter Sends the stdout and stderr of a container to the client as they arrive
+type logWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	lock    sync.Mutex
+}
+
+//Write Sends a chunk of log output
+func (w *logWriter) Write(data []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	n, err := w.w.Write(data)
+	if w.flusher != nil {
+		w.flusher.Flush()
+	}
+	return n, err
+}
+
+//getLogsOptionsFromRequest Reads the tail, since, follow and timestamps parameters of a log request.
+//since is either a time in RFC3339 format or a duration before now such as 15m.
+func getLogsOptionsFromRequest(r *http.Request) (docker.LogsOptions, error) {
+	options := docker.LogsOptions{
+		Stdout: true,
+		Stderr: true,
+		Tail:   "all",
+	}
+	query := r.URL.Query()
+	if tail := query.Get("tail"); tail != "" && tail != "all" {
+		lines, err := strconv.Atoi(tail)
+		if err != nil || lines < 0 {
+			return options, errors.New("tail must be a number of lines or all")
+		}
+		options.Tail = tail
+	}
+	if since := query.Get("since"); since != "" {
+		sinceTime, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			duration, durationErr := time.ParseDuration(since)
+			if durationErr != nil || duration < 0 {
+				return options, errors.New("since must be an RFC3339 time or a duration")
+			}
+			sinceTime = time.Now().Add(-duration)
+		}
+		options.Since = sinceTime.Unix()
+	}
+	if follow := query.Get("follow"); follow != "" {
+		following, err := strconv.ParseBool(follow)
+		if err != nil {
+			return options, errors.New("follow must be true or false")
+		}
+		options.Follow = following
+	}
+	if timestamps := query.Get("timestamps"); timestamps != "" {
+		withTimestamps, err := strconv.ParseBool(timestamps)
+		if err != nil {
+			return options, errors.New("timestamps must be true or false")
+		}
+		options.Timestamps = withTimestamps
+	}
+	return options, nil
+}
+
+//getSpaceLogsAPIHandler Handles GET /api/v1/space/:spaceid/logs - Streams the stdout and stderr of the container of a space
+func getSpaceLogsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	//Get user and error out if it didn't work
+	user, err := getUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	space, status, err := getSpaceFromRequest(r, user, ADMIN_READ_SPACE)
+	if err != nil {
+		w.WriteHeader(status)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	options, err := getLogsOptionsFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Invalid Request: "+err.Error()+"\n")
+		return
+	}
+	//Spaces that failed before docker created a container have no logs
+	if space.ContainerID == "" {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "Space has no container\n")
+		return
+	}
+	dockerHost := getHostByID(space.HostID)
+	dockerClient, connected := getHostClient(dockerHost)
+	if !connected {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, "Host of space is not connected\n")
+		return
+	}
+	//Fail before the stream starts if the container is gone
+	_, err = dockerClient.InspectContainer(space.ContainerID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "Container of space not found\n")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	output := &logWriter{w: w}
+	output.flusher, _ = w.(http.Flusher)
+	options.Container = space.ContainerID
+	options.OutputStream = output
+	options.ErrorStream = output
+	//Stops a followed stream once the client goes away
+	options.Context = r.Context()
+	err = dockerClient.Logs(options)
+	if err != nil && r.Context().Err() == nil {
+		log.Debugf("Log stream of Space %d ended with error: %s\n", space.ID, err.Error())
+	}
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package userspaced
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGetLogsOptionsFromRequest(t *testing.T) {
+	tests := []struct {
+		query      string
+		tail       string
+		since      time.Duration //How long before now since should be. Zero means since is not set.
+		sinceTime  int64         //Expected since if it is given as a time
+		follow     bool
+		timestamps bool
+		valid      bool
+	}{
+		{"", "all", 0, 0, false, false, true},
+		{"tail=all", "all", 0, 0, false, false, true},
+		{"tail=100", "100", 0, 0, false, false, true},
+		{"tail=0", "0", 0, 0, false, false, true},
+		{"tail=-1", "", 0, 0, false, false, false},
+		{"tail=ten", "", 0, 0, false, false, false},
+		{"since=15m", "all", 15 * time.Minute, 0, false, false, true},
+		{"since=2017-06-01T12:00:00Z", "all", 0, 1496318400, false, false, true},
+		{"since=-15m", "", 0, 0, false, false, false},
+		{"since=yesterday", "", 0, 0, false, false, false},
+		{"follow=true", "all", 0, 0, true, false, true},
+		{"follow=1", "all", 0, 0, true, false, true},
+		{"follow=false", "all", 0, 0, false, false, true},
+		{"follow=always", "", 0, 0, false, false, false},
+		{"timestamps=true&tail=5&follow=true", "5", 0, 0, true, true, true},
+		{"timestamps=maybe", "", 0, 0, false, false, false},
+	}
+	for _, test := range tests {
+		before := time.Now()
+		options, err := getLogsOptionsFromRequest(httptest.NewRequest("GET", "/logs?"+test.query, nil))
+		if (err == nil) != test.valid {
+			t.Errorf("%q: error = %v, valid = %t", test.query, err, test.valid)
+			continue
+		}
+		if !test.valid {
+			continue
+		}
+		if !options.Stdout || !options.Stderr || options.Tail != test.tail ||
+			options.Follow != test.follow || options.Timestamps != test.timestamps {
+			t.Errorf("%q: got %+v", test.query, options)
+		}
+		switch {
+		case test.since != 0:
+			earliest := before.Add(-test.since).Unix()
+			latest := time.Now().Add(-test.since).Unix()
+			if options.Since < earliest || options.Since > latest {
+				t.Errorf("%q: since = %d, want between %d and %d", test.query, options.Since, earliest, latest)
+			}
+		case options.Since != test.sinceTime:
+			t.Errorf("%q: since = %d, want %d", test.query, options.Since, test.sinceTime)
+		}
+	}
+}
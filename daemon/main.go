@@ -17,7 +17,9 @@
 package userspaced
 
 import (
+	"database/sql"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/fsouza/go-dockerclient"
@@ -32,29 +34,46 @@ import (
 
 //OrchestratorInfo This struct has the data that is sent to clients when they connect
 type OrchestratorInfo struct {
-	SupportsCAS        bool   `json:"supports_cas"`         //True if the daemon supports CAS authentication
-	CASURL             string `json:"cas_url"`              //Hostname that is used to connect to the CAS server
-	AllowsLocalLogin   bool   `json:"supports_local_login"` //True is the daemon supports local users
-	AllowsRegistration bool   `json:"allows_registration"`  //True if the daemon allows registration for local users
+	SupportsCAS        bool   `json:"supports_cas"`                  //True if the daemon supports CAS authentication
+	CASURL             string `json:"cas_url"`                       //Hostname that is used to connect to the CAS server
+	AllowsLocalLogin   bool   `json:"supports_local_login"`          //True is the daemon supports local users
+	AllowsRegistration bool   `json:"allows_registration"`           //True if the daemon allows registration for local users
+	RegistrationPrefix string `json:"registration_prefix,omitempty"` //Prefix that usernames of registered users must start with
+	SupportsLDAP       bool   `json:"supports_ldap"`                 //True if users can log in with LDAP credentials at /ldaplogin
+	SupportsOIDC       bool   `json:"supports_oidc"`                 //True if users can log in with OpenID Connect at /oidclogin
+	OIDCIssuerURL      string `json:"oidc_issuer_url,omitempty"`     //Issuer of the OpenID Connect provider
+	SSHGatewayAddress  string `json:"ssh_gateway_address,omitempty"` //Address of the SSH gateway. Users log in as user+spacename.
 }
 
 //Space Struct that represents the space
 type Space struct {
-	ID            uint            `gorm:"primary_key"`               // Primary Key and ID of container
-	CreatedAt     time.Time       `json:"-"`                         // Creation time
-	ArchiveDate   time.Time       `json:"archive_date,omitempty"`    // This is the timestamp of when the space was archived. This is set if the space was archived.
-	Archived      bool            `json:"archived,omitempty"`        // This value is true if the space was deleted as a result of inactivity. All data is lost but metadata is preserved.
-	ImageID       uint            `json:"image_id,omitempty"`        // This is the image that is used by the container that contains the space. This is a link to SpaceImage.
-	LastNetAccess string          `json:"last_net_access,omitempty"` // The time this space was last accessed over the network but not SSH. This may be empty if the space was never accessed.
-	LastSSHAccess time.Time       `json:"last_ssh_access,omitempty"` // The time this space was last accessed over SSH. This may be empty if the space was never accessed.
-	OwnerID       uint            `json:"owner_id,omitempty"`        // Unique ID of the user that owns the Space. This is a link to User.
-	HostID        uint            `json:"host_id,omitempty"`         // ID of the host that contains this space
-	FriendlyName  string          `json:"space_name,omitempty"`      // Friendly name of this space
-	ContainerID   string          `json:"space_id,omitempty"`        // ID of Docker container running this space
-	SpaceState    string          `json:"space_state,omitempty"`     // Running State of Space (running, paused, archived, error)
-	SSHKeyID      uint            `json:"ssh_key_id,omitempty"`      // ID of the SSH Key that this container is using
-	PortLinks     []SpacePortLink `json:"port_links,omitempty"`      // Shows what external ports are bound to the ports on the space
-	KeepAlive     bool            `json:"keep_alive,omitempty"`      // If true, this container will be started if found to be 'exited'
+	ID                uint            `gorm:"primary_key"`                   // Primary Key and ID of container
+	CreatedAt         time.Time       `json:"-"`                             // Creation time
+	ArchiveDate       time.Time       `json:"archive_date,omitempty"`        // This is the timestamp of when the space was archived. This is set if the space was archived.
+	Archived          bool            `json:"archived,omitempty"`            // This value is true if the space was deleted as a result of inactivity. All data is lost but metadata is preserved.
+	ImageID           uint            `json:"image_id,omitempty"`            // This is the image that is used by the container that contains the space. This is a link to SpaceImage.
+	LastNetAccess     time.Time       `json:"last_net_access,omitempty"`     // The time this space was last accessed over the network but not SSH. This may be empty if the space was never accessed.
+	LastSSHAccess     time.Time       `json:"last_ssh_access,omitempty"`     // The time this space was last accessed over SSH. This may be empty if the space was never accessed.
+	OwnerID           uint            `json:"owner_id,omitempty"`            // Unique ID of the user that owns the Space. This is a link to User.
+	HostID            uint            `json:"host_id,omitempty"`             // ID of the host that contains this space
+	FriendlyName      string          `json:"space_name,omitempty"`          // Friendly name of this space
+	ContainerID       string          `json:"space_id,omitempty"`            // ID of Docker container running this space
+	SpaceState        string          `json:"space_state,omitempty"`         // Running State of Space (running, paused, archived, error)
+	SSHKeyID          uint            `json:"-"`                             // ID of the SSH Key that this container is using. Every key of the owner is used if this is 0.
+	SSHKey            string          `gorm:"-" json:"ssh_key_id,omitempty"` // Public ID of the SSH Key that this container is using
+	PortLinks         []SpacePortLink `json:"port_links,omitempty"`          // Shows what external ports are bound to the ports on the space
+	KeepAlive         bool            `json:"keep_alive,omitempty"`          // If true, this container will be started if found to be 'exited'
+	MemoryBytes       int64           `json:"memory_bytes,omitempty"`        // Memory limit of the container. Counts against the memory quota of the owner.
+	CPUShares         int64           `json:"cpu_shares,omitempty"`          // Relative CPU weight of the container. Counts against the CPU quota of the owner.
+	DiskBytes         int64           `json:"disk_bytes,omitempty"`          // Disk allotted to the container. Counts against the disk quota of the owner.
+	LastExitCode      int             `json:"last_exit_code,omitempty"`      // Exit code of the container the last time it stopped
+	LastExitTime      time.Time       `json:"last_exit_time,omitempty"`      // The time the container last stopped
+	OOMKilled         bool            `json:"oom_killed,omitempty"`          // True if the container was killed for running out of memory the last time it stopped
+	ResumedAt         time.Time       `json:"resumed_at,omitempty"`          // The time the space was last resumed. Counts as activity so the space is not paused again right away.
+	PausedByLifecycle bool            `json:"paused_by_lifecycle,omitempty"` // True if the space was paused by the lifecycle engine for being idle rather than by its owner
+	SSHSessions       int             `json:"ssh_sessions,omitempty"`        // Number of SSH sessions that are currently open
+	SSHSessionsIn     int64           `json:"ssh_sessions_in,omitempty"`     // Number of SSH sessions the space has received
+	KeysPending       bool            `json:"keys_pending,omitempty"`        // True if the keys could not be added when the space was created. They are added again on the next sync.
 }
 
 //SpacePortLink A link between container port and host port
@@ -65,6 +84,7 @@ type SpacePortLink struct {
 	ExternalPort    uint16    `json:"external_port"`            //Port that is exposed on the host
 	ExternalAddress string    `json:"external_address"`         //External address that clients would connect to the reach the space
 	DisplayAddress  string    `json:"external_display_address"` //Address that is displayed to clients as the external address
+	Proxied         bool      `json:"proxied"`                  //False if the daemon does not forward this port, such as on remote hosts. The port is then only reachable from its host.
 	SpaceID         uint      `json:"-"`                        // ID of the space that this record is associated with
 }
 
@@ -81,42 +101,165 @@ type SpaceImage struct {
 
 // SpaceUsageReport This object stores the metrics for a space at a specific point in time. The reports are not reset each time therefore the difference between two reports will show the increase in the time between the reports.
 type SpaceUsageReport struct {
-	ID              uint      `gorm:"primary_key" json:"-"` //Primary Key
-	CreatedAt       time.Time `json:"-"`                    //Creation time
-	ContainerID     string    `json:"container_id"`         // ID of the container
-	DiskUsageBytes  int64     `json:"disk_usage_bytes"`     // Number of bytes that the space is taking up on disk.
-	NetworkInBytes  int64     `json:"network_in_bytes"`     // Number of bytes that the space has received over the network. This does include SSH.
-	NetworkOutBytes int64     `json:"network_out_bytes"`    // Number of bytes that the space has sent over the network. This includes SSH.
-	ReportID        int64     `json:"report_id"`            // ID of the report
-	SSHSessionCount int64     `json:"ssh_session_count"`    // This is the number of SSH sessions the space has received.
-	Timestamp       time.Time `json:"timestamp"`            // Time this data was recorded
+	ID                 uint      `gorm:"primary_key" json:"-"`  //Primary Key
+	CreatedAt          time.Time `json:"-"`                     //Creation time
+	SpaceID            uint      `gorm:"index" json:"space_id"` // ID of the space
+	OwnerID            uint      `gorm:"index" json:"owner_id"` // ID of the user that owned the space. Kept here so usage can be reported after the space is deleted.
+	HostID             uint      `json:"host_id"`               // ID of the host the space was on
+	ContainerID        string    `json:"container_id"`          // ID of the container
+	DiskUsageBytes     int64     `json:"disk_usage_bytes"`      // Number of bytes that the space is taking up on disk.
+	NetworkInBytes     int64     `json:"network_in_bytes"`      // Number of bytes that the space has received over the network. This does include SSH.
+	NetworkOutBytes    int64     `json:"network_out_bytes"`     // Number of bytes that the space has sent over the network. This includes SSH.
+	BlockReadBytes     int64     `json:"block_read_bytes"`      // Number of bytes that the space has read from block devices
+	BlockWriteBytes    int64     `json:"block_write_bytes"`     // Number of bytes that the space has written to block devices
+	CPUTimeNanos       int64     `json:"cpu_time_nanos"`        // CPU time the space has used in nanoseconds
+	MemoryUsageBytes   int64     `json:"memory_usage_bytes"`    // Memory the space was using when the report was made. This is not a running total.
+	ReportID           int64     `json:"report_id"`             // ID of the report
+	SSHSessionCount    int64     `json:"ssh_session_count"`     // This is the number of SSH sessions the space has received.
+	Timestamp          time.Time `json:"timestamp"`             // Time this data was recorded
+	ContainerStartedAt time.Time `json:"-"`                     // Start time of the container the raw counters were read from
+	RawNetworkIn       int64     `json:"-"`                     // Received bytes as docker reported them. Used to work out the increase since the last report.
+	RawNetworkOut      int64     `json:"-"`                     // Sent bytes as docker reported them
+	RawBlockRead       int64     `json:"-"`                     // Read bytes as docker reported them
+	RawBlockWrite      int64     `json:"-"`                     // Written bytes as docker reported them
+	RawCPUTime         int64     `json:"-"`                     // CPU time as docker reported it
 }
 
 //UserPublicKey Represents a stored user public ssh key
 type UserPublicKey struct {
-	ID        uint      `gorm:"primary_key" json:"-"`  // Primary Key
-	PublicID  string    `gorm:"index" json:"space_id"` // Public UUID of this Key
-	CreatedAt time.Time `json:"-"`                     // Creation time
-	OwnerID   uint      `json:"user_id"`               // ID of user tha owns this key
-	Name      string    `json:"name"`                  // Friendly name of this key
-	PublicKey string    `json:"public_key"`            // Public key
+	ID          uint      `gorm:"primary_key" json:"-"`     // Primary Key
+	PublicID    string    `gorm:"index" json:"key_id"`      // Public UUID of this Key
+	CreatedAt   time.Time `json:"created_at"`               // Creation time
+	OwnerID     uint      `gorm:"index" json:"user_id"`     // ID of user tha owns this key
+	Name        string    `json:"name"`                     // Friendly name of this key
+	PublicKey   string    `json:"public_key"`               // Public key
+	Fingerprint string    `gorm:"index" json:"fingerprint"` // SHA256 fingerprint of the key
 }
 
 //DockerInstance Struct representing a docker instance to use for containers
 type DockerInstance struct {
-	ID                     uint           `gorm:"primary_key" json:"-"`     //Primary Key
-	CreatedAt              time.Time      `json:"-"`                        //Creation Time
-	UpdatedAt              time.Time      `json:"-"`                        //Last Update time
-	Name                   string         `json:"name"`                     //Friendly name of this docker instance
-	ConnectionType         string         `json:"connection_type"`          //Type of connection to use when connecting a docker instance (local,tls)
-	Endpoint               string         `json:"sock_path"`                //Path to the sock if the connection type is local or remote address if the type is tls
-	CaCertPath             string         `json:"ca_cert_path"`             //Path to the CA certificate if the connection type is tls
-	ClientCertPath         string         `json:"client_cert_path"`         //Path to the Client certificate if the connection type is tls
-	ClientKeyPath          string         `json:"client_key_path"`          //Path to the Client key if the connection type is tls
-	IsConnected            bool           `json:"is_connected"`             //This is true if the daemon is reporting it is connected to the Docker host
-	DockerClient           *docker.Client `gorm:"-" json:"-"`               //Connection to the Docker instance
-	ExternalAddress        string         `json:"external_address"`         //External address that the spaces will use
-	ExternalDisplayAddress string         `json:"external_display_address"` //External addresses that users will see
+	ID                     uint           `gorm:"primary_key" json:"host_id"` //Primary Key
+	CreatedAt              time.Time      `json:"-"`                          //Creation Time
+	UpdatedAt              time.Time      `json:"-"`                          //Last Update time
+	Name                   string         `json:"name"`                       //Friendly name of this docker instance
+	ConnectionType         string         `json:"connection_type"`            //Type of connection to use when connecting a docker instance (local,tls)
+	Endpoint               string         `json:"sock_path"`                  //Path to the sock if the connection type is local or remote address if the type is tls
+	CaCertPath             string         `json:"ca_cert_path"`               //Path to the CA certificate if the connection type is tls
+	ClientCertPath         string         `json:"client_cert_path"`           //Path to the Client certificate if the connection type is tls
+	ClientKeyPath          string         `json:"client_key_path"`            //Path to the Client key if the connection type is tls
+	IsConnected            bool           `json:"is_connected"`               //This is true if the daemon is reporting it is connected to the Docker host
+	DockerClient           *docker.Client `gorm:"-" json:"-"`                 //Connection to the Docker instance
+	ExternalAddress        string         `json:"external_address"`           //External address that the spaces will use
+	ExternalDisplayAddress string         `json:"external_display_address"`   //External addresses that users will see
+	Draining               bool           `json:"draining"`                   //If true, no new spaces will be placed on this host
+	LastSeen               time.Time      `json:"last_seen"`                  //Last time the host answered a health check
+	LastError              time.Time      `json:"last_error"`                 //Last time the host failed a health check
+	LastErrorMessage       string         `json:"last_error_message"`         //Error returned by the last failed health check
+}
+
+//SpaceQuota Limits on the resources that users may allocate to their spaces. A limit of 0 means unlimited.
+//A quota applies to a single user if UserID is set, otherwise it applies to every user holding Permission.
+type SpaceQuota struct {
+	ID             uint      `gorm:"primary_key" json:"quota_id"` //Primary Key
+	CreatedAt      time.Time `json:"-"`                           //Creation time
+	UpdatedAt      time.Time `json:"-"`                           //Last Update time
+	UserID         uint      `gorm:"index" json:"user_id"`        //ID of the user this quota applies to
+	Permission     string    `json:"permission"`                  //Permission group this quota applies to if UserID is not set
+	Priority       int       `json:"priority"`                    //Used to pick between permission group quotas. Highest wins.
+	MaxSpaces      int       `json:"max_spaces"`                  //Maximum number of spaces
+	MaxMemoryBytes int64     `json:"max_memory_bytes"`            //Maximum total memory across all spaces
+	MaxCPUShares   int64     `json:"max_cpu_shares"`              //Maximum total cpu shares across all spaces
+	MaxDiskBytes   int64     `json:"max_disk_bytes"`              //Maximum total disk across all spaces
+}
+
+//ExternalIdentity Links a user to their account at a provider whose usernames can change, such as an OIDC issuer.
+//Logins from the provider are matched on the subject so a user who changes their name cannot take over another account.
+type ExternalIdentity struct {
+	ID        uint      `gorm:"primary_key" json:"-"`                              //Primary Key
+	CreatedAt time.Time `json:"-"`                                                 //Creation time
+	Issuer    string    `gorm:"unique_index:idx_external_identity" json:"issuer"`  //Provider that vouches for the subject
+	Subject   string    `gorm:"unique_index:idx_external_identity" json:"subject"` //ID of the account at the provider. This never changes.
+	UserID    uint      `gorm:"index" json:"user_id"`                              //ID of the user the account logs in as
+}
+
+//QuotaUsage The resources a user currently has allocated to their spaces
+type QuotaUsage struct {
+	Spaces      int   `json:"spaces"`       //Number of spaces that are not archived
+	MemoryBytes int64 `json:"memory_bytes"` //Total memory allocated
+	CPUShares   int64 `json:"cpu_shares"`   //Total cpu shares allocated
+	DiskBytes   int64 `json:"disk_bytes"`   //Total disk allocated
+}
+
+//QuotaReport Sent to users so they can compare their usage with their limits
+type QuotaReport struct {
+	Quota SpaceQuota `json:"quota"` //Limits that apply to the user
+	Usage QuotaUsage `json:"usage"` //Current allocation of the user
+}
+
+//LoginRequest Sent to log in as a local user
+type LoginRequest struct {
+	Username   string `json:"username"`   //Name of the user
+	Password   string `json:"password"`   //Password of the user
+	Persistent bool   `json:"persistent"` //If true, the session does not expire
+}
+
+//RegistrationRequest Sent to create a local user
+type RegistrationRequest struct {
+	Username  string `json:"username"`   //Name of the new user
+	Password  string `json:"password"`   //Password of the new user. Has to meet the password policy.
+	Email     string `json:"email"`      //Email address of the new user
+	FirstName string `json:"first_name"` //First name of the new user
+	LastName  string `json:"last_name"`  //Last name of the new user
+}
+
+//ExecRequest A command to run in a space
+type ExecRequest struct {
+	Command        []string `json:"command"`                   //Command and its arguments
+	Stdin          string   `json:"stdin,omitempty"`           //Sent to the command as its input
+	Env            []string `json:"env,omitempty"`             //Extra environment variables in the form KEY=value
+	WorkingDir     string   `json:"working_dir,omitempty"`     //Directory to run the command in
+	TimeoutSeconds int      `json:"timeout_seconds,omitempty"` //How long to wait for the command. The daemon default is used if not set.
+}
+
+//ExecResult What a command run in a space produced
+type ExecResult struct {
+	ExitCode  int    `json:"exit_code"` //Exit code of the command. -1 if it timed out.
+	Stdout    string `json:"stdout"`    //Output of the command
+	Stderr    string `json:"stderr"`    //Error output of the command
+	Truncated bool   `json:"truncated"` //True if the output was longer than the daemon keeps
+	TimedOut  bool   `json:"timed_out"` //True if the command did not finish in time
+}
+
+//UsageDelta How much the usage of one or more spaces grew between two points in time
+type UsageDelta struct {
+	From            time.Time `json:"from"`              //Start of the period
+	To              time.Time `json:"to"`                //End of the period
+	DiskUsageBytes  int64     `json:"disk_usage_bytes"`  //Change in disk usage. This is negative if the space shrank.
+	NetworkInBytes  int64     `json:"network_in_bytes"`  //Bytes received over the network
+	NetworkOutBytes int64     `json:"network_out_bytes"` //Bytes sent over the network
+	BlockReadBytes  int64     `json:"block_read_bytes"`  //Bytes read from block devices
+	BlockWriteBytes int64     `json:"block_write_bytes"` //Bytes written to block devices
+	CPUTimeNanos    int64     `json:"cpu_time_nanos"`    //CPU time used in nanoseconds
+	SSHSessions     int64     `json:"ssh_sessions"`      //SSH sessions received
+}
+
+//UsageAggregate The combined usage of the spaces of a user or host
+type UsageAggregate struct {
+	UserID uint       `json:"user_id,omitempty"` //Set if the usage is grouped by user
+	HostID uint       `json:"host_id,omitempty"` //Set if the usage is grouped by host
+	Spaces int        `json:"spaces"`            //Number of spaces that reported usage in the period
+	Usage  UsageDelta `json:"usage"`             //Combined usage of the spaces
+}
+
+//HostPlacement Records why the scheduler chose a host for a space
+type HostPlacement struct {
+	ID         uint      `gorm:"primary_key" json:"-"` //Primary Key
+	CreatedAt  time.Time `json:"timestamp"`            //Time the decision was made
+	SpaceID    uint      `json:"space_id"`             //ID of the space that was placed
+	HostID     uint      `json:"host_id"`              //ID of the host that was chosen
+	Score      float64   `json:"score"`                //Score of the chosen host. Lower is less occupied.
+	Reason     string    `json:"reason"`               //Human readable explanation of the choice
+	Candidates string    `json:"candidates"`           //Summary of every host that was considered
 }
 
 //endregion
@@ -150,7 +293,7 @@ func Init() {
 
 	//Init DB
 	log.Info("Connecting to database...")
-	db, err := gorm.Open("sqlite3", "./userspace.db")
+	db, err := openDatabase()
 	//db.LogMode(true)
 	database = db
 	defer database.Close()
@@ -161,13 +304,28 @@ func Init() {
 
 	//Migrate Models
 	log.Info("Migrating Models...")
+	err = migrateLastNetAccess(database)
+	if err != nil {
+		log.Fatalf("Failed to migrate last_net_access of spaces. Error: %s\n", err.Error())
+	}
 	database.AutoMigrate(&Space{})
 	database.AutoMigrate(&SpacePortLink{})
 	database.AutoMigrate(&SpaceImage{})
 	database.AutoMigrate(&SpaceUsageReport{})
 	database.AutoMigrate(&DockerInstance{})
 	database.AutoMigrate(&UserPublicKey{})
+	database.AutoMigrate(&HostPlacement{})
+	database.AutoMigrate(&SpaceQuota{})
+	database.AutoMigrate(&ExternalIdentity{})
+	err = migrateProxyInstances(database)
+	if err != nil {
+		log.Fatalf("Failed to migrate proxy_instances. Error: %s\n", err.Error())
+	}
+	database.AutoMigrate(&ProxyInstance{})
 	log.Info("Migration Complete.")
+	assignKeyPublicIDs(db)
+	registerMetrics(db)
+	go startMetricsServer()
 
 	if viper.GetBool("UseLocalDockerHost") {
 		log.Info("Checking if there are any existing Docker hosts")
@@ -185,6 +343,27 @@ func Init() {
 	//Connect to docker hosts
 	initDockerHosts(database)
 
+	//Spaces have to trust the gateway before any of them are created
+	err = initSSHGateway()
+	if err != nil {
+		log.Criticalf("Error initializing SSH gateway: %s\n", err.Error())
+	} else if viper.GetBool("SSHGatewayEnabled") {
+		log.Info("Starting SSH Gateway")
+		go syncSSHGatewayKey(db)
+		go startSSHGateway(db)
+	}
+
+	log.Info("Starting Space Proxies")
+	startSpaceProxies(db)
+
+	if viper.GetBool("HTTPProxyEnabled") {
+		log.Info("Starting HTTP Proxy")
+		go startHTTPProxy(db)
+	}
+
+	log.Info("Starting Host Health Monitor")
+	go startHostHealthMonitor(db)
+
 	//Check if we need starter images
 	if viper.GetBool("PullStarterImages") {
 		ensureStarterImages(database)
@@ -195,18 +374,49 @@ func Init() {
 	log.Info("Initiating CAS Handler")
 	initCAS()
 
+	//Docker events keep the states current. This is a safety net in case an event is missed.
 	log.Info("Starting Space State Watcher")
 	go func(db *gorm.DB) {
 		log.Info("Space State Monitor Started")
 		for true {
 			updateSpaceStates(db)
-			time.Sleep(time.Second * 5)
+			time.Sleep(getClampedInterval("SpaceReconcileIntervalSeconds", minLoopInterval))
 		}
 	}(db)
 
+	log.Info("Starting Usage Collector")
+	go startUsageCollector(db)
+
+	log.Info("Starting SSH Session Tracker")
+	go startSSHSessionTracker(db)
+
+	log.Info("Starting Lifecycle Policy Engine")
+	go startLifecycleEngine(db)
+
 	startAPI()
 }
 
+//migrateLastNetAccess Space.LastNetAccess used to be a string that was never set. Databases from then have a varchar
+//column full of "" that cannot be read into a time, which breaks every query for spaces. The column is renamed out
+//of the way so that AutoMigrate adds a datetime column in its place. No access times are lost since none were stored.
+func migrateLastNetAccess(db *gorm.DB) error {
+	var columnType string
+	row := db.Raw("SELECT type FROM pragma_table_info('spaces') WHERE name = 'last_net_access'").Row()
+	err := row.Scan(&columnType)
+	if err == sql.ErrNoRows {
+		//New database or already migrated
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if strings.ToLower(columnType) == "datetime" {
+		return nil
+	}
+	log.Warningf("Moving %s column last_net_access of spaces to last_net_access_string\n", columnType)
+	return db.Exec("ALTER TABLE spaces RENAME COLUMN last_net_access TO last_net_access_string").Error
+}
+
 //initLogging Configures and initializes logging for the daemon
 func initLogging() {
 
@@ -225,6 +435,11 @@ func initLogging() {
 	logging.SetBackend(backendFormatter)
 }
 
+//openDatabase Connects to the database of the daemon
+func openDatabase() (*gorm.DB, error) {
+	return gorm.Open("sqlite3", "./userspace.db")
+}
+
 //loadConfig I bet you can guess what this function does
 func loadConfig() {
 	viper.SetConfigName("config")                // name of config file (without extension)
@@ -240,69 +455,161 @@ func loadConfig() {
 
 	log.Infof("Using config file: %s", viper.ConfigFileUsed())
 	for _, key := range viper.AllKeys() {
-		log.Infof("Loaded: %s as %s", key, viper.GetString(key))
+		log.Infof("Loaded: %s as %s", key, getLoggedConfigValue(key))
+	}
+	//Defaults for settings that cannot be zero
+	viper.SetDefault("HostHealthCheckIntervalSeconds", 10)
+	viper.SetDefault("HostReconnectMaxBackoffSeconds", 300)
+	viper.SetDefault("RegistrationUsernamePrefix", "local-")
+	viper.SetDefault("SpaceReconcileIntervalSeconds", 60)
+	viper.SetDefault("LifecycleCheckIntervalSeconds", 300)
+	viper.SetDefault("SSHTrackingIntervalSeconds", 60)
+	viper.SetDefault("UsageCollectionIntervalSeconds", 300)
+	viper.SetDefault("ProxyConnectTimeoutSeconds", 10)
+	viper.SetDefault("MetricsListenAddress", "127.0.0.1:9464")
+	viper.SetDefault("PublishSSHPorts", true)
+	viper.SetDefault("SSHGatewayListenAddress", ":2222")
+	viper.SetDefault("SSHGatewayHostKey", "./ssh_gateway_host.key")
+	viper.SetDefault("SSHGatewayClientKey", "./ssh_gateway_client.key")
+	viper.SetDefault("SSHGatewayHandshakeTimeoutSeconds", 30)
+	viper.SetDefault("HTTPProxyListenAddress", ":80")
+	viper.SetDefault("HTTPProxyCertificate", "./http_proxy.cert")
+	viper.SetDefault("HTTPProxyKey", "./http_proxy.key")
+	viper.SetDefault("ExecDefaultTimeoutSeconds", 60)
+	viper.SetDefault("ExecMaxTimeoutSeconds", 600)
+	viper.SetDefault("ExecMaxOutputBytes", 1048576)
+	viper.SetDefault("FileUploadMaxBytes", 1073741824)
+	viper.SetDefault("FileDownloadMaxBytes", 1073741824)
+	viper.SetDefault("PasswordMinLength", 10)
+	viper.SetDefault("BcryptCost", 10)
+	viper.SetDefault("AdminUsername", "admin")
+	viper.SetDefault("LDAPTimeoutSeconds", 10)
+	viper.SetDefault("LDAPUserFilter", "(uid=%s)")
+	viper.SetDefault("LDAPUsernameAttribute", "uid")
+	viper.SetDefault("LDAPGroupAttribute", "memberOf")
+	viper.SetDefault("LDAPGroupFilter", "(member=%s)")
+	viper.SetDefault("OIDCScopes", []string{"openid", "profile", "email"})
+	viper.SetDefault("OIDCUsernameClaim", "preferred_username")
+	viper.SetDefault("CASEmailAttribute", "mail")
+	viper.SetDefault("CASFirstNameAttribute", "givenName")
+	viper.SetDefault("CASLastNameAttribute", "sn")
+	viper.SetDefault("CASDisplayNameAttribute", "displayName")
+	viper.SetDefault("CASDefaultPermissions", []string{"user.*"})
+}
+
+//minLoopInterval Shortest time between the passes of the background loops so a bad config cannot make them spin
+const minLoopInterval = time.Second
+
+//getClampedInterval Returns the number of seconds a setting holds as a duration, but never less than min
+func getClampedInterval(key string, min time.Duration) time.Duration {
+	interval := time.Duration(viper.GetInt(key)) * time.Second
+	if interval < min {
+		return min
 	}
-	//viper.SetDefault("k", "v")
+	return interval
 }
 
-//updateSpaceStates Synchronizes the state of a space and its underlying container
+//getLoggedConfigValue Returns the value of a setting as it should appear in the log. Passwords and secrets are hidden.
+func getLoggedConfigValue(key string) string {
+	value := viper.GetString(key)
+	lowerKey := strings.ToLower(key)
+	if value != "" && (strings.HasSuffix(lowerKey, "password") || strings.HasSuffix(lowerKey, "secret")) {
+		return "[redacted]"
+	}
+	return value
+}
+
+//updateSpaceStates Synchronizes the state of all spaces and their underlying containers
 func updateSpaceStates(db *gorm.DB) {
 	spaces := []Space{}
 	db.Find(&spaces)
 
 	for _, space := range spaces {
-		//Get the host of the Space
-		hostID := space.HostID
-		host := getHostByID(hostID)
-		//If the host is disconnected the start should be changed
-		if !host.IsConnected {
-			log.Infof("Updated Space %s(%d) to state %s from %s\n", space.FriendlyName, space.ID, "host error", space.SpaceState)
-			log.Criticalf("Host %s(%d) in Error State\n", host.Name, host.ID)
-			space.SpaceState = "host error"
-			db.Save(space)
-			continue
+		updateSpaceState(db, space)
+	}
+}
+
+//updateSpaceState Synchronizes the state of a space and its underlying container
+func updateSpaceState(db *gorm.DB, space Space) {
+	//Archived spaces no longer have a container
+	if space.Archived {
+		return
+	}
+	//Get the host of the Space
+	hostID := space.HostID
+	host := getHostByID(hostID)
+	//If the host is disconnected the start should be changed
+	dClient, connected := getHostClient(host)
+	if !connected {
+		//No need to continuously complain about spaces that are already in error state
+		if space.SpaceState == "host error" {
+			return
 		}
-		//Ignore spaces that are just starting or being removed
-		if space.SpaceState == "started" ||
-			space.SpaceState == "deleting" {
-			continue
+		log.Infof("Updated Space %s(%d) to state %s from %s\n", space.FriendlyName, space.ID, "host error", space.SpaceState)
+		log.Criticalf("Host %d in Error State\n", hostID)
+		saveSpaceStateUpdates(db, space.ID, map[string]interface{}{"space_state": "host error"})
+		return
+	}
+	//Ignore spaces that are just starting or being removed
+	if space.SpaceState == "started" ||
+		space.SpaceState == "deleting" {
+		return
+	}
+	//Now let's grab the actual container
+	container, err := dClient.InspectContainer(space.ContainerID)
+	if err != nil {
+		//No need to continuously complain about containers that are already in error state
+		if space.SpaceState == "error" {
+			return
 		}
-		//Get the client from the host
-		dClient := host.DockerClient
-		//Now let's grab the actual container
-		container, err := dClient.InspectContainer(space.ContainerID)
-		if err != nil {
-			//No need to continuously complain about containers that are already in error state
-			if space.SpaceState == "error" {
-				continue
-			}
-			log.Critical("Error updating space state: " + err.Error())
-			log.Infof("Updated Space %s(%d) to state %s from %s\n", space.FriendlyName, space.ID, "error", space.SpaceState)
+		log.Critical("Error updating space state: " + err.Error())
+		log.Infof("Updated Space %s(%d) to state %s from %s\n", space.FriendlyName, space.ID, "error", space.SpaceState)
+		saveSpaceStateUpdates(db, space.ID, map[string]interface{}{"space_state": "error"})
+		return
+	}
+	if space.KeysPending && container.State.Running {
+		addPendingKeys(db, space)
+	}
+	updates := make(map[string]interface{})
+	if container.State.Status == "exited" {
+		//Keep track of why it stopped
+		updates["last_exit_code"] = container.State.ExitCode
+		updates["last_exit_time"] = container.State.FinishedAt
+		updates["oom_killed"] = container.State.OOMKilled
+	}
+	//Spaces that are not kept alive are allowed to stay stopped
+	if container.State.Status == "exited" && space.KeepAlive {
+		err = dClient.StartContainer(container.ID, nil)
+		if err == nil {
+			log.Infof("Restarted Space %s(%d) that was exited. [%s]\n", space.FriendlyName, space.ID, space.ContainerID)
+			updates["space_state"] = "running"
+			saveSpaceStateUpdates(db, space.ID, updates)
+			return
+		} else {
+			log.Criticalf("Failed to restart exited Space %s(%d). [%s]", space.FriendlyName, space.ID, space.ContainerID)
 			space.SpaceState = "error"
-			db.Save(space)
-			continue
-		}
-		if container.State.Status == "exited" {
-			err = dClient.StartContainer(container.ID, nil)
-			if err == nil {
-				log.Infof("Restarted Space %s(%d) that was exited. [%s]\n", space.FriendlyName, space.ID, space.ContainerID)
-				space.SpaceState = "running"
-				db.Save(space)
-				continue
-			} else {
-				log.Critical("Failed to restart exited Space %s(%d). [%s]", space.FriendlyName, space.ID, space.ContainerID)
-				space.SpaceState = "error"
-				db.Save(space)
-			}
-		}
-		//Save the status
-		if container.State.Status != space.SpaceState {
-			log.Infof("Updated Space %s(%d) to state %s from %s\n", space.FriendlyName, space.ID, container.State.Status, space.SpaceState)
-			space.SpaceState = container.State.Status
-			db.Save(space)
-			continue
+			updates["space_state"] = "error"
 		}
 	}
+	//Save the status
+	if container.State.Status != space.SpaceState {
+		log.Infof("Updated Space %s(%d) to state %s from %s\n", space.FriendlyName, space.ID, container.State.Status, space.SpaceState)
+		updates["space_state"] = container.State.Status
+	}
+	saveSpaceStateUpdates(db, space.ID, updates)
+}
+
+//saveSpaceStateUpdates Writes the columns that updateSpaceState synchronizes. The space it works on can be read a whole
+//pass earlier, and saving the whole row would put back the access times, SSH counters and lifecycle flags that other
+//goroutines wrote since.
+func saveSpaceStateUpdates(db *gorm.DB, spaceID uint, updates map[string]interface{}) {
+	if len(updates) == 0 {
+		return
+	}
+	err := db.Model(&Space{ID: spaceID}).Updates(updates).Error
+	if err != nil {
+		log.Warningf("Error saving state of Space %d: %s\n", spaceID, err.Error())
+	}
 }
 
 //GetSpaceArrayAssociation Retrieves associated records for an array of Spaces. Internally, this calls GetSpaceAssociation
@@ -321,5 +628,17 @@ func GetSpaceArrayAssociation(db *gorm.DB, spaces []Space) ([]Space, error) {
 //GetSpaceAssociation Retreives associated records for a Space
 func GetSpaceAssociation(db *gorm.DB, space Space) (Space, error) {
 	err := db.Model(&space).Related(&space.PortLinks).Error
-	return space, err
+	if err != nil {
+		return space, err
+	}
+	if space.SSHKeyID != 0 {
+		var key UserPublicKey
+		query := db.Where("id = ?", space.SSHKeyID).First(&key)
+		//A deleted key leaves the space without a selected key
+		if query.Error != nil && !query.RecordNotFound() {
+			return space, query.Error
+		}
+		space.SSHKey = key.PublicID
+	}
+	return space, nil
 }
@@ -0,0 +1,226 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package userspaced
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/jinzhu/gorm"
+	"github.com/spf13/viper"
+)
+
+//newTestDatabase Opens an empty in memory database with the models migrated. It is closed when the test ends.
+func newTestDatabase(t *testing.T) *gorm.DB {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Error opening database: %s", err.Error())
+	}
+	//Every connection to :memory: is a new database
+	db.DB().SetMaxOpenConns(1)
+	db.AutoMigrate(&Space{}, &SpacePortLink{}, &SpaceImage{}, &DockerInstance{}, &UserPublicKey{}, &HostPlacement{}, &SpaceQuota{}, &ExternalIdentity{}, &SpaceUsageReport{})
+	t.Cleanup(func() {
+		db.Close()
+	})
+	return db
+}
+
+//useTestAuthProvider Points the auth provider and the database of the daemon at a test database
+func useTestAuthProvider(t *testing.T, db *gorm.DB) {
+	previousDatabase := database
+	database = db
+	authProvider.Database = db
+	authProvider.Startup()
+	t.Cleanup(func() {
+		database = previousDatabase
+		authProvider.Database = previousDatabase
+	})
+}
+
+func TestMigrateLastNetAccess(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.DB().SetMaxOpenConns(1)
+	//The table as it was when LastNetAccess was a string
+	db.Exec(`CREATE TABLE spaces ("id" integer primary key autoincrement, "friendly_name" varchar(255), "last_net_access" varchar(255))`)
+	db.Exec(`INSERT INTO spaces (friendly_name, last_net_access) VALUES ('old', '')`)
+
+	err = migrateLastNetAccess(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.AutoMigrate(&Space{})
+	var spaces []Space
+	err = db.Find(&spaces).Error
+	if err != nil {
+		t.Fatalf("Spaces cannot be read after the migration: %s", err.Error())
+	}
+	if len(spaces) != 1 || spaces[0].FriendlyName != "old" || !spaces[0].LastNetAccess.IsZero() {
+		t.Errorf("Spaces = %+v", spaces)
+	}
+
+	now := time.Now()
+	db.Model(&spaces[0]).Update("last_net_access", now)
+	db.First(&spaces[0], spaces[0].ID)
+	if !spaces[0].LastNetAccess.Equal(now) {
+		t.Errorf("last_net_access = %s, want %s", spaces[0].LastNetAccess, now)
+	}
+	//Running it again does nothing
+	if err = migrateLastNetAccess(db); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMigrateLastNetAccessOnNewDatabase(t *testing.T) {
+	db := newTestDatabase(t)
+	if err := migrateLastNetAccess(db); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUpdateSpaceStateAddsPendingKeys(t *testing.T) {
+	db := newTestDatabase(t)
+	//Read and written with atomic since the fake host runs on its own goroutines
+	var uploads int32
+	uploadsFail := int32(1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/json"):
+			w.Write([]byte(`{"Id":"container","State":{"Status":"running","Running":true}}`))
+		case r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, "/archive"):
+			atomic.AddInt32(&uploads, 1)
+			if atomic.LoadInt32(&uploadsFail) == 1 {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := &DockerInstance{ID: 1, ConnectionType: "local", Name: "local"}
+	setHostConnected(host, client)
+	setTestDockerInstances(t, host)
+	space := Space{HostID: host.ID, ContainerID: "container", SpaceState: "running", KeysPending: true}
+	db.Create(&space)
+
+	updateSpaceState(db, space)
+	db.First(&space, space.ID)
+	if atomic.LoadInt32(&uploads) != 1 || !space.KeysPending {
+		t.Fatalf("Failed upload: %d uploads, keys_pending = %t", atomic.LoadInt32(&uploads), space.KeysPending)
+	}
+	atomic.StoreInt32(&uploadsFail, 0)
+	updateSpaceState(db, space)
+	db.First(&space, space.ID)
+	if atomic.LoadInt32(&uploads) != 2 || space.KeysPending || space.SpaceState != "running" {
+		t.Fatalf("Retried upload: %d uploads, keys_pending = %t, state = %s", atomic.LoadInt32(&uploads), space.KeysPending, space.SpaceState)
+	}
+	updateSpaceState(db, space)
+	if atomic.LoadInt32(&uploads) != 2 {
+		t.Errorf("Keys were uploaded again after they were added")
+	}
+}
+
+func TestGetLoggedConfigValueHidesSecrets(t *testing.T) {
+	settings := map[string]string{
+		"AdminPassword":     "hunter22",
+		"LDAPBindPassword":  "bindpass",
+		"OIDCClientSecret":  "clientsecret",
+		"PasswordMinLength": "10",
+		"ApiHost":           "localhost",
+	}
+	for key, value := range settings {
+		viper.Set(key, value)
+		defer viper.Set(key, nil)
+	}
+	for _, key := range viper.AllKeys() {
+		logged := getLoggedConfigValue(key)
+		for _, secret := range []string{"hunter22", "bindpass", "clientsecret"} {
+			if strings.Contains(logged, secret) {
+				t.Errorf("%s is logged as %q", key, logged)
+			}
+		}
+	}
+	if logged := getLoggedConfigValue("PasswordMinLength"); logged != "10" {
+		t.Errorf("PasswordMinLength is logged as %q", logged)
+	}
+	if logged := getLoggedConfigValue("ApiHost"); logged != "localhost" {
+		t.Errorf("ApiHost is logged as %q", logged)
+	}
+	viper.Set("LDAPBindPassword", "")
+	if logged := getLoggedConfigValue("LDAPBindPassword"); logged != "" {
+		t.Errorf("An unset password is logged as %q", logged)
+	}
+}
+
+func TestGetClampedInterval(t *testing.T) {
+	defer viper.Set("TestIntervalSeconds", nil)
+	tests := []struct {
+		seconds interface{}
+		min     time.Duration
+		want    time.Duration
+	}{
+		{nil, time.Second, time.Second},
+		{0, time.Second, time.Second},
+		{-5, time.Second, time.Second},
+		{1, time.Second, time.Second},
+		{60, time.Second, time.Minute},
+		{10, time.Minute, time.Minute},
+		{"300", time.Second, 5 * time.Minute},
+	}
+	for _, test := range tests {
+		viper.Set("TestIntervalSeconds", test.seconds)
+		if interval := getClampedInterval("TestIntervalSeconds", test.min); interval != test.want {
+			t.Errorf("%v seconds with a minimum of %s = %s, want %s", test.seconds, test.min, interval, test.want)
+		}
+	}
+}
+
+func TestUpdateSpaceStateOnlyWritesStateColumns(t *testing.T) {
+	db := newTestDatabase(t)
+	host := startTestStateHost(t, `{"Status":"paused"}`)
+	space := Space{HostID: host.ID, ContainerID: "abc", SpaceState: "running"}
+	db.Create(&space)
+	//Written by the gateway and the lifecycle engine after the reconcile pass read the space
+	accessed := time.Now().Add(-time.Minute).Round(time.Second)
+	db.Model(&Space{ID: space.ID}).Updates(map[string]interface{}{
+		"last_ssh_access":     accessed,
+		"ssh_sessions":        2,
+		"paused_by_lifecycle": true,
+	})
+
+	updateSpaceState(db, space)
+	var updated Space
+	db.First(&updated, space.ID)
+	if updated.SpaceState != "paused" {
+		t.Errorf("state = %s, want paused", updated.SpaceState)
+	}
+	if !updated.LastSSHAccess.Equal(accessed) || updated.SSHSessions != 2 || !updated.PausedByLifecycle {
+		t.Errorf("Columns written by others were overwritten: %+v", updated)
+	}
+}
@@ -0,0 +1,227 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package userspaced
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spf13/viper"
+	"goji.io/middleware"
+	"goji.io/pat"
+)
+
+const metricsNamespace = "userspace"
+
+var (
+	spaceCreationSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "space_creation_seconds",
+		Help:      "Time it took to create and start a space.",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 10),
+	})
+	spaceCreationFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "space_creation_failures_total",
+		Help:      "Number of spaces that could not be created by the step that failed.",
+	}, []string{"reason"})
+	apiRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "api_requests_total",
+		Help:      "Number of API requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+	apiRequestSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "api_request_duration_seconds",
+		Help:      "Time it took to handle API requests by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	//Resource gauges that are set every time the usage collector records a report
+	spaceMemoryBytes      = newSpaceGauge("space_memory_bytes", "Memory the space is using.")
+	spaceDiskBytes        = newSpaceGauge("space_disk_bytes", "Bytes the space is taking up on disk.")
+	spaceNetworkInBytes   = newSpaceGauge("space_network_in_bytes", "Bytes the space has received over the network.")
+	spaceNetworkOutBytes  = newSpaceGauge("space_network_out_bytes", "Bytes the space has sent over the network.")
+	spaceBlockReadBytes   = newSpaceGauge("space_block_read_bytes", "Bytes the space has read from block devices.")
+	spaceBlockWriteBytes  = newSpaceGauge("space_block_write_bytes", "Bytes the space has written to block devices.")
+	spaceCPUSeconds       = newSpaceGauge("space_cpu_seconds", "CPU time the space has used.")
+	spaceSSHSessionsTotal = newSpaceGauge("space_ssh_sessions", "SSH sessions the space has received.")
+	spaceGauges           = []*prometheus.GaugeVec{spaceMemoryBytes, spaceDiskBytes, spaceNetworkInBytes, spaceNetworkOutBytes,
+		spaceBlockReadBytes, spaceBlockWriteBytes, spaceCPUSeconds, spaceSSHSessionsTotal}
+)
+
+//newSpaceGauge Creates a gauge with a series for every space
+func newSpaceGauge(name string, help string) *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      name,
+		Help:      help,
+	}, []string{"space_id"})
+}
+
+//stateCollector Reports the number of spaces in each state and the status of the hosts whenever metrics are scraped
+type stateCollector struct {
+	db            *gorm.DB
+	spaces        *prometheus.Desc
+	hostConnected *prometheus.Desc
+	hostDraining  *prometheus.Desc
+}
+
+//Describe Sends the descriptions of the metrics of the collector
+func (c *stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.spaces
+	ch <- c.hostConnected
+	ch <- c.hostDraining
+}
+
+//Collect Reads the current state from the database and the host cache
+func (c *stateCollector) Collect(ch chan<- prometheus.Metric) {
+	rows, err := c.db.Model(&Space{}).Select("space_state, count(*)").Group("space_state").Rows()
+	if err != nil {
+		log.Warningf("Error counting spaces for metrics: %s\n", err.Error())
+	} else {
+		for rows.Next() {
+			var state string
+			var count float64
+			if rows.Scan(&state, &count) == nil {
+				ch <- prometheus.MustNewConstMetric(c.spaces, prometheus.GaugeValue, count, state)
+			}
+		}
+		rows.Close()
+	}
+
+	for _, instance := range getCachedDockerInstances() {
+		hostID := strconv.Itoa(int(instance.ID))
+		ch <- prometheus.MustNewConstMetric(c.hostConnected, prometheus.GaugeValue, boolToFloat(isHostConnected(instance)), hostID, instance.Name)
+		ch <- prometheus.MustNewConstMetric(c.hostDraining, prometheus.GaugeValue, boolToFloat(instance.Draining), hostID, instance.Name)
+	}
+}
+
+//boolToFloat Converts a flag to the 1 or 0 that Prometheus expects
+func boolToFloat(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+//registerMetrics Registers every metric of the daemon with Prometheus
+func registerMetrics(db *gorm.DB) {
+	prometheus.MustRegister(spaceCreationSeconds, spaceCreationFailures, apiRequests, apiRequestSeconds)
+	for _, gauge := range spaceGauges {
+		prometheus.MustRegister(gauge)
+	}
+	prometheus.MustRegister(newStateCollector(db))
+}
+
+//newStateCollector Creates the collector for the space states and host status
+func newStateCollector(db *gorm.DB) *stateCollector {
+	return &stateCollector{
+		db:            db,
+		spaces:        prometheus.NewDesc(metricsNamespace+"_spaces", "Number of spaces in each state.", []string{"state"}, nil),
+		hostConnected: prometheus.NewDesc(metricsNamespace+"_host_connected", "1 if the daemon is connected to the host.", []string{"host_id", "host_name"}, nil),
+		hostDraining:  prometheus.NewDesc(metricsNamespace+"_host_draining", "1 if the host does not accept new spaces.", []string{"host_id", "host_name"}, nil),
+	}
+}
+
+//startMetricsServer Serves the metrics on a listener of their own. They name every host and space, so they are kept
+//off the public API and the listener should only be reachable by the Prometheus server.
+func startMetricsServer() {
+	listenAddress := viper.GetString("MetricsListenAddress")
+	if listenAddress == "" {
+		log.Info("MetricsListenAddress is not set so metrics are not served")
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	log.Infof("Serving metrics on %s/metrics\n", listenAddress)
+	err := http.ListenAndServe(listenAddress, mux)
+	log.Criticalf("Metrics server stopped: %s\n", err.Error())
+}
+
+//recordSpaceUsageMetrics Updates the resource gauges of a space from a usage report
+func recordSpaceUsageMetrics(report *SpaceUsageReport) {
+	spaceID := strconv.Itoa(int(report.SpaceID))
+	spaceMemoryBytes.WithLabelValues(spaceID).Set(float64(report.MemoryUsageBytes))
+	spaceDiskBytes.WithLabelValues(spaceID).Set(float64(report.DiskUsageBytes))
+	spaceNetworkInBytes.WithLabelValues(spaceID).Set(float64(report.NetworkInBytes))
+	spaceNetworkOutBytes.WithLabelValues(spaceID).Set(float64(report.NetworkOutBytes))
+	spaceBlockReadBytes.WithLabelValues(spaceID).Set(float64(report.BlockReadBytes))
+	spaceBlockWriteBytes.WithLabelValues(spaceID).Set(float64(report.BlockWriteBytes))
+	spaceCPUSeconds.WithLabelValues(spaceID).Set(time.Duration(report.CPUTimeNanos).Seconds())
+	spaceSSHSessionsTotal.WithLabelValues(spaceID).Set(float64(report.SSHSessionCount))
+}
+
+//forgetSpaceMetrics Removes the resource gauges of a space that no longer has a container
+func forgetSpaceMetrics(spaceID uint) {
+	for _, gauge := range spaceGauges {
+		gauge.DeleteLabelValues(strconv.Itoa(int(spaceID)))
+	}
+}
+
+//statusRecorder Remembers the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+//WriteHeader Records the status code before writing it
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+//Flush Lets streaming handlers flush through the recorder
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+//Hijack Lets websocket handlers take over the connection through the recorder
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Connection does not support hijacking")
+	}
+	r.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+//metricsMiddleware Counts and times API requests by the route pattern that matched them
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		//Use the pattern instead of the path so that IDs do not create a series each
+		route := "unmatched"
+		if pattern, ok := middleware.Pattern(r.Context()).(*pat.Pattern); ok {
+			route = pattern.String()
+		}
+		apiRequests.WithLabelValues(route, r.Method, strconv.Itoa(recorder.status)).Inc()
+		apiRequestSeconds.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
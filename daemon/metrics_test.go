@@ -0,0 +1,104 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package userspaced
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"goji.io"
+	"goji.io/pat"
+)
+
+func TestMetricsMiddlewareLabelsRoutes(t *testing.T) {
+	mux := goji.NewMux()
+	mux.Use(metricsMiddleware)
+	mux.HandleFunc(pat.Get("/api/v1/space/:spaceid"), func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	route := apiRequests.WithLabelValues("/api/v1/space/:spaceid", "GET", "404")
+	unmatched := apiRequests.WithLabelValues("unmatched", "GET", "404")
+	before := testutil.ToFloat64(route)
+	unmatchedBefore := testutil.ToFloat64(unmatched)
+
+	//Every space is counted under the pattern rather than its own path
+	for _, path := range []string{"/api/v1/space/1", "/api/v1/space/2", "/nothing"} {
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	if count := testutil.ToFloat64(route) - before; count != 2 {
+		t.Errorf("Counted %f requests for the route, want 2", count)
+	}
+	if count := testutil.ToFloat64(unmatched) - unmatchedBefore; count != 1 {
+		t.Errorf("Counted %f unmatched requests, want 1", count)
+	}
+}
+
+func TestStateCollector(t *testing.T) {
+	db := newTestDatabase(t)
+	connected := &DockerInstance{ID: 1, Name: "up"}
+	setHostConnected(connected, nil)
+	setTestDockerInstances(t, connected, &DockerInstance{ID: 2, Name: "down", Draining: true})
+	db.Create(&Space{SpaceState: "running"})
+	db.Create(&Space{SpaceState: "running"})
+	db.Create(&Space{SpaceState: "paused"})
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(newStateCollector(db))
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values []string
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			var labels []string
+			for _, label := range metric.GetLabel() {
+				labels = append(labels, label.GetName()+"="+label.GetValue())
+			}
+			values = append(values, fmt.Sprintf("%s{%s} %g", family.GetName(), strings.Join(labels, ","), metric.GetGauge().GetValue()))
+		}
+	}
+	expected := []string{
+		"userspace_host_connected{host_id=1,host_name=up} 1",
+		"userspace_host_connected{host_id=2,host_name=down} 0",
+		"userspace_host_draining{host_id=1,host_name=up} 0",
+		"userspace_host_draining{host_id=2,host_name=down} 1",
+		"userspace_spaces{state=paused} 1",
+		"userspace_spaces{state=running} 2",
+	}
+	if strings.Join(values, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected metrics\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(values, "\n"))
+	}
+}
+
+func TestForgetSpaceMetrics(t *testing.T) {
+	recordSpaceUsageMetrics(&SpaceUsageReport{SpaceID: 42, CPUTimeNanos: 2500000000, MemoryUsageBytes: 1024})
+	if seconds := testutil.ToFloat64(spaceCPUSeconds.WithLabelValues("42")); seconds != 2.5 {
+		t.Errorf("CPU seconds = %f, want 2.5", seconds)
+	}
+	forgetSpaceMetrics(42)
+	for _, gauge := range spaceGauges {
+		if gauge.DeleteLabelValues("42") {
+			t.Error("A gauge of the space was left behind")
+		}
+	}
+}
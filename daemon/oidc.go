@@ -0,0 +1,339 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package userspaced
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/spf13/viper"
+	"golang.org/x/oauth2"
+)
+
+//oidcLoginTimeout How long a user has to finish logging in at the provider
+const oidcLoginTimeout = 10 * time.Minute
+
+//oidcMaxPendingLogins Anyone can start a login so only this many are remembered at once
+const oidcMaxPendingLogins = 10000
+
+//oidcStateCookie Holds the state of a login in the browser that started it so that a callback from another browser,
+//such as one an attacker sends a victim to, is turned away
+const oidcStateCookie = "userspace_oidc_state"
+
+//oidcPendingLogin What is needed to finish a login once the provider redirects back
+type oidcPendingLogin struct {
+	codeVerifier string    //PKCE verifier whose challenge was sent to the provider
+	nonce        string    //Has to match the nonce in the ID token
+	expires      time.Time //The login is forgotten after this time
+}
+
+//oidcClient The discovered provider. It is set up on the first login so the daemon can start while the provider is down.
+type oidcClient struct {
+	provider *oidc.Provider
+	verifier *oidc.IDTokenVerifier
+	config   oauth2.Config
+}
+
+var oidcState *oidcClient
+var oidcStateLock sync.Mutex
+
+//oidcPendingLogins Logins that have been sent to the provider, keyed by their state parameter
+var oidcPendingLogins = make(map[string]oidcPendingLogin)
+var oidcPendingLoginsLock sync.Mutex
+
+//getOIDCClient Returns the provider, running discovery if it has not been done yet
+func getOIDCClient() (*oidcClient, error) {
+	oidcStateLock.Lock()
+	defer oidcStateLock.Unlock()
+	if oidcState != nil {
+		return oidcState, nil
+	}
+	//The provider keeps the context to fetch keys later so it cannot be the context of a request
+	provider, err := oidc.NewProvider(context.Background(), viper.GetString("OIDCIssuerURL"))
+	if err != nil {
+		return nil, err
+	}
+	clientID := viper.GetString("OIDCClientID")
+	oidcState = &oidcClient{
+		provider: provider,
+		//Checks the signature against the JWKS of the provider as well as the issuer, audience and expiry
+		verifier: provider.Verifier(&oidc.Config{ClientID: clientID}),
+		config: oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: viper.GetString("OIDCClientSecret"),
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  viper.GetString("OIDCRedirectURL"),
+			Scopes:       viper.GetStringSlice("OIDCScopes"),
+		},
+	}
+	log.Infof("Discovered OIDC provider %s\n", viper.GetString("OIDCIssuerURL"))
+	return oidcState, nil
+}
+
+//randomURLString Returns a random string that is safe to put in a URL
+func randomURLString() (string, error) {
+	data := make([]byte, 32)
+	_, err := rand.Read(data)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+//addPendingOIDCLogin Remembers a login that is being sent to the provider and forgets the ones that were never finished.
+//Returns an error if too many logins are in progress.
+func addPendingOIDCLogin(state string, login oidcPendingLogin) error {
+	oidcPendingLoginsLock.Lock()
+	defer oidcPendingLoginsLock.Unlock()
+	now := time.Now()
+	for pendingState, pending := range oidcPendingLogins {
+		if now.After(pending.expires) {
+			delete(oidcPendingLogins, pendingState)
+		}
+	}
+	if len(oidcPendingLogins) >= oidcMaxPendingLogins {
+		return errors.New("Too many logins in progress")
+	}
+	oidcPendingLogins[state] = login
+	return nil
+}
+
+//takePendingOIDCLogin Returns a pending login and forgets it so the state cannot be used twice
+func takePendingOIDCLogin(state string) (oidcPendingLogin, bool) {
+	oidcPendingLoginsLock.Lock()
+	defer oidcPendingLoginsLock.Unlock()
+	login, exists := oidcPendingLogins[state]
+	delete(oidcPendingLogins, state)
+	if !exists || time.Now().After(login.expires) {
+		return login, false
+	}
+	return login, true
+}
+
+//getOIDCClaimValues Returns the values of a claim as strings. Lists give one value per entry.
+func getOIDCClaimValues(claims map[string]interface{}, claim string) []string {
+	var values []string
+	switch value := claims[claim].(type) {
+	case nil:
+	case []interface{}:
+		for _, entry := range value {
+			values = append(values, fmt.Sprint(entry))
+		}
+	default:
+		values = append(values, fmt.Sprint(value))
+	}
+	return values
+}
+
+//getOIDCClaimPermissions Returns the permissions that come from OIDCClaimPermissions, and which of them a set of claims grants.
+//The keys of OIDCClaimPermissions are claim=value and are compared without regard to case.
+func getOIDCClaimPermissions(claims map[string]interface{}) ([]string, []string) {
+	//viper lower cases the keys of maps
+	claimPermissions := viper.GetStringMapStringSlice("OIDCClaimPermissions")
+	lowerClaims := make(map[string]interface{})
+	for claim, value := range claims {
+		lowerClaims[strings.ToLower(claim)] = value
+	}
+	var managed []string
+	var granted []string
+	for key, permissions := range claimPermissions {
+		managed = append(managed, permissions...)
+		separator := strings.Index(key, "=")
+		if separator <= 0 {
+			continue
+		}
+		for _, value := range getOIDCClaimValues(lowerClaims, key[:separator]) {
+			if strings.ToLower(value) == key[separator+1:] {
+				granted = append(granted, permissions...)
+				break
+			}
+		}
+	}
+	return managed, granted
+}
+
+//getOIDCLoginHandler Handles GET /oidclogin - Sends the user to the OIDC provider to log in
+func getOIDCLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if !viper.GetBool("OIDCEnabled") {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "OIDC login is disabled\n")
+		return
+	}
+	client, err := getOIDCClient()
+	if err != nil {
+		log.Warningf("Error discovering OIDC provider: %s\n", err.Error())
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprint(w, "Error contacting the OIDC provider\n")
+		return
+	}
+
+	state, errState := randomURLString()
+	nonce, errNonce := randomURLString()
+	if errState != nil || errNonce != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Internal Server Error")
+		return
+	}
+	codeVerifier := oauth2.GenerateVerifier()
+	err = addPendingOIDCLogin(state, oidcPendingLogin{
+		codeVerifier: codeVerifier,
+		nonce:        nonce,
+		expires:      time.Now().Add(oidcLoginTimeout),
+	})
+	if err != nil {
+		log.Warningf("Refused OIDC login from %s: %s\n", r.RemoteAddr, err.Error())
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, err.Error()+"\n")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		MaxAge:   int(oidcLoginTimeout.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		//The provider sends the browser back with a top level GET, which Lax still sends the cookie on
+		SameSite: http.SameSiteLaxMode,
+	})
+	authURL := client.config.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(codeVerifier))
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+//getOIDCCallbackHandler Handles GET /oidccallback - Finishes a login when the provider redirects back and returns a session
+func getOIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if !viper.GetBool("OIDCEnabled") {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "OIDC login is disabled\n")
+		return
+	}
+	query := r.URL.Query()
+	if providerErr := query.Get("error"); providerErr != "" {
+		log.Warningf("OIDC provider returned an error: %s %s\n", providerErr, query.Get("error_description"))
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "Error")
+		return
+	}
+	//The state has to come back to the browser that was sent to the provider
+	state := query.Get("state")
+	stateCookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(stateCookie.Value), []byte(state)) != 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Invalid Request: the login was not started in this browser\n")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, MaxAge: -1, HttpOnly: true, Secure: true, SameSite: http.SameSiteLaxMode})
+	login, valid := takePendingOIDCLogin(state)
+	if !valid {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Invalid Request: unknown or expired state\n")
+		return
+	}
+	client, err := getOIDCClient()
+	if err != nil {
+		log.Warningf("Error discovering OIDC provider: %s\n", err.Error())
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprint(w, "Error contacting the OIDC provider\n")
+		return
+	}
+
+	claims, err := exchangeOIDCCode(r.Context(), client, query.Get("code"), login)
+	if err != nil {
+		log.Warning("Error handling OIDC login: " + err.Error())
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "Error")
+		return
+	}
+	subjects := getOIDCClaimValues(claims, "sub")
+	issuers := getOIDCClaimValues(claims, "iss")
+	usernames := getOIDCClaimValues(claims, viper.GetString("OIDCUsernameClaim"))
+	if len(subjects) != 1 || subjects[0] == "" || len(issuers) != 1 || len(usernames) != 1 {
+		log.Warningf("OIDC ID token is missing sub, iss or %s\n", viper.GetString("OIDCUsernameClaim"))
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "Error")
+		return
+	}
+	username, err := normalizeExternalUsername(usernames[0])
+	if err != nil {
+		log.Warningf("OIDC user %s has an invalid username %q\n", subjects[0], usernames[0])
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "Error")
+		return
+	}
+	log.Infof("Authenticated %s (%s) using OIDC\n", username, subjects[0])
+
+	//Users are matched on the subject since the username claim can usually be changed by the user
+	externalUser := ExternalUser{Username: username, Issuer: issuers[0], Subject: subjects[0]}
+	if values := getOIDCClaimValues(claims, "email"); len(values) == 1 {
+		externalUser.Email = values[0]
+	}
+	if values := getOIDCClaimValues(claims, "given_name"); len(values) == 1 {
+		externalUser.FirstName = values[0]
+	}
+	if values := getOIDCClaimValues(claims, "family_name"); len(values) == 1 {
+		externalUser.LastName = values[0]
+	}
+	user, err := provisionExternalUser(externalUser)
+	if err != nil {
+		log.Warningf("Error provisioning OIDC user %s: %s\n", externalUser.Username, err.Error())
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "Error")
+		return
+	}
+	managed, granted := getOIDCClaimPermissions(claims)
+	err = syncManagedPermissions(user.ID, managed, granted)
+	if err != nil {
+		log.Criticalf("Error updating permissions of %s: %s\n", user.Username, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Internal Server Error")
+		return
+	}
+	sendNewSession(w, user, false)
+}
+
+//exchangeOIDCCode Trades the code from the provider for tokens and returns the claims of the verified ID token
+func exchangeOIDCCode(ctx context.Context, client *oidcClient, code string, login oidcPendingLogin) (map[string]interface{}, error) {
+	if code == "" {
+		return nil, errors.New("No code in callback")
+	}
+	token, err := client.config.Exchange(ctx, code, oauth2.VerifierOption(login.codeVerifier))
+	if err != nil {
+		return nil, err
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("No ID token in token response")
+	}
+	idToken, err := client.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+	if idToken.Nonce != login.nonce {
+		return nil, errors.New("Nonce of ID token does not match")
+	}
+	var claims map[string]interface{}
+	err = idToken.Claims(&claims)
+	return claims, err
+}
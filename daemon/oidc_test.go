@@ -0,0 +1,335 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package userspaced
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v3"
+	"github.com/spf13/viper"
+)
+
+//mockOIDCIssuer An OIDC provider that hands out an ID token for a single code
+type mockOIDCIssuer struct {
+	server    *httptest.Server
+	key       *rsa.PrivateKey
+	challenge string                 //PKCE challenge that the code verifier has to match
+	nonce     string                 //Nonce put in the ID token
+	claims    map[string]interface{} //Claims put in the ID token besides the standard ones
+}
+
+//startMockOIDCIssuer Starts a provider and points the OIDC config of the daemon at it for the length of a test
+func startMockOIDCIssuer(t *testing.T) *mockOIDCIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &mockOIDCIssuer{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                issuer.server.URL,
+			"authorization_endpoint":                issuer.server.URL + "/auth",
+			"token_endpoint":                        issuer.server.URL + "/token",
+			"jwks_uri":                              issuer.server.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"}}})
+	})
+	mux.HandleFunc("/token", issuer.handleToken)
+	issuer.server = httptest.NewServer(mux)
+
+	settings := map[string]interface{}{
+		"OIDCEnabled":       true,
+		"OIDCIssuerURL":     issuer.server.URL,
+		"OIDCClientID":      "userspace",
+		"OIDCRedirectURL":   "https://localhost:8080/oidccallback",
+		"OIDCScopes":        []string{"openid"},
+		"OIDCUsernameClaim": "preferred_username",
+	}
+	for setting, value := range settings {
+		viper.Set(setting, value)
+	}
+	oidcStateLock.Lock()
+	oidcState = nil
+	oidcStateLock.Unlock()
+	t.Cleanup(func() {
+		issuer.server.Close()
+		for setting := range settings {
+			viper.Set(setting, nil)
+		}
+		oidcStateLock.Lock()
+		oidcState = nil
+		oidcStateLock.Unlock()
+	})
+	return issuer
+}
+
+//handleToken Trades the code for an ID token if the PKCE verifier matches the challenge
+func (issuer *mockOIDCIssuer) handleToken(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	verifierHash := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+	if r.Form.Get("code") != "code" || base64.RawURLEncoding.EncodeToString(verifierHash[:]) != issuer.challenge {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+	claims := map[string]interface{}{
+		"iss":   issuer.server.URL,
+		"aud":   "userspace",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": issuer.nonce,
+	}
+	for claim, value := range issuer.claims {
+		claims[claim] = value
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: jose.JSONWebKey{Key: issuer.key, KeyID: "test"}}, nil)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	payload, _ := json.Marshal(claims)
+	signature, err := signer.Sign(payload)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	idToken, _ := signature.CompactSerialize()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "token", "token_type": "Bearer", "id_token": idToken})
+}
+
+//startLogin Starts a login at /oidclogin and returns its state and the cookie the browser was given
+func (issuer *mockOIDCIssuer) startLogin(t *testing.T) (string, *http.Cookie) {
+	recorder := httptest.NewRecorder()
+	getOIDCLoginHandler(recorder, httptest.NewRequest("GET", "/oidclogin", nil))
+	if recorder.Code != http.StatusFound {
+		t.Fatalf("Login was not redirected to the provider: %d %s", recorder.Code, recorder.Body.String())
+	}
+	location, err := url.Parse(recorder.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := location.Query()
+	if query.Get("code_challenge_method") != "S256" {
+		t.Errorf("Login does not use PKCE with S256: %s", location)
+	}
+	issuer.challenge = query.Get("code_challenge")
+	issuer.nonce = query.Get("nonce")
+	for _, cookie := range recorder.Result().Cookies() {
+		if cookie.Name == oidcStateCookie {
+			return query.Get("state"), cookie
+		}
+	}
+	t.Fatal("Login did not set the state cookie")
+	return "", nil
+}
+
+//finishLogin Sends the browser back to /oidccallback
+func finishLogin(state string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	request := httptest.NewRequest("GET", "/oidccallback?code=code&state="+url.QueryEscape(state), nil)
+	if cookie != nil {
+		request.AddCookie(cookie)
+	}
+	recorder := httptest.NewRecorder()
+	getOIDCCallbackHandler(recorder, request)
+	return recorder
+}
+
+func TestOIDCLogin(t *testing.T) {
+	db := newTestDatabase(t)
+	useTestAuthProvider(t, db)
+	issuer := startMockOIDCIssuer(t)
+
+	issuer.claims = map[string]interface{}{"sub": "1", "preferred_username": "Alice"}
+	state, cookie := issuer.startLogin(t)
+	recorder := finishLogin(state, cookie)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Login failed: %d %s", recorder.Code, recorder.Body.String())
+	}
+	alice, err := authProvider.GetUser("alice")
+	if err != nil {
+		t.Fatalf("User was not created: %s", err.Error())
+	}
+	//A state can only be used once
+	recorder = finishLogin(state, cookie)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("A used state was accepted: %d", recorder.Code)
+	}
+
+	//Renaming yourself at the provider keeps the account
+	issuer.claims = map[string]interface{}{"sub": "1", "preferred_username": "bob"}
+	state, cookie = issuer.startLogin(t)
+	recorder = finishLogin(state, cookie)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Login after a rename failed: %d %s", recorder.Code, recorder.Body.String())
+	}
+	if _, err := authProvider.GetUser("bob"); err == nil {
+		t.Error("A new user was created after a rename")
+	}
+	var identities []ExternalIdentity
+	db.Find(&identities)
+	if len(identities) != 1 || identities[0].UserID != alice.ID || identities[0].Issuer != issuer.server.URL {
+		t.Errorf("Expected a single identity for alice, got %+v", identities)
+	}
+
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		status int
+	}{
+		//Someone else renaming themselves to alice does not get her account
+		{"taken name", map[string]interface{}{"sub": "2", "preferred_username": "alice"}, http.StatusForbidden},
+		{"invalid name", map[string]interface{}{"sub": "3", "preferred_username": "eve+web"}, http.StatusForbidden},
+		{"no subject", map[string]interface{}{"preferred_username": "eve"}, http.StatusForbidden},
+		{"new user", map[string]interface{}{"sub": "4", "preferred_username": "eve"}, http.StatusOK},
+	}
+	for _, test := range tests {
+		issuer.claims = test.claims
+		state, cookie := issuer.startLogin(t)
+		recorder := finishLogin(state, cookie)
+		if recorder.Code != test.status {
+			t.Errorf("%s: expected %d, got %d %s", test.name, test.status, recorder.Code, recorder.Body.String())
+		}
+	}
+}
+
+func TestOIDCLoginChecks(t *testing.T) {
+	db := newTestDatabase(t)
+	useTestAuthProvider(t, db)
+	issuer := startMockOIDCIssuer(t)
+	issuer.claims = map[string]interface{}{"sub": "1", "preferred_username": "alice"}
+
+	//The callback has to come from the browser that started the login
+	state, _ := issuer.startLogin(t)
+	recorder := finishLogin(state, nil)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Callback without the state cookie was accepted: %d", recorder.Code)
+	}
+	otherState, otherCookie := issuer.startLogin(t)
+	recorder = finishLogin(state, otherCookie)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Callback with the cookie of another login was accepted: %d", recorder.Code)
+	}
+	recorder = finishLogin(otherState, otherCookie)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Callback with a matching cookie failed: %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	//The ID token has to carry the nonce of the login
+	state, cookie := issuer.startLogin(t)
+	issuer.nonce = "replayed"
+	recorder = finishLogin(state, cookie)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("ID token with the wrong nonce was accepted: %d", recorder.Code)
+	}
+
+	//The provider only hands out tokens for the verifier whose challenge it was sent
+	state, cookie = issuer.startLogin(t)
+	issuer.challenge = "not-the-challenge"
+	recorder = finishLogin(state, cookie)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Login went through without the PKCE verifier: %d", recorder.Code)
+	}
+}
+
+func TestAddPendingOIDCLoginIsCapped(t *testing.T) {
+	oidcPendingLoginsLock.Lock()
+	previous := oidcPendingLogins
+	oidcPendingLogins = make(map[string]oidcPendingLogin)
+	oidcPendingLoginsLock.Unlock()
+	defer func() {
+		oidcPendingLoginsLock.Lock()
+		oidcPendingLogins = previous
+		oidcPendingLoginsLock.Unlock()
+	}()
+
+	expires := time.Now().Add(oidcLoginTimeout)
+	for i := 0; i < oidcMaxPendingLogins; i++ {
+		err := addPendingOIDCLogin(strconv.Itoa(i), oidcPendingLogin{expires: expires})
+		if err != nil {
+			t.Fatalf("Login %d was refused: %s", i, err.Error())
+		}
+	}
+	err := addPendingOIDCLogin("full", oidcPendingLogin{expires: expires})
+	if err == nil {
+		t.Error("A login was added past the limit")
+	}
+
+	//Logins that expired make room
+	oidcPendingLoginsLock.Lock()
+	for state, login := range oidcPendingLogins {
+		login.expires = time.Now().Add(-time.Second)
+		oidcPendingLogins[state] = login
+		break
+	}
+	oidcPendingLoginsLock.Unlock()
+	err = addPendingOIDCLogin("room", oidcPendingLogin{expires: expires})
+	if err != nil {
+		t.Errorf("An expired login did not make room: %s", err.Error())
+	}
+}
+
+func TestGetOIDCClaimPermissions(t *testing.T) {
+	viper.Set("OIDCClaimPermissions", map[string][]string{
+		"groups=userspace-admins": {"*.*"},
+		"email_verified=true":     {"user.space.exec"},
+		"hd=example.edu":          {"space.gpu"},
+	})
+	defer viper.Set("OIDCClaimPermissions", nil)
+
+	tests := []struct {
+		name    string
+		claims  map[string]interface{}
+		granted []string
+	}{
+		{"no claims", map[string]interface{}{}, nil},
+		{"list claim", map[string]interface{}{"groups": []interface{}{"staff", "Userspace-Admins"}}, []string{"*.*"}},
+		{"boolean claim", map[string]interface{}{"email_verified": true}, []string{"user.space.exec"}},
+		{"false boolean", map[string]interface{}{"email_verified": false}, nil},
+		//Claim names are compared without regard to case like the values
+		{"claim case", map[string]interface{}{"HD": "Example.edu"}, []string{"space.gpu"}},
+		{"several claims", map[string]interface{}{"hd": "example.edu", "email_verified": true}, []string{"space.gpu", "user.space.exec"}},
+		{"other value", map[string]interface{}{"hd": "example.com"}, nil},
+	}
+	for _, test := range tests {
+		managed, granted := getOIDCClaimPermissions(test.claims)
+		sort.Strings(managed)
+		sort.Strings(granted)
+		if strings.Join(managed, ",") != "*.*,space.gpu,user.space.exec" {
+			t.Errorf("%s: every mapped permission should be managed, got %v", test.name, managed)
+		}
+		if strings.Join(granted, ",") != strings.Join(test.granted, ",") {
+			t.Errorf("%s: expected %v to be granted, got %v", test.name, test.granted, granted)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package userspaced
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/spf13/viper"
+	auth "github.com/twa16/go-auth"
+)
+
+//ExternalUser A user as an external identity provider such as LDAP describes them
+type ExternalUser struct {
+	Username  string   //Name the user logs in with
+	Email     string   //Email address of the user
+	FirstName string   //First name of the user
+	LastName  string   //Last name of the user
+	Groups    []string //Groups the user belongs to in the provider
+	Issuer    string   //Provider that issued Subject
+	Subject   string   //Unchanging ID of the account at the provider. Users are matched on this rather than the username.
+}
+
+//Issuers of LDAP and CAS identities. Both name their accounts by username so the username is used as the subject.
+//OIDC issuers are URLs so they cannot collide with these.
+const (
+	ldapIssuer = "ldap"
+	casIssuer  = "cas"
+)
+
+//unlinkedUserIssuers Issuers whose logins may claim a user from before LDAP and CAS users were linked to identities
+var unlinkedUserIssuers = map[string]bool{
+	ldapIssuer: true,
+	casIssuer:  true,
+}
+
+//errInvalidExternalUsername Returned when a provider names a user with something that cannot be a username
+var errInvalidExternalUsername = errors.New("The name of this user at the provider is not a valid username")
+
+//normalizeExternalUsername Returns the username for a name that a provider sent. Providers match names without case
+//so the name is lowercased, and it ends up in SSH logins and subdomains so it has to follow the same rules as the names
+//of local users.
+func normalizeExternalUsername(name string) (string, error) {
+	username := strings.ToLower(strings.TrimSpace(name))
+	if !usernamePattern.MatchString(username) {
+		return "", errInvalidExternalUsername
+	}
+	return username, nil
+}
+
+//getRegistrationUsernamePrefix Returns the prefix that the names of registered users have to start with. Providers
+//cannot hand out names with the prefix, so registration cannot take the name of someone who has not logged in yet.
+//Empty if no external provider is enabled since there are then no other names to collide with.
+func getRegistrationUsernamePrefix() string {
+	if !viper.GetBool("SupportsCAS") && !viper.GetBool("LDAPEnabled") && !viper.GetBool("OIDCEnabled") {
+		return ""
+	}
+	return viper.GetString("RegistrationUsernamePrefix")
+}
+
+//provisionExternalUser Returns the internal user for someone who logged in through an external provider. The user is
+//created on their first login and their profile is updated from the provider on every login after that.
+func provisionExternalUser(external ExternalUser) (auth.User, error) {
+	//The bootstrapped admin holds *.* so no provider may ever log in as it, whatever state its password is in
+	if external.Username == viper.GetString("AdminUsername") {
+		return auth.User{}, errors.New("External logins cannot use the name of the admin user")
+	}
+	prefix := getRegistrationUsernamePrefix()
+	if prefix != "" && strings.HasPrefix(external.Username, prefix) {
+		return auth.User{}, errors.New("Usernames starting with " + prefix + " are reserved for registered users")
+	}
+	//Matching on the username alone would let one provider log in as the users of another
+	if external.Issuer == "" || external.Subject == "" {
+		return auth.User{}, errors.New("External users need an issuer and a subject")
+	}
+	return provisionExternalIdentity(external)
+}
+
+//provisionExternalIdentity Returns the user linked to the account of a provider that is matched on its subject.
+//The username only names the user when they are created, and it has to be free then.
+func provisionExternalIdentity(external ExternalUser) (auth.User, error) {
+	var identity ExternalIdentity
+	query := database.Where("issuer = ? AND subject = ?", external.Issuer, external.Subject).First(&identity)
+	if query.Error == nil {
+		user, err := authProvider.GetUserByID(identity.UserID)
+		if err != nil {
+			return user, err
+		}
+		return updateExternalUser(user, external)
+	}
+	if !query.RecordNotFound() {
+		return auth.User{}, query.Error
+	}
+
+	user, err := authProvider.GetUser(external.Username)
+	if err == nil {
+		err = checkUnlinkedUser(user, external)
+		if err != nil {
+			return auth.User{}, err
+		}
+		identity = ExternalIdentity{Issuer: external.Issuer, Subject: external.Subject, UserID: user.ID}
+		err = database.Create(&identity).Error
+		if err != nil {
+			return auth.User{}, err
+		}
+		log.Infof("Linked user %s to their %s identity\n", user.Username, external.Issuer)
+		return updateExternalUser(user, external)
+	}
+	if err.Error() != "record not found" {
+		return auth.User{}, err
+	}
+	user, err = createExternalUser(external)
+	if err != nil {
+		return user, err
+	}
+	identity = ExternalIdentity{Issuer: external.Issuer, Subject: external.Subject, UserID: user.ID}
+	return user, database.Create(&identity).Error
+}
+
+//checkUnlinkedUser Returns an error unless an identity may claim a user that already has its name. Only LDAP and CAS
+//logins qualify. They may claim users created before logins were linked to identities, and with LinkLDAPAndCASUsers
+//set, users of the other one of the two, which then logs in as the same user. Local users, who have a password, and
+//users linked to any other identity are never handed to another login.
+func checkUnlinkedUser(user auth.User, external ExternalUser) error {
+	if !unlinkedUserIssuers[external.Issuer] || user.PasswordHash != "" {
+		return errors.New("A different user with this name already exists")
+	}
+	var identities []ExternalIdentity
+	err := database.Where("user_id = ?", user.ID).Find(&identities).Error
+	if err != nil {
+		return err
+	}
+	for _, identity := range identities {
+		if !viper.GetBool("LinkLDAPAndCASUsers") || !unlinkedUserIssuers[identity.Issuer] {
+			return errors.New("A different user with this name already exists")
+		}
+	}
+	return nil
+}
+
+//createExternalUser Creates the internal user for the first login of someone from a provider
+func createExternalUser(external ExternalUser) (auth.User, error) {
+	var user auth.User
+	user.Username = external.Username
+	user.Email = external.Email
+	user.FirstName = external.FirstName
+	user.LastName = external.LastName
+	user.Permissions = []auth.Permission{
+		{Permission: "user.*"},
+	}
+	user, err := authProvider.CreateUser(user)
+	if err != nil {
+		return user, err
+	}
+	log.Infof("Created user %s on first login\n", user.Username)
+	return user, nil
+}
+
+//updateExternalUser Updates the profile of a user from what the provider sent at login
+func updateExternalUser(user auth.User, external ExternalUser) (auth.User, error) {
+	updates := make(map[string]interface{})
+	if external.Email != "" && external.Email != user.Email {
+		updates["email"] = external.Email
+	}
+	if external.FirstName != "" && external.FirstName != user.FirstName {
+		updates["first_name"] = external.FirstName
+	}
+	if external.LastName != "" && external.LastName != user.LastName {
+		updates["last_name"] = external.LastName
+	}
+	if len(updates) == 0 {
+		return user, nil
+	}
+	return user, database.Model(&user).Updates(updates).Error
+}
+
+//syncManagedPermissions Makes the permissions of a user that a provider manages match what the provider granted.
+//Permissions outside of managed, such as ones given by an admin, are left alone.
+func syncManagedPermissions(userID uint, managed []string, granted []string) error {
+	var current []auth.Permission
+	err := database.Where("auth_user_id = ?", userID).Find(&current).Error
+	if err != nil {
+		return err
+	}
+	isManaged := make(map[string]bool)
+	for _, permission := range managed {
+		isManaged[permission] = true
+	}
+	isGranted := make(map[string]bool)
+	for _, permission := range granted {
+		isGranted[permission] = true
+	}
+
+	held := make(map[string]bool)
+	for _, permission := range current {
+		held[permission.Permission] = true
+		if isManaged[permission.Permission] && !isGranted[permission.Permission] {
+			err = database.Delete(&permission).Error
+			if err != nil {
+				return err
+			}
+			log.Infof("Removed %s from user %d\n", permission.Permission, userID)
+		}
+	}
+	for permission := range isGranted {
+		if held[permission] {
+			continue
+		}
+		err = database.Create(&auth.Permission{AuthUserID: userID, Permission: permission}).Error
+		if err != nil {
+			return err
+		}
+		log.Infof("Granted %s to user %d\n", permission, userID)
+	}
+	return nil
+}
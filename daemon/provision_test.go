@@ -0,0 +1,232 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package userspaced
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	auth "github.com/twa16/go-auth"
+)
+
+func TestProvisionExternalUser(t *testing.T) {
+	db := newTestDatabase(t)
+	useTestAuthProvider(t, db)
+	viper.Set("SupportsCAS", true)
+	viper.Set("RegistrationUsernamePrefix", "local-")
+	viper.Set("AdminUsername", "admin")
+	defer viper.Set("SupportsCAS", nil)
+	defer viper.Set("RegistrationUsernamePrefix", nil)
+	defer viper.Set("AdminUsername", nil)
+	_, err := authProvider.CreateUser(auth.User{Username: "local-alice", PasswordHash: "hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = authProvider.CreateUser(auth.User{Username: "carol", PasswordHash: "hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		username string
+		valid    bool
+	}{
+		{"bob", true},
+		//Logging in again returns the same user
+		{"bob", true},
+		//Names of registered users are out of reach of providers
+		{"local-alice", false},
+		{"local-dave", false},
+		//So are local users from before the prefix
+		{"carol", false},
+		//The admin is never handed to a provider, even before it is bootstrapped
+		{"admin", false},
+	}
+	for _, test := range tests {
+		user, err := provisionExternalUser(ExternalUser{Username: test.username, Issuer: casIssuer, Subject: test.username})
+		if (err == nil) != test.valid {
+			t.Errorf("%s: expected success to be %t, got %v", test.username, test.valid, err)
+			continue
+		}
+		if test.valid && (user.ID == 0 || user.Username != test.username) {
+			t.Errorf("%s: got user %q with ID %d", test.username, user.Username, user.ID)
+		}
+	}
+}
+
+func TestProvisionExternalUserKeepsProvidersApart(t *testing.T) {
+	db := newTestDatabase(t)
+	useTestAuthProvider(t, db)
+	//Users from before LDAP and CAS logins were linked to identities
+	erin, err := authProvider.CreateUser(auth.User{Username: "erin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = authProvider.CreateUser(auth.User{Username: "frank"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bob, err := provisionExternalUser(ExternalUser{Username: "bob", Issuer: ldapIssuer, Subject: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		external ExternalUser
+		userID   uint //ID of the user the login should get. Zero if it should be refused.
+	}{
+		{"same provider", ExternalUser{Username: "bob", Issuer: ldapIssuer, Subject: "bob"}, bob.ID},
+		{"CAS user with the name of an LDAP user", ExternalUser{Username: "bob", Issuer: casIssuer, Subject: "bob"}, 0},
+		{"OIDC user with the name of an LDAP user", ExternalUser{Username: "bob", Issuer: "https://id.example.com", Subject: "1234"}, 0},
+		{"no subject", ExternalUser{Username: "bob", Issuer: ldapIssuer}, 0},
+		{"no issuer", ExternalUser{Username: "bob", Subject: "bob"}, 0},
+		//The first login to an unlinked user claims it and it is then closed to the others
+		{"CAS claims an unlinked user", ExternalUser{Username: "erin", Issuer: casIssuer, Subject: "erin"}, erin.ID},
+		{"CAS logs in again", ExternalUser{Username: "erin", Issuer: casIssuer, Subject: "erin"}, erin.ID},
+		{"LDAP after the claim", ExternalUser{Username: "erin", Issuer: ldapIssuer, Subject: "erin"}, 0},
+		//OIDC has always matched on subjects so it never had a claim to users by name
+		{"OIDC user with the name of an unlinked user", ExternalUser{Username: "frank", Issuer: "https://id.example.com", Subject: "5678"}, 0},
+	}
+	for _, test := range tests {
+		user, err := provisionExternalUser(test.external)
+		if test.userID == 0 {
+			if err == nil {
+				t.Errorf("%s: logged in as %s(%d)", test.name, user.Username, user.ID)
+			}
+			continue
+		}
+		if err != nil || user.ID != test.userID {
+			t.Errorf("%s: got user %d (%v), want %d", test.name, user.ID, err, test.userID)
+		}
+	}
+	var identities int
+	db.Model(&ExternalIdentity{}).Where("user_id = ?", erin.ID).Count(&identities)
+	if identities != 1 {
+		t.Errorf("erin has %d identities, want 1", identities)
+	}
+}
+
+func TestProvisionExternalUserLinksLDAPAndCASWhenConfigured(t *testing.T) {
+	db := newTestDatabase(t)
+	useTestAuthProvider(t, db)
+	viper.Set("LinkLDAPAndCASUsers", true)
+	defer viper.Set("LinkLDAPAndCASUsers", nil)
+
+	casUser, err := provisionExternalUser(ExternalUser{Username: "bob", Issuer: casIssuer, Subject: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ldapUser, err := provisionExternalUser(ExternalUser{Username: "bob", Issuer: ldapIssuer, Subject: "bob"})
+	if err != nil || ldapUser.ID != casUser.ID {
+		t.Fatalf("LDAP login got user %d (%v), want the CAS user %d", ldapUser.ID, err, casUser.ID)
+	}
+	//Both logins keep working once they are linked
+	for _, issuer := range []string{casIssuer, ldapIssuer} {
+		user, err := provisionExternalUser(ExternalUser{Username: "bob", Issuer: issuer, Subject: "bob"})
+		if err != nil || user.ID != casUser.ID {
+			t.Errorf("%s login again got user %d (%v)", issuer, user.ID, err)
+		}
+	}
+	//Other providers are still kept apart
+	_, err = provisionExternalUser(ExternalUser{Username: "bob", Issuer: "https://id.example.com", Subject: "1234"})
+	if err == nil {
+		t.Error("OIDC login was linked to the user of LDAP and CAS")
+	}
+	oidcUser, err := provisionExternalUser(ExternalUser{Username: "carol", Issuer: "https://id.example.com", Subject: "5678"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := provisionExternalUser(ExternalUser{Username: "carol", Issuer: casIssuer, Subject: "carol"})
+	if err == nil {
+		t.Errorf("CAS login was linked to OIDC user %d as user %d", oidcUser.ID, user.ID)
+	}
+}
+
+func TestNormalizeExternalUsername(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		valid    bool
+	}{
+		{"alice", "alice", true},
+		{"Alice", "alice", true},
+		{" bob.smith ", "bob.smith", true},
+		{"carol_1-x", "carol_1-x", true},
+		//These would break the user+space logins of the SSH gateway or the subdomains of the HTTP proxy
+		{"dave smith", "", false},
+		{"dave@example.edu", "", false},
+		{"dave+web", "", false},
+		{"-dave", "", false},
+		{"d", "", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		username, err := normalizeExternalUsername(test.name)
+		if (err == nil) != test.valid || username != test.username {
+			t.Errorf("normalizeExternalUsername(%q) = %q, %v", test.name, username, err)
+		}
+	}
+}
+
+func TestSyncManagedPermissions(t *testing.T) {
+	tests := []struct {
+		name    string
+		current []string
+		managed []string
+		granted []string
+		result  []string
+	}{
+		{"grant", nil, []string{"space.gpu"}, []string{"space.gpu"}, []string{"space.gpu"}},
+		{"revoke", []string{"space.gpu", "user.*"}, []string{"space.gpu"}, nil, []string{"user.*"}},
+		{"keep", []string{"space.gpu"}, []string{"space.gpu"}, []string{"space.gpu"}, []string{"space.gpu"}},
+		//Permissions an admin gave by hand are not the provider's to take away
+		{"unmanaged", []string{"admin.*"}, []string{"space.gpu"}, nil, []string{"admin.*"}},
+		{"swap", []string{"user.*"}, []string{"user.*", "guest.*"}, []string{"guest.*"}, []string{"guest.*"}},
+		{"duplicate grants", nil, []string{"space.gpu"}, []string{"space.gpu", "space.gpu"}, []string{"space.gpu"}},
+	}
+	for _, test := range tests {
+		db := newTestDatabase(t)
+		useTestAuthProvider(t, db)
+		var permissions []auth.Permission
+		for _, permission := range test.current {
+			permissions = append(permissions, auth.Permission{Permission: permission})
+		}
+		user, err := authProvider.CreateUser(auth.User{Username: "alice", Permissions: permissions})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = syncManagedPermissions(user.ID, test.managed, test.granted)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+		var held []auth.Permission
+		db.Where("auth_user_id = ?", user.ID).Find(&held)
+		var result []string
+		for _, permission := range held {
+			result = append(result, permission.Permission)
+		}
+		sort.Strings(result)
+		if strings.Join(result, ",") != strings.Join(test.result, ",") {
+			t.Errorf("%s: expected %v, got %v", test.name, test.result, result)
+		}
+	}
+}
@@ -17,130 +17,328 @@
 package userspaced
 
 import (
-	"bytes"
-	"encoding/hex"
-	"flag"
-	"fmt"
-	"github.com/op/go-logging"
 	"io"
 	"net"
 	"strconv"
+	"sync"
 	"time"
-)
 
-var logproxy = logging.MustGetLogger("userspace-daemon")
+	"github.com/jinzhu/gorm"
+	"github.com/spf13/viper"
+)
 
+//ProxyInstance Forwards connections from an external address to a port that a space's container publishes on 127.0.0.1
 type ProxyInstance struct {
-	ID             uint      `gorm:"primary_key" json:"-"`   // Primary Key and ID of container
-	PublicID       string    `gorm:"index" json:"space_id"`  // Public UUID of this Space
-	CreatedAt      time.Time `json:"-"`                      // Creation time
-	ListenAddress  string    `unique_index:idx_lstnaddress"` // Address that the proxy will listen on
-	ListenPort     int       `unique_index:idx_lstnaddress"` // Port that the proxy will listen on
-	ConnectAddress string    // Address that the proxy will connect to
-	ConnectPort    int       // Port that the proxy will connect to
-	SpaceID        string
-}
-
-func (proxy ProxyInstance) proxyConn(conn *net.TCPConn) {
-	rAddr, err := net.ResolveTCPAddr("tcp", buildConnectAddress(proxy))
-	fmt.Println(rAddr)
-	if err != nil {
-		panic(err)
+	ID             uint      `gorm:"primary_key" json:"-"`                                 // Primary Key and ID of container
+	CreatedAt      time.Time `json:"-"`                                                    // Creation time
+	ListenAddress  string    `gorm:"unique_index:idx_proxy_listen" json:"-"`               // Address that the proxy will listen on
+	ListenPort     int       `gorm:"unique_index:idx_proxy_listen" json:"-"`               // Port that the proxy will listen on
+	Protocol       string    `gorm:"unique_index:idx_proxy_listen;default:'tcp'" json:"-"` // tcp or udp
+	ConnectAddress string    `json:"-"`                                                    // Address that the proxy will connect to
+	ConnectPort    int       `json:"-"`                                                    // Port that the proxy will connect to
+	SpaceID        uint      `gorm:"index" json:"-"`                                       // ID of the space the proxy forwards to
+	SpacePort      uint16    `json:"-"`                                                    // Port on the space that the proxy reaches
+}
+
+//runningProxy A proxy that is accepting connections
+type runningProxy struct {
+	instance ProxyInstance //Configuration of the proxy
+	listener io.Closer     //Closed to stop the proxy
+}
+
+//udpSpacePorts Ports on a space that docker publishes for UDP as well as TCP
+var udpSpacePorts = map[uint16]bool{1337: true}
+
+//udpSessionTimeout How long a UDP client may be quiet before its connection to the space is closed
+const udpSessionTimeout = 2 * time.Minute
+
+//udpMaxPacketBytes Largest UDP payload that can be relayed
+const udpMaxPacketBytes = 65535
+
+var runningProxies = make(map[uint]*runningProxy)
+var runningProxiesLock sync.Mutex
+
+//proxyAccessInterval LastNetAccess is written at most this often for a space so busy ports do not hammer the database
+const proxyAccessInterval = time.Minute
+
+//proxyLastAccess The last time LastNetAccess was written for each space, shared by all proxies of the space
+var proxyLastAccess = make(map[uint]time.Time)
+var proxyLastAccessLock sync.Mutex
+
+//recordProxyAccess Updates LastNetAccess of a space unless it was written in the last proxyAccessInterval
+func recordProxyAccess(db *gorm.DB, spaceID uint) {
+	now := time.Now()
+	proxyLastAccessLock.Lock()
+	if now.Sub(proxyLastAccess[spaceID]) < proxyAccessInterval {
+		proxyLastAccessLock.Unlock()
+		return
 	}
+	proxyLastAccess[spaceID] = now
+	proxyLastAccessLock.Unlock()
+	db.Model(&Space{ID: spaceID}).Update("last_net_access", now)
+}
 
-	rConn, err := net.DialTCP("tcp", nil, rAddr)
-	if err != nil {
-		panic(err)
+//forgetProxyAccess Drops the last access of a space once its proxies are removed
+func forgetProxyAccess(spaceID uint) {
+	proxyLastAccessLock.Lock()
+	defer proxyLastAccessLock.Unlock()
+	delete(proxyLastAccess, spaceID)
+}
+
+//startSpaceProxies Starts a proxy for every port link of every space. Called when the daemon starts.
+func startSpaceProxies(db *gorm.DB) {
+	var spaces []Space
+	db.Where("archived = ?", false).Find(&spaces)
+	for _, space := range spaces {
+		ensureSpaceProxies(db, space)
 	}
-	defer rConn.Close()
+}
 
-	buf := &bytes.Buffer{}
-	for {
-		data := make([]byte, 256)
-		n, err := conn.Read(data)
-		if err != nil {
-			panic(err)
+//migrateProxyInstances Replaces the unique index on the listen address and port with one that includes the protocol,
+//so that the TCP and UDP proxies of a port can both be stored. Has to run before ProxyInstance is migrated.
+func migrateProxyInstances(db *gorm.DB) error {
+	if !db.HasTable(&ProxyInstance{}) || !db.Dialect().HasIndex(db.NewScope(&ProxyInstance{}).TableName(), "idx_lstnaddress") {
+		return nil
+	}
+	log.Info("Replacing index idx_lstnaddress of proxy_instances")
+	return db.Model(&ProxyInstance{}).RemoveIndex("idx_lstnaddress").Error
+}
+
+//ensureSpaceProxies Creates the proxy records for the port links of a space and starts any that are not running.
+//Links that cannot be proxied are marked so that clients know the port is only reachable from the host itself.
+func ensureSpaceProxies(db *gorm.DB, space Space) {
+	dockerHost := getHostByID(space.HostID)
+	if dockerHost == nil {
+		return
+	}
+
+	var portLinks []SpacePortLink
+	db.Where("space_id = ?", space.ID).Find(&portLinks)
+	for _, portLink := range portLinks {
+		proxied := false
+		//Containers publish their ports on 127.0.0.1 of their host so only a local host can be reached from here
+		if dockerHost.ConnectionType != "local" {
+			log.Warningf("Not proxying port %d of Space %d since host %s(%d) is not local\n", portLink.ExternalPort, space.ID, dockerHost.Name, dockerHost.ID)
+		} else {
+			proxied = ensurePortLinkProxies(db, space, portLink)
 		}
-		buf.Write(data[:n])
-		if data[0] == '\r' && data[1] == '\n' {
-			break
+		if proxied != portLink.Proxied {
+			db.Model(&SpacePortLink{ID: portLink.ID}).Update("proxied", proxied)
 		}
 	}
+}
 
-	if _, err := rConn.Write(buf.Bytes()); err != nil {
-		panic(err)
+//ensurePortLinkProxies Starts the proxies of a port link. A proxy is started for every protocol that docker publishes
+//the port for. Returns true if all of them are running.
+func ensurePortLinkProxies(db *gorm.DB, space Space, portLink SpacePortLink) bool {
+	listenAddress := viper.GetString("ProxyListenAddress")
+	if listenAddress == "" {
+		listenAddress = portLink.ExternalAddress
+	}
+	//Listening on every interface would collide with the port that docker publishes on 127.0.0.1
+	if listenAddress == "" {
+		log.Warningf("Not proxying port %d of Space %d since neither ProxyListenAddress nor the external address of the host is set\n", portLink.ExternalPort, space.ID)
+		return false
 	}
-	logproxy.Debugf("sent:\n%v", hex.Dump(buf.Bytes()))
 
-	data := make([]byte, 1024)
-	n, err := rConn.Read(data)
-	if err != nil {
-		if err != io.EOF {
-			panic(err)
-		} else {
-			logproxy.Debugf("received err: %v", err)
+	protocols := []string{"tcp"}
+	if udpSpacePorts[portLink.SpacePort] {
+		protocols = append(protocols, "udp")
+	}
+	proxied := true
+	for _, protocol := range protocols {
+		var proxy ProxyInstance
+		query := db.Where("listen_address = ? AND listen_port = ? AND protocol = ?", listenAddress, portLink.ExternalPort, protocol).First(&proxy)
+		if query.Error != nil && !query.RecordNotFound() {
+			log.Warningf("Error retrieving proxy for port %d of Space %d: %s\n", portLink.ExternalPort, space.ID, query.Error.Error())
+			proxied = false
+			continue
+		}
+		proxy.ListenAddress = listenAddress
+		proxy.ListenPort = int(portLink.ExternalPort)
+		proxy.Protocol = protocol
+		proxy.ConnectAddress = "127.0.0.1"
+		proxy.ConnectPort = int(portLink.ExternalPort)
+		proxy.SpaceID = space.ID
+		proxy.SpacePort = portLink.SpacePort
+		err := db.Save(&proxy).Error
+		if err != nil {
+			log.Warningf("Error saving proxy for port %d of Space %d: %s\n", portLink.ExternalPort, space.ID, err.Error())
+			proxied = false
+			continue
+		}
+		err = startProxy(db, proxy)
+		if err != nil {
+			log.Warningf("Error starting proxy %s/%s for Space %d: %s\n", buildListenAddress(proxy), protocol, space.ID, err.Error())
+			proxied = false
 		}
 	}
-	logproxy.Debugf("received:\n%v", hex.Dump(data[:n]))
+	return proxied
 }
 
-func (proxy ProxyInstance) handleConn(in <-chan *net.TCPConn, out chan<- *net.TCPConn) {
-	for conn := range in {
-		proxy.proxyConn(conn)
-		out <- conn
+//removeSpaceProxies Stops the proxies of a space and deletes their records
+func removeSpaceProxies(db *gorm.DB, spaceID uint) {
+	var proxies []ProxyInstance
+	db.Where("space_id = ?", spaceID).Find(&proxies)
+	for _, proxy := range proxies {
+		stopProxy(proxy.ID)
 	}
+	db.Where("space_id = ?", spaceID).Delete(&ProxyInstance{})
+	forgetProxyAccess(spaceID)
 }
 
-func (proxy ProxyInstance) closeConn(in <-chan *net.TCPConn) {
-	for conn := range in {
-		conn.Close()
+//startProxy Starts accepting connections for a proxy. Nothing happens if the proxy is already running.
+func startProxy(db *gorm.DB, proxy ProxyInstance) error {
+	runningProxiesLock.Lock()
+	defer runningProxiesLock.Unlock()
+	if _, running := runningProxies[proxy.ID]; running {
+		return nil
+	}
+	if proxy.Protocol == "udp" {
+		listener, err := net.ListenPacket("udp", buildListenAddress(proxy))
+		if err != nil {
+			return err
+		}
+		runningProxies[proxy.ID] = &runningProxy{instance: proxy, listener: listener}
+		go proxy.relayPackets(db, listener)
+	} else {
+		listener, err := net.Listen("tcp", buildListenAddress(proxy))
+		if err != nil {
+			return err
+		}
+		runningProxies[proxy.ID] = &runningProxy{instance: proxy, listener: listener}
+		go proxy.acceptConns(db, listener)
 	}
+	log.Infof("Proxying %s to %s over %s for Space %d\n", buildListenAddress(proxy), buildConnectAddress(proxy), proxy.Protocol, proxy.SpaceID)
+	return nil
 }
 
-func (proxy ProxyInstance) start() {
-	flag.Parse()
+//stopProxy Stops accepting connections for a proxy. Connections that are open are left alone.
+func stopProxy(proxyID uint) {
+	runningProxiesLock.Lock()
+	defer runningProxiesLock.Unlock()
+	running, exists := runningProxies[proxyID]
+	if !exists {
+		return
+	}
+	running.listener.Close()
+	delete(runningProxies, proxyID)
+}
 
-	addr, err := net.ResolveTCPAddr("tcp", buildListenAddress(proxy))
-	if err != nil {
-		panic(err)
+//acceptConns Hands every connection to its own goroutine until the listener is closed
+func (proxy ProxyInstance) acceptConns(db *gorm.DB, listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			//Temporary errors such as running out of file descriptors should not stop the proxy
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				log.Warningf("Error accepting connection on %s: %s\n", buildListenAddress(proxy), err.Error())
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			log.Debugf("Proxy on %s stopped: %s\n", buildListenAddress(proxy), err.Error())
+			return
+		}
+		//SSH is tracked by the session tracker
+		if proxy.SpacePort != 22 {
+			recordProxyAccess(db, proxy.SpaceID)
+		}
+		go proxy.proxyConn(conn)
 	}
+}
 
-	listener, err := net.ListenTCP("tcp", addr)
+//proxyConn Copies data in both directions between a client and the space until both sides are done
+func (proxy ProxyInstance) proxyConn(conn net.Conn) {
+	defer conn.Close()
+	timeout := time.Duration(viper.GetInt("ProxyConnectTimeoutSeconds")) * time.Second
+	rConn, err := net.DialTimeout("tcp", buildConnectAddress(proxy), timeout)
 	if err != nil {
-		panic(err)
+		log.Debugf("Proxy could not connect to %s: %s\n", buildConnectAddress(proxy), err.Error())
+		return
 	}
+	defer rConn.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go copyAndCloseWrite(rConn, conn, &wg)
+	go copyAndCloseWrite(conn, rConn, &wg)
+	wg.Wait()
+}
 
-	pending, complete := make(chan *net.TCPConn), make(chan *net.TCPConn)
+//relayPackets Forwards UDP packets to the space. Each client gets its own socket to the space so replies can be
+//sent back to the right client.
+func (proxy ProxyInstance) relayPackets(db *gorm.DB, listener net.PacketConn) {
+	sessions := make(map[string]net.Conn)
+	var sessionsLock sync.Mutex
+	buffer := make([]byte, udpMaxPacketBytes)
+	for {
+		n, client, err := listener.ReadFrom(buffer)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+			log.Debugf("UDP proxy on %s stopped: %s\n", buildListenAddress(proxy), err.Error())
+			sessionsLock.Lock()
+			for _, session := range sessions {
+				session.Close()
+			}
+			sessionsLock.Unlock()
+			return
+		}
 
-	for i := 0; i < 5; i++ {
-		go proxy.handleConn(pending, complete)
+		sessionsLock.Lock()
+		session, exists := sessions[client.String()]
+		if !exists {
+			session, err = net.Dial("udp", buildConnectAddress(proxy))
+			if err != nil {
+				sessionsLock.Unlock()
+				log.Debugf("Proxy could not connect to %s: %s\n", buildConnectAddress(proxy), err.Error())
+				continue
+			}
+			sessions[client.String()] = session
+			recordProxyAccess(db, proxy.SpaceID)
+			go relayReplies(listener, client, session, func() {
+				sessionsLock.Lock()
+				delete(sessions, client.String())
+				sessionsLock.Unlock()
+			})
+		}
+		sessionsLock.Unlock()
+		session.SetReadDeadline(time.Now().Add(udpSessionTimeout))
+		session.Write(buffer[:n])
 	}
-	go proxy.closeConn(complete)
+}
 
+//relayReplies Sends what the space answers back to a UDP client until the client has been quiet for udpSessionTimeout
+func relayReplies(listener net.PacketConn, client net.Addr, session net.Conn, done func()) {
+	defer done()
+	defer session.Close()
+	buffer := make([]byte, udpMaxPacketBytes)
+	session.SetReadDeadline(time.Now().Add(udpSessionTimeout))
 	for {
-		conn, err := listener.AcceptTCP()
+		n, err := session.Read(buffer)
 		if err != nil {
-			panic(err)
+			return
 		}
-		pending <- conn
-		logproxy.Debugf("Got shit\n")
+		listener.WriteTo(buffer[:n], client)
 	}
 }
 
-func buildListenAddress(configuration ProxyInstance) string {
-	return configuration.ListenAddress + ":" + strconv.Itoa(configuration.ListenPort)
+//copyAndCloseWrite Copies from src to dst and then tells dst that nothing more will be sent so the other direction can finish
+func copyAndCloseWrite(dst net.Conn, src net.Conn, wg *sync.WaitGroup) {
+	defer wg.Done()
+	io.Copy(dst, src)
+	if tcpConn, ok := dst.(*net.TCPConn); ok {
+		tcpConn.CloseWrite()
+	} else {
+		dst.Close()
+	}
 }
 
-func buildConnectAddress(configuration ProxyInstance) string {
-	return configuration.ConnectAddress + ":" + strconv.Itoa(configuration.ConnectPort)
+func buildListenAddress(configuration ProxyInstance) string {
+	return net.JoinHostPort(configuration.ListenAddress, strconv.Itoa(configuration.ListenPort))
 }
 
-func main_test() {
-	proxy := ProxyInstance{}
-	proxy.ListenAddress = "192.168.0.109"
-	proxy.ListenPort = 6275
-	proxy.ConnectAddress = "162.17.206.195"
-	proxy.ConnectPort = 80
-	proxy.start()
-
+func buildConnectAddress(configuration ProxyInstance) string {
+	return net.JoinHostPort(configuration.ConnectAddress, strconv.Itoa(configuration.ConnectPort))
 }
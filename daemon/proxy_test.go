@@ -0,0 +1,265 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package userspaced
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+//getFreePort Returns a port on 127.0.0.1 that nothing is listening on for TCP or UDP
+func getFreePort(t *testing.T) int {
+	for i := 0; i < 10; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := listener.Addr().(*net.TCPAddr).Port
+		listener.Close()
+		packetConn, err := net.ListenPacket("udp", listener.Addr().String())
+		if err == nil {
+			packetConn.Close()
+			return port
+		}
+	}
+	t.Fatal("No free port")
+	return 0
+}
+
+//startTCPEcho Starts a server that sends back whatever it receives
+func startTCPEcho(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+//startUDPEcho Starts a server that sends every packet back to where it came from
+func startUDPEcho(t *testing.T) int {
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		packetConn.Close()
+	})
+	go func() {
+		buffer := make([]byte, 1500)
+		for {
+			n, from, err := packetConn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			packetConn.WriteTo(buffer[:n], from)
+		}
+	}()
+	return packetConn.LocalAddr().(*net.UDPAddr).Port
+}
+
+//startTestProxy Saves and starts a proxy that is stopped when the test ends
+func startTestProxy(t *testing.T, db *gorm.DB, proxy ProxyInstance) ProxyInstance {
+	db.Create(&proxy)
+	err := startProxy(db, proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		stopProxy(proxy.ID)
+		//Space IDs start over in every test database
+		forgetProxyAccess(proxy.SpaceID)
+	})
+	return proxy
+}
+
+func TestTCPProxy(t *testing.T) {
+	db := newTestDatabase(t)
+	space := Space{}
+	db.Create(&space)
+	proxy := startTestProxy(t, db, ProxyInstance{
+		ListenAddress:  "127.0.0.1",
+		ListenPort:     getFreePort(t),
+		Protocol:       "tcp",
+		ConnectAddress: "127.0.0.1",
+		ConnectPort:    startTCPEcho(t),
+		SpaceID:        space.ID,
+		SpacePort:      1337,
+	})
+
+	conn, err := net.Dial("tcp", buildListenAddress(proxy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("hello"))
+	//Closing our side has to reach the space and close the other direction as well
+	conn.(*net.TCPConn).CloseWrite()
+	reply, err := io.ReadAll(conn)
+	if err != nil || string(reply) != "hello" {
+		t.Errorf("Reply = %q, %v", reply, err)
+	}
+	db.First(&space, space.ID)
+	if space.LastNetAccess.IsZero() {
+		t.Error("Connection did not count as network access")
+	}
+}
+
+func TestRecordProxyAccessIsThrottled(t *testing.T) {
+	db := newTestDatabase(t)
+	space := Space{}
+	db.Create(&space)
+	defer forgetProxyAccess(space.ID)
+
+	recordProxyAccess(db, space.ID)
+	db.First(&space, space.ID)
+	if space.LastNetAccess.IsZero() {
+		t.Fatal("The first access was not recorded")
+	}
+	earlier := time.Now().Add(-time.Hour).Round(time.Second)
+	db.Model(&Space{ID: space.ID}).Update("last_net_access", earlier)
+	recordProxyAccess(db, space.ID)
+	db.First(&space, space.ID)
+	if !space.LastNetAccess.Equal(earlier) {
+		t.Errorf("An access within %s was written again", proxyAccessInterval)
+	}
+
+	proxyLastAccessLock.Lock()
+	proxyLastAccess[space.ID] = time.Now().Add(-proxyAccessInterval)
+	proxyLastAccessLock.Unlock()
+	recordProxyAccess(db, space.ID)
+	db.First(&space, space.ID)
+	if space.LastNetAccess.Equal(earlier) {
+		t.Errorf("An access after %s was not written", proxyAccessInterval)
+	}
+}
+
+func TestUDPProxy(t *testing.T) {
+	db := newTestDatabase(t)
+	space := Space{}
+	db.Create(&space)
+	proxy := startTestProxy(t, db, ProxyInstance{
+		ListenAddress:  "127.0.0.1",
+		ListenPort:     getFreePort(t),
+		Protocol:       "udp",
+		ConnectAddress: "127.0.0.1",
+		ConnectPort:    startUDPEcho(t),
+		SpaceID:        space.ID,
+		SpacePort:      1337,
+	})
+
+	//Two clients make sure replies go back to the client that sent the packet
+	for _, message := range []string{"first", "second"} {
+		conn, err := net.Dial("udp", buildListenAddress(proxy))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte(message))
+		buffer := make([]byte, 100)
+		n, err := conn.Read(buffer)
+		if err != nil || string(buffer[:n]) != message {
+			t.Errorf("Reply = %q, %v, want %q", buffer[:n], err, message)
+		}
+		conn.Close()
+	}
+}
+
+func TestEnsureSpaceProxiesMarksRemoteLinksUnproxied(t *testing.T) {
+	db := newTestDatabase(t)
+	db.AutoMigrate(&ProxyInstance{})
+	setTestDockerInstances(t, &DockerInstance{ID: 1, ConnectionType: "tls", Name: "remote"})
+	space := Space{HostID: 1}
+	db.Create(&space)
+	portLink := SpacePortLink{SpaceID: space.ID, SpacePort: 1337, ExternalPort: uint16(getFreePort(t)), ExternalAddress: "127.0.0.1", Proxied: true}
+	db.Create(&portLink)
+
+	ensureSpaceProxies(db, space)
+	db.First(&portLink, portLink.ID)
+	if portLink.Proxied {
+		t.Error("Port link on a remote host is marked as proxied")
+	}
+	var count int
+	db.Model(&ProxyInstance{}).Count(&count)
+	if count != 0 {
+		t.Errorf("%d proxies were created for a remote host", count)
+	}
+}
+
+func TestEnsureSpaceProxiesProxiesTCPAndUDP(t *testing.T) {
+	db := newTestDatabase(t)
+	db.AutoMigrate(&ProxyInstance{})
+	setTestDockerInstances(t, &DockerInstance{ID: 1, ConnectionType: "local", Name: "local"})
+	space := Space{HostID: 1}
+	db.Create(&space)
+	portLink := SpacePortLink{SpaceID: space.ID, SpacePort: 1337, ExternalPort: uint16(getFreePort(t)), ExternalAddress: "127.0.0.1"}
+	db.Create(&portLink)
+
+	ensureSpaceProxies(db, space)
+	defer removeSpaceProxies(db, space.ID)
+	db.First(&portLink, portLink.ID)
+	if !portLink.Proxied {
+		t.Error("Port link is not marked as proxied")
+	}
+	var protocols []string
+	db.Model(&ProxyInstance{}).Where("space_id = ?", space.ID).Order("protocol").Pluck("protocol", &protocols)
+	if len(protocols) != 2 || protocols[0] != "tcp" || protocols[1] != "udp" {
+		t.Errorf("Proxies = %v, want tcp and udp", protocols)
+	}
+}
+
+func TestMigrateProxyInstances(t *testing.T) {
+	db := newTestDatabase(t)
+	//The index as it was before proxies had a protocol
+	db.Exec(`CREATE TABLE proxy_instances ("id" integer primary key autoincrement, "listen_address" varchar(255), "listen_port" integer)`)
+	db.Exec(`CREATE UNIQUE INDEX idx_lstnaddress ON proxy_instances(listen_address, listen_port)`)
+	db.Exec(`INSERT INTO proxy_instances (listen_address, listen_port) VALUES ('127.0.0.1', 20000)`)
+
+	err := migrateProxyInstances(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.AutoMigrate(&ProxyInstance{})
+	var existing ProxyInstance
+	db.First(&existing)
+	if existing.Protocol != "tcp" {
+		t.Errorf("Protocol of an existing proxy = %q, want tcp", existing.Protocol)
+	}
+	err = db.Create(&ProxyInstance{ListenAddress: "127.0.0.1", ListenPort: 20000, Protocol: "udp"}).Error
+	if err != nil {
+		t.Errorf("UDP proxy on the same port could not be saved: %s", err.Error())
+	}
+}
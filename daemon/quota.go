@@ -0,0 +1,179 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package userspaced
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/jinzhu/gorm"
+	"github.com/spf13/viper"
+	auth "github.com/twa16/go-auth"
+)
+
+//quotaLocks One lock per user so that a quota check and the creation of the space it allowed happen together
+var quotaLocks = make(map[uint]*sync.Mutex)
+var quotaLocksLock sync.Mutex
+
+//lockQuotaForUser Takes the quota lock of a user and returns the function that releases it
+func lockQuotaForUser(userID uint) func() {
+	quotaLocksLock.Lock()
+	lock, exists := quotaLocks[userID]
+	if !exists {
+		lock = &sync.Mutex{}
+		quotaLocks[userID] = lock
+	}
+	quotaLocksLock.Unlock()
+	lock.Lock()
+	return lock.Unlock
+}
+
+//getDefaultQuota Builds the quota that applies when no quota records match a user
+func getDefaultQuota() SpaceQuota {
+	return SpaceQuota{
+		MaxSpaces:      viper.GetInt("DefaultQuotaMaxSpaces"),
+		MaxMemoryBytes: viper.GetInt64("DefaultQuotaMaxMemoryBytes"),
+		MaxCPUShares:   viper.GetInt64("DefaultQuotaMaxCPUShares"),
+		MaxDiskBytes:   viper.GetInt64("DefaultQuotaMaxDiskBytes"),
+	}
+}
+
+//getQuotaForUser Finds the quota for a user. A quota for the specific user wins, followed by the highest priority
+//permission group quota that the user holds. If neither exist the defaults from the config are used.
+func getQuotaForUser(db *gorm.DB, userID uint) (SpaceQuota, error) {
+	var quota SpaceQuota
+	//Older databases may hold more than one quota for a user. The first one saved wins.
+	query := db.Where("user_id = ?", userID).Order("id asc").First(&quota)
+	if query.Error == nil {
+		return quota, nil
+	}
+	if !query.RecordNotFound() {
+		return quota, query.Error
+	}
+
+	var groupQuotas []SpaceQuota
+	err := db.Where("user_id = 0 AND permission <> ''").Order("priority desc").Find(&groupQuotas).Error
+	if err != nil {
+		return quota, err
+	}
+	for _, groupQuota := range groupQuotas {
+		hasPerm, err := authProvider.CheckPermission(userID, groupQuota.Permission)
+		if err != nil {
+			return quota, err
+		}
+		if hasPerm {
+			return groupQuota, nil
+		}
+	}
+	return getDefaultQuota(), nil
+}
+
+//getQuotaUsageForUser Totals the resources allocated to the spaces of a user. Archived spaces do not count.
+func getQuotaUsageForUser(db *gorm.DB, userID uint) (QuotaUsage, error) {
+	var usage QuotaUsage
+	var spaces []Space
+	err := db.Where("owner_id = ? AND archived = ?", userID, false).Find(&spaces).Error
+	if err != nil {
+		return usage, err
+	}
+	for _, space := range spaces {
+		usage.Spaces++
+		usage.MemoryBytes += space.MemoryBytes
+		usage.CPUShares += space.CPUShares
+		usage.DiskBytes += space.DiskBytes
+	}
+	return usage, nil
+}
+
+//applyDefaultSpaceResources Fills in the resources of a space that the user did not request
+func applyDefaultSpaceResources(space *Space) {
+	if space.MemoryBytes == 0 {
+		space.MemoryBytes = viper.GetInt64("DefaultSpaceMemoryBytes")
+	}
+	if space.CPUShares == 0 {
+		space.CPUShares = viper.GetInt64("DefaultSpaceCPUShares")
+	}
+	if space.DiskBytes == 0 {
+		space.DiskBytes = viper.GetInt64("DefaultSpaceDiskBytes")
+	}
+}
+
+//checkSpaceResources Returns an error if a resource of a space is negative or more than a single space may have.
+//Negative values would lower the usage of the owner and get around their quota.
+func checkSpaceResources(space Space) error {
+	resources := []struct {
+		name  string
+		value int64
+		max   int64
+	}{
+		{"memory_bytes", space.MemoryBytes, viper.GetInt64("MaxSpaceMemoryBytes")},
+		{"cpu_shares", space.CPUShares, viper.GetInt64("MaxSpaceCPUShares")},
+		{"disk_bytes", space.DiskBytes, viper.GetInt64("MaxSpaceDiskBytes")},
+	}
+	for _, resource := range resources {
+		if resource.value < 0 {
+			return fmt.Errorf("%s must not be negative", resource.name)
+		}
+		if resource.max > 0 && resource.value > resource.max {
+			return fmt.Errorf("%s must be at most %d", resource.name, resource.max)
+		}
+	}
+	return nil
+}
+
+//checkQuotaRestrictions Returns true if creating the space would keep the user within their quota.
+//If the user is over quota, the returned string describes which limit was hit. Callers should hold the lock from
+//lockQuotaForUser until the space is saved so that parallel requests cannot both pass.
+func checkQuotaRestrictions(db *gorm.DB, user *auth.User, space Space) (bool, string, error) {
+	quota, err := getQuotaForUser(db, user.ID)
+	if err != nil {
+		return false, "", err
+	}
+	usage, err := getQuotaUsageForUser(db, user.ID)
+	if err != nil {
+		return false, "", err
+	}
+	if quota.MaxSpaces > 0 && usage.Spaces+1 > quota.MaxSpaces {
+		return false, fmt.Sprintf("Space limit of %d reached", quota.MaxSpaces), nil
+	}
+	if quota.MaxMemoryBytes > 0 && usage.MemoryBytes+space.MemoryBytes > quota.MaxMemoryBytes {
+		return false, fmt.Sprintf("Memory limit of %d bytes reached", quota.MaxMemoryBytes), nil
+	}
+	if quota.MaxCPUShares > 0 && usage.CPUShares+space.CPUShares > quota.MaxCPUShares {
+		return false, fmt.Sprintf("CPU share limit of %d reached", quota.MaxCPUShares), nil
+	}
+	if quota.MaxDiskBytes > 0 && usage.DiskBytes+space.DiskBytes > quota.MaxDiskBytes {
+		return false, fmt.Sprintf("Disk limit of %d bytes reached", quota.MaxDiskBytes), nil
+	}
+	return true, "", nil
+}
+
+//findQuotaToUpdate Returns the ID of the quota that a new quota replaces. There is at most one quota per user and
+//one per permission group, so saving another one updates it instead of adding a duplicate.
+func findQuotaToUpdate(db *gorm.DB, quota SpaceQuota) (uint, error) {
+	var existing SpaceQuota
+	var query *gorm.DB
+	if quota.UserID != 0 {
+		query = db.Where("user_id = ?", quota.UserID).Order("id asc").First(&existing)
+	} else {
+		query = db.Where("user_id = 0 AND permission = ?", quota.Permission).Order("id asc").First(&existing)
+	}
+	if query.RecordNotFound() {
+		return 0, nil
+	}
+	return existing.ID, query.Error
+}
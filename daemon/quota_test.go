@@ -0,0 +1,149 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package userspaced
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	auth "github.com/twa16/go-auth"
+)
+
+func TestCheckQuotaRestrictions(t *testing.T) {
+	db := newTestDatabase(t)
+	db.Create(&SpaceQuota{UserID: 1, MaxSpaces: 3, MaxMemoryBytes: 1000, MaxCPUShares: 0, MaxDiskBytes: 5000})
+	db.Create(&Space{OwnerID: 1, MemoryBytes: 400, CPUShares: 512, DiskBytes: 2000})
+	db.Create(&Space{OwnerID: 1, MemoryBytes: 400, CPUShares: 512, DiskBytes: 2000, Archived: true})
+	db.Create(&Space{OwnerID: 2, MemoryBytes: 900})
+	user := &auth.User{}
+	user.ID = 1
+
+	tests := []struct {
+		name  string
+		space Space
+		allow bool
+	}{
+		{"fits", Space{MemoryBytes: 600, DiskBytes: 3000}, true},
+		{"memory over", Space{MemoryBytes: 601}, false},
+		{"disk over", Space{DiskBytes: 3001}, false},
+		{"cpu unlimited", Space{CPUShares: 1 << 20}, true},
+	}
+	for _, test := range tests {
+		allowed, reason, err := checkQuotaRestrictions(db, user, test.space)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err.Error())
+		}
+		if allowed != test.allow {
+			t.Errorf("%s: allowed = %t, want %t (%s)", test.name, allowed, test.allow, reason)
+		}
+	}
+
+	db.Create(&Space{OwnerID: 1})
+	db.Create(&Space{OwnerID: 1})
+	allowed, reason, _ := checkQuotaRestrictions(db, user, Space{})
+	if allowed || reason != "Space limit of 3 reached" {
+		t.Errorf("Fourth space: allowed = %t, reason = %q", allowed, reason)
+	}
+}
+
+func TestGetQuotaForUserFallsBackToDefault(t *testing.T) {
+	db := newTestDatabase(t)
+	viper.Set("DefaultQuotaMaxSpaces", 2)
+	defer viper.Set("DefaultQuotaMaxSpaces", nil)
+	quota, err := getQuotaForUser(db, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quota.MaxSpaces != 2 {
+		t.Errorf("MaxSpaces = %d, want the default of 2", quota.MaxSpaces)
+	}
+}
+
+func TestCheckSpaceResources(t *testing.T) {
+	viper.Set("MaxSpaceMemoryBytes", 1024)
+	defer viper.Set("MaxSpaceMemoryBytes", nil)
+	tests := []struct {
+		name  string
+		space Space
+		valid bool
+	}{
+		{"defaults", Space{}, true},
+		{"at max", Space{MemoryBytes: 1024, CPUShares: 4096, DiskBytes: 1 << 40}, true},
+		{"over max", Space{MemoryBytes: 1025}, false},
+		{"negative memory", Space{MemoryBytes: -1}, false},
+		{"negative cpu", Space{CPUShares: -1}, false},
+		{"negative disk", Space{DiskBytes: -1}, false},
+	}
+	for _, test := range tests {
+		err := checkSpaceResources(test.space)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: error = %v, want valid = %t", test.name, err, test.valid)
+		}
+	}
+}
+
+func TestFindQuotaToUpdate(t *testing.T) {
+	db := newTestDatabase(t)
+	userQuota := SpaceQuota{UserID: 3, MaxSpaces: 1}
+	db.Create(&userQuota)
+	groupQuota := SpaceQuota{Permission: "faculty.*", MaxSpaces: 5}
+	db.Create(&groupQuota)
+
+	tests := []struct {
+		name  string
+		quota SpaceQuota
+		want  uint
+	}{
+		{"same user", SpaceQuota{UserID: 3}, userQuota.ID},
+		{"same permission", SpaceQuota{Permission: "faculty.*"}, groupQuota.ID},
+		{"new user", SpaceQuota{UserID: 4}, 0},
+		{"new permission", SpaceQuota{Permission: "staff.*"}, 0},
+	}
+	for _, test := range tests {
+		id, err := findQuotaToUpdate(db, test.quota)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err.Error())
+		}
+		if id != test.want {
+			t.Errorf("%s: got quota %d, want %d", test.name, id, test.want)
+		}
+	}
+}
+
+func TestLockQuotaForUser(t *testing.T) {
+	unlock := lockQuotaForUser(1)
+	//Other users are not held up
+	lockQuotaForUser(2)()
+
+	var wait sync.WaitGroup
+	locked := make(chan bool)
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		lockQuotaForUser(1)()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("Second lock of the same user did not wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	wait.Wait()
+}
@@ -0,0 +1,319 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package userspaced
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+)
+
+//sshGatewaySpaceUser The user the gateway logs into spaces as
+const sshGatewaySpaceUser = "root"
+
+//sshGatewayClientSigner Key the gateway uses to log into spaces. Nil if the gateway is disabled.
+var sshGatewayClientSigner ssh.Signer
+
+//initSSHGateway Loads the keys of the gateway. This has to happen before spaces are created so they trust the gateway.
+func initSSHGateway() error {
+	if !viper.GetBool("SSHGatewayEnabled") {
+		return nil
+	}
+	signer, err := loadOrCreateSSHKey(viper.GetString("SSHGatewayClientKey"))
+	if err != nil {
+		return err
+	}
+	sshGatewayClientSigner = signer
+	return nil
+}
+
+//syncSSHGatewayKey Installs the key of the gateway in every running space. The key is otherwise only written when a
+//space is created, resumed or has its keys changed, so spaces from before the gateway was enabled would turn it away.
+func syncSSHGatewayKey(db *gorm.DB) {
+	var spaces []Space
+	db.Where("space_state = ? AND archived = ?", "running", false).Find(&spaces)
+	for _, space := range spaces {
+		err, _ := AddPublicKeysToSpace(db, space)
+		if err != nil {
+			log.Warningf("Error installing the SSH gateway key in Space %s(%d): %s\n", space.FriendlyName, space.ID, err.Error())
+		}
+	}
+}
+
+//getSSHGatewayAuthorizedKey Returns the authorized_keys line that lets the gateway into a space.
+//The second value is false if the gateway is disabled.
+func getSSHGatewayAuthorizedKey() (string, bool) {
+	if sshGatewayClientSigner == nil {
+		return "", false
+	}
+	authorizedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshGatewayClientSigner.PublicKey())))
+	return authorizedKey + " userspace-ssh-gateway", true
+}
+
+//loadOrCreateSSHKey Reads a private key from a file. A new key is generated and saved if the file does not exist.
+func loadOrCreateSSHKey(keyFile string) (ssh.Signer, error) {
+	if _, err := os.Stat(keyFile); os.IsNotExist(err) {
+		log.Warningf("Generating SSH key %s\n", keyFile)
+		privateKey, err := rsa.GenerateKey(rand.Reader, 4096)
+		if err != nil {
+			return nil, err
+		}
+		err = WritePrivateKeyToFile(privateKey, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		//Only the daemon should be able to read the key
+		err = os.Chmod(keyFile, 0600)
+		if err != nil {
+			return nil, err
+		}
+	}
+	keyBytes, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(keyBytes)
+}
+
+//startSSHGateway Accepts SSH connections on a single port and forwards them to the space named in the login.
+//Users log in as user+spacename.
+func startSSHGateway(db *gorm.DB) {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return authenticateGatewayUser(db, conn.User(), key)
+		},
+	}
+	hostKey, err := loadOrCreateSSHKey(viper.GetString("SSHGatewayHostKey"))
+	if err != nil {
+		log.Criticalf("Error loading SSH gateway host key: %s\n", err.Error())
+		return
+	}
+	config.AddHostKey(hostKey)
+
+	listenAddress := viper.GetString("SSHGatewayListenAddress")
+	listener, err := net.Listen("tcp", listenAddress)
+	if err != nil {
+		log.Criticalf("Error starting SSH gateway on %s: %s\n", listenAddress, err.Error())
+		return
+	}
+	log.Infof("SSH Gateway listening on %s\n", listenAddress)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			log.Criticalf("SSH gateway stopped: %s\n", err.Error())
+			return
+		}
+		go handleGatewayConn(db, config, conn)
+	}
+}
+
+//authenticateGatewayUser Checks that the user in a user+spacename login owns the space and that the key is one that may
+//log into the space
+func authenticateGatewayUser(db *gorm.DB, login string, key ssh.PublicKey) (*ssh.Permissions, error) {
+	accessDenied := errors.New("access denied")
+	separator := strings.LastIndex(login, "+")
+	if separator <= 0 || separator == len(login)-1 {
+		return nil, accessDenied
+	}
+	username := login[:separator]
+	spaceName := login[separator+1:]
+
+	user, err := authProvider.GetUser(username)
+	if err != nil {
+		return nil, accessDenied
+	}
+
+	var space Space
+	err = db.Where("owner_id = ? AND friendly_name = ? AND archived = ?", user.ID, spaceName, false).Order("id asc").First(&space).Error
+	if err != nil {
+		return nil, accessDenied
+	}
+
+	//The gateway lets in the same keys as the space itself
+	keys, err := getKeysForSpace(db, space)
+	if err != nil {
+		log.Warningf("SSH gateway could not load the keys of Space %d: %s\n", space.ID, err.Error())
+		return nil, accessDenied
+	}
+	keyMatched := false
+	for _, spaceKey := range keys {
+		parsedKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(spaceKey.PublicKey))
+		if err == nil && bytes.Equal(parsedKey.Marshal(), key.Marshal()) {
+			keyMatched = true
+			break
+		}
+	}
+	if !keyMatched {
+		return nil, accessDenied
+	}
+	log.Infof("SSH gateway authenticated %s for Space %s(%d)\n", username, space.FriendlyName, space.ID)
+	return &ssh.Permissions{Extensions: map[string]string{"space_id": strconv.Itoa(int(space.ID))}}, nil
+}
+
+//handleGatewayConn Logs into the space of an authenticated user and relays every channel and request between the two connections
+func handleGatewayConn(db *gorm.DB, config *ssh.ServerConfig, conn net.Conn) {
+	defer conn.Close()
+	//Clients that never finish the handshake would otherwise hold on to the connection forever
+	conn.SetDeadline(time.Now().Add(getClampedInterval("SSHGatewayHandshakeTimeoutSeconds", time.Second)))
+	clientConn, clientChannels, clientRequests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		log.Debugf("SSH gateway handshake with %s failed: %s\n", conn.RemoteAddr(), err.Error())
+		return
+	}
+	defer clientConn.Close()
+	//Sessions can be idle for as long as the user likes once they are logged in
+	conn.SetDeadline(time.Time{})
+
+	var space Space
+	err = db.First(&space, clientConn.Permissions.Extensions["space_id"]).Error
+	if err != nil {
+		log.Warningf("SSH gateway could not load space %s: %s\n", clientConn.Permissions.Extensions["space_id"], err.Error())
+		return
+	}
+	address, err := getGatewayTarget(db, space)
+	if err != nil {
+		log.Warningf("SSH gateway could not reach Space %d: %s\n", space.ID, err.Error())
+		return
+	}
+	db.Model(&Space{ID: space.ID}).Update("last_ssh_access", time.Now())
+
+	timeout := time.Duration(viper.GetInt("ProxyConnectTimeoutSeconds")) * time.Second
+	spaceConn, err := net.DialTimeout("tcp", net.JoinHostPort(address, "22"), timeout)
+	if err != nil {
+		log.Warningf("SSH gateway could not connect to Space %d: %s\n", space.ID, err.Error())
+		return
+	}
+	defer spaceConn.Close()
+	spaceClientConn, spaceChannels, spaceRequests, err := ssh.NewClientConn(spaceConn, spaceConn.RemoteAddr().String(), &ssh.ClientConfig{
+		User: sshGatewaySpaceUser,
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(sshGatewayClientSigner)},
+		//Spaces generate their own host keys and the connection never leaves the docker network
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         timeout,
+	})
+	if err != nil {
+		log.Warningf("SSH gateway could not log into Space %d: %s\n", space.ID, err.Error())
+		return
+	}
+	defer spaceClientConn.Close()
+
+	go relayGlobalRequests(spaceRequests, clientConn)
+	go relayGlobalRequests(clientRequests, spaceClientConn)
+	//The space opens channels for remote port forwards
+	go func() {
+		for newChannel := range spaceChannels {
+			go relayNewChannel(newChannel, clientConn)
+		}
+	}()
+	for newChannel := range clientChannels {
+		go relayNewChannel(newChannel, spaceClientConn)
+	}
+}
+
+//getGatewayTarget Returns the address of a space on its docker network. Logging in counts as activity so a space
+//that was paused for being idle is woken up. Spaces paused on purpose stay paused, the same as in the HTTP proxy.
+func getGatewayTarget(db *gorm.DB, space Space) (string, error) {
+	//Look the address up first so that a space that cannot be reached is not resumed for nothing
+	address, err := getSpaceIPAddress(space)
+	if err != nil {
+		return "", err
+	}
+	if space.SpaceState == "paused" {
+		err = resumeIdleSpace(db, space)
+		if err != nil {
+			return "", err
+		}
+	}
+	return address, nil
+}
+
+//relayGlobalRequests Sends global requests such as port forwards to the other side and passes back the reply
+func relayGlobalRequests(requests <-chan *ssh.Request, dest ssh.Conn) {
+	for request := range requests {
+		ok, payload, err := dest.SendRequest(request.Type, request.WantReply, request.Payload)
+		if request.WantReply {
+			request.Reply(ok && err == nil, payload)
+		}
+	}
+}
+
+//relayNewChannel Opens the same channel on the other side and relays between the two
+func relayNewChannel(newChannel ssh.NewChannel, dest ssh.Conn) {
+	destChannel, destRequests, err := dest.OpenChannel(newChannel.ChannelType(), newChannel.ExtraData())
+	if err != nil {
+		if openErr, ok := err.(*ssh.OpenChannelError); ok {
+			newChannel.Reject(openErr.Reason, openErr.Message)
+		} else {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		}
+		return
+	}
+	srcChannel, srcRequests, err := newChannel.Accept()
+	if err != nil {
+		destChannel.Close()
+		return
+	}
+	go relayChannel(srcChannel, srcRequests, destChannel)
+	go relayChannel(destChannel, destRequests, srcChannel)
+}
+
+//relayChannel Copies the data and requests from one channel to another. The other channel is closed once this one is.
+func relayChannel(src ssh.Channel, srcRequests <-chan *ssh.Request, dest ssh.Channel) {
+	var copies sync.WaitGroup
+	copies.Add(2)
+	go func() {
+		io.Copy(dest, src)
+		copies.Done()
+	}()
+	go func() {
+		io.Copy(dest.Stderr(), src.Stderr())
+		copies.Done()
+	}()
+	//Nothing can be written to the channel after EOF so wait for both streams
+	copied := make(chan struct{})
+	go func() {
+		copies.Wait()
+		dest.CloseWrite()
+		close(copied)
+	}()
+	//Requests such as pty-req, window-change and exit-status
+	for request := range srcRequests {
+		ok, err := dest.SendRequest(request.Type, request.WantReply, request.Payload)
+		if request.WantReply {
+			request.Reply(ok && err == nil, nil)
+		}
+	}
+	<-copied
+	dest.Close()
+}
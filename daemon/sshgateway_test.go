@@ -0,0 +1,99 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package userspaced
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestGetGatewayTargetOnlyResumesIdleSpaces(t *testing.T) {
+	db := newTestDatabase(t)
+	host := startTestDockerHost(t, "172.17.0.2")
+	tests := []struct {
+		name              string
+		state             string
+		pausedByLifecycle bool
+		valid             bool
+		finalState        string
+	}{
+		{"running", "running", false, true, "running"},
+		{"paused for being idle", "paused", true, true, "running"},
+		//The owner or an admin paused the space on purpose
+		{"paused on purpose", "paused", false, false, "paused"},
+	}
+	for _, test := range tests {
+		space := Space{HostID: host.ID, ContainerID: "container", SpaceState: test.state, PausedByLifecycle: test.pausedByLifecycle}
+		db.Create(&space)
+		address, err := getGatewayTarget(db, space)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: expected success to be %t, got %v", test.name, test.valid, err)
+		}
+		if test.valid && address != "172.17.0.2" {
+			t.Errorf("%s: address = %q", test.name, address)
+		}
+		db.First(&space, space.ID)
+		if space.SpaceState != test.finalState {
+			t.Errorf("%s: space is %s, want %s", test.name, space.SpaceState, test.finalState)
+		}
+	}
+}
+
+func TestHandleGatewayConnTimesOutHandshakes(t *testing.T) {
+	db := newTestDatabase(t)
+	viper.Set("SSHGatewayHandshakeTimeoutSeconds", 1)
+	defer viper.Set("SSHGatewayHandshakeTimeoutSeconds", nil)
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(hostKey)
+
+	//The client connects and then never says anything
+	server, client := net.Pipe()
+	defer client.Close()
+	go func() {
+		//Drain the version line of the server so its writes do not block
+		buffer := make([]byte, 1024)
+		for {
+			if _, err := client.Read(buffer); err != nil {
+				return
+			}
+		}
+	}()
+	finished := make(chan struct{})
+	go func() {
+		handleGatewayConn(db, config, server)
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("A handshake that never finished kept the connection open")
+	}
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package userspaced
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+//sshPortHex Port 22 as it appears in /proc/net/tcp
+const sshPortHex = "0016"
+
+//tcpStateEstablished ESTABLISHED as it appears in /proc/net/tcp
+const tcpStateEstablished = "01"
+
+//sshSessionsSeen The sockets of the SSH sessions that were open in each space at the last check.
+//Sockets are identified by their inode so a reconnect from the same address counts as a new session.
+var sshSessionsSeen = make(map[uint]map[string]bool)
+var sshSessionsSeenLock sync.Mutex
+
+//startSSHSessionTracker Periodically checks the running spaces for SSH sessions
+func startSSHSessionTracker(db *gorm.DB) {
+	interval := getClampedInterval("SSHTrackingIntervalSeconds", minLoopInterval)
+	log.Infof("SSH Session Tracker Started. Checking every %s\n", interval)
+	for true {
+		var spaces []Space
+		db.Where("space_state = ?", "running").Find(&spaces)
+		for _, space := range spaces {
+			err := trackSSHSessions(db, space)
+			if err != nil {
+				log.Debugf("Failed to check SSH sessions of Space %s(%d): %s\n", space.FriendlyName, space.ID, err.Error())
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+//trackSSHSessions Counts the SSH sessions in a space and records when it was last accessed
+func trackSSHSessions(db *gorm.DB, space Space) error {
+	//cat fails if the space has no IPv6 but still prints the IPv4 table so the exit code is ignored
+	result, err := runInSpace(space, ExecRequest{Command: []string{"cat", "/proc/net/tcp", "/proc/net/tcp6"}})
+	if err != nil {
+		return err
+	}
+	sessions := parseSSHSessions(result.Stdout)
+
+	sshSessionsSeenLock.Lock()
+	previous, known := sshSessionsSeen[space.ID]
+	sshSessionsSeen[space.ID] = sessions
+	sshSessionsSeenLock.Unlock()
+
+	newSessions := countNewSSHSessions(previous, known, space.SSHSessions, sessions)
+
+	updates := map[string]interface{}{"ssh_sessions": len(sessions)}
+	if newSessions > 0 {
+		updates["ssh_sessions_in"] = space.SSHSessionsIn + int64(newSessions)
+		log.Infof("Space %s(%d) received %d new SSH session(s)\n", space.FriendlyName, space.ID, newSessions)
+	}
+	//An open session is activity even if nothing new connected
+	if len(sessions) > 0 {
+		updates["last_ssh_access"] = time.Now()
+	}
+	return db.Model(&Space{ID: space.ID}).Updates(updates).Error
+}
+
+//countNewSSHSessions Returns how many of the sessions were not open at the previous check.
+//Without a previous check the sessions are only new if none were open at the last recorded check.
+//This keeps a restart of the daemon from counting the open sessions twice.
+func countNewSSHSessions(previous map[string]bool, known bool, recordedSessions int, sessions map[string]bool) int {
+	if !known && recordedSessions > 0 {
+		return 0
+	}
+	newSessions := 0
+	for inode := range sessions {
+		if !previous[inode] {
+			newSessions++
+		}
+	}
+	return newSessions
+}
+
+//parseSSHSessions Returns the inodes of the established connections to port 22 in the output of /proc/net/tcp
+func parseSSHSessions(procNetTCP string) map[string]bool {
+	sessions := make(map[string]bool)
+	for _, line := range strings.Split(procNetTCP, "\n") {
+		//sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+		fields := strings.Fields(line)
+		if len(fields) < 10 || fields[0] == "sl" {
+			continue
+		}
+		localAddress := strings.Split(fields[1], ":")
+		if len(localAddress) != 2 || localAddress[1] != sshPortHex || fields[3] != tcpStateEstablished {
+			continue
+		}
+		sessions[fields[9]] = true
+	}
+	return sessions
+}
+
+//forgetSSHSessions Drops what is known about the sessions of a space once it stops running
+func forgetSSHSessions(spaceID uint) {
+	sshSessionsSeenLock.Lock()
+	defer sshSessionsSeenLock.Unlock()
+	delete(sshSessionsSeen, spaceID)
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package userspaced
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+//testProcNetTCP Output of cat /proc/net/tcp /proc/net/tcp6 in a space with sshd running
+const testProcNetTCP = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:0016 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 18211 1 0000000000000000 100 0 0 10 0
+   1: 020011AC:0016 010011AC:D4F2 01 00000000:00000000 02:0009B5C8 00000000     0        0 19884 4 0000000000000000 20 4 31 10 -1
+   2: 020011AC:0016 010011AC:D4F6 06 00000000:00000000 03:00001770 00000000     0        0 0 3 0000000000000000
+   3: 020011AC:9C4E 5DB8D822:0016 01 00000000:00000000 00:00000000 00000000     0        0 20411 1 0000000000000000 20 4 30 10 -1
+   4: 020011AC:0539 010011AC:D4FA 01 00000000:00000000 00:00000000 00000000     0        0 20455 1 0000000000000000 20 4 30 10 -1
+  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000000000000000000000000000:0016 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 18213 1 0000000000000000 100 0 0 10 0
+   1: 0000000000000000FFFF0000020011AC:0016 0000000000000000FFFF0000010011AC:D502 01 00000000:00000000 02:0009B5C8 00000000     0        0 20002 2 0000000000000000 20 4 29 10 -1
+   2: 0000000000000000FFFF0000020011AC:0016 0000000000000000FFFF0000010011AC:D506 08 00000000:00000000 00:00000000 00000000     0        0 20017 1 0000000000000000 20 4 29 10 -1
+`
+
+func TestParseSSHSessions(t *testing.T) {
+	lines := strings.Split(testProcNetTCP, "\n")
+	tests := []struct {
+		name     string
+		output   string
+		sessions []string
+	}{
+		//Listening sockets, closing sessions and connections the space makes to other SSH servers are left out
+		{"ipv4 and ipv6", testProcNetTCP, []string{"19884", "20002"}},
+		{"ipv4 only", strings.Join(lines[:6], "\n"), []string{"19884"}},
+		{"ipv6 only", strings.Join(lines[6:], "\n"), []string{"20002"}},
+		{"listening only", strings.Join(lines[:2], "\n"), nil},
+		{"empty", "", nil},
+		{"truncated row", "   1: 020011AC:0016 010011AC:D4F2 01", nil},
+	}
+	for _, test := range tests {
+		var sessions []string
+		for inode := range parseSSHSessions(test.output) {
+			sessions = append(sessions, inode)
+		}
+		sort.Strings(sessions)
+		if strings.Join(sessions, ",") != strings.Join(test.sessions, ",") {
+			t.Errorf("%s: expected sessions %v, got %v", test.name, test.sessions, sessions)
+		}
+	}
+}
+
+func TestCountNewSSHSessions(t *testing.T) {
+	sessions := func(inodes ...string) map[string]bool {
+		result := make(map[string]bool)
+		for _, inode := range inodes {
+			result[inode] = true
+		}
+		return result
+	}
+	tests := []struct {
+		name     string
+		previous map[string]bool
+		known    bool
+		recorded int
+		sessions map[string]bool
+		want     int
+	}{
+		{"first session", sessions(), true, 0, sessions("19884"), 1},
+		{"still open", sessions("19884"), true, 1, sessions("19884"), 0},
+		//A reconnect from the same address gets a new socket
+		{"reconnect", sessions("19884"), true, 1, sessions("20002"), 1},
+		{"closed", sessions("19884"), true, 1, sessions(), 0},
+		//After a restart of the daemon the sessions that were recorded as open are not counted again
+		{"restart with open sessions", nil, false, 1, sessions("19884"), 0},
+		{"restart without open sessions", nil, false, 0, sessions("19884", "20002"), 2},
+	}
+	for _, test := range tests {
+		if count := countNewSSHSessions(test.previous, test.known, test.recorded, test.sessions); count != test.want {
+			t.Errorf("%s: expected %d new sessions, got %d", test.name, test.want, count)
+		}
+	}
+}
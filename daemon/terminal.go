@@ -0,0 +1,229 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package userspaced
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/gorilla/websocket"
+	"github.com/spf13/viper"
+	auth "github.com/twa16/go-auth"
+)
+
+//terminalCommand Starts bash if the image has it and falls back to sh
+var terminalCommand = []string{"/bin/sh", "-c", "if command -v bash >/dev/null 2>&1; then exec bash -l; else exec sh -l; fi"}
+
+//terminalAccessInterval LastNetAccess is written at most this often while a user types so that an open terminal keeps
+//the space from being paused without writing to the database on every keystroke
+const terminalAccessInterval = time.Minute
+
+//TerminalControlMessage Sent by the client as a text message to control the terminal. Binary messages are keystrokes.
+type TerminalControlMessage struct {
+	Type string `json:"type"` //Only resize is supported
+	Cols uint   `json:"cols"` //Width of the terminal in characters
+	Rows uint   `json:"rows"` //Height of the terminal in characters
+}
+
+var terminalUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	CheckOrigin:     checkTerminalOrigin,
+}
+
+//checkTerminalOrigin Only lets pages on ApiHost open terminals. Clients that are not browsers send no Origin.
+func checkTerminalOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	originURL, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(originURL.Hostname(), viper.GetString("ApiHost"))
+}
+
+//terminalWriter Sends the output of the terminal to the websocket as binary messages
+type terminalWriter struct {
+	conn *websocket.Conn
+	lock sync.Mutex
+}
+
+//Write Sends a chunk of output
+func (w *terminalWriter) Write(data []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	err := w.conn.WriteMessage(websocket.BinaryMessage, data)
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+//getTerminalAPIHandler Handles GET /api/v1/space/:spaceid/terminal - Upgrades to a websocket attached to a shell in the space.
+//The WebSocket API of browsers cannot set headers, so browsers have to pass the session token as the token parameter.
+//URLs end up in access logs, so the parameter is only read if X-Auth-Token is missing and clients that can set the
+//header should.
+func getTerminalAPIHandler(w http.ResponseWriter, r *http.Request) {
+	//Pages on other sites could otherwise open a shell with a token they got hold of
+	if !checkTerminalOrigin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "Origin not allowed\n")
+		return
+	}
+	if r.Header.Get("X-Auth-Token") == "" && r.URL.Query().Get("token") != "" {
+		r.Header.Set("X-Auth-Token", r.URL.Query().Get("token"))
+	}
+	//Get user and error out if it didn't work
+	user, err := getUserFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	serveTerminal(w, r, user)
+}
+
+//serveTerminal Opens a terminal for an authenticated user. A shell can do anything an exec can so the same
+//permissions are needed.
+func serveTerminal(w http.ResponseWriter, r *http.Request, user *auth.User) {
+	space, status, err := getExecSpaceFromRequest(r, user)
+	if err != nil {
+		w.WriteHeader(status)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	//Opening a terminal wakes up a space that went idle. Spaces that were paused on purpose have to be resumed first.
+	if space.SpaceState == "paused" {
+		err = resumeIdleSpace(database, *space)
+		if err != nil {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+	}
+	dockerHost := getHostByID(space.HostID)
+	dockerClient, connected := getHostClient(dockerHost)
+	if !connected {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, "Host of space is not connected\n")
+		return
+	}
+
+	exec, err := dockerClient.CreateExec(docker.CreateExecOptions{
+		Container:    space.ContainerID,
+		Cmd:          terminalCommand,
+		Env:          []string{"TERM=xterm-256color"},
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		Tty:          true,
+	})
+	if err != nil {
+		log.Warningf("Error creating terminal for Space %d: %s\n", space.ID, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Error creating terminal\n")
+		return
+	}
+
+	conn, err := terminalUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		//The upgrader has already replied
+		log.Debugf("Terminal upgrade failed for Space %d: %s\n", space.ID, err.Error())
+		return
+	}
+	defer conn.Close()
+	log.Infof("User %s opened a terminal in Space %s(%d)\n", user.Username, space.FriendlyName, space.ID)
+	lastAccess := time.Now()
+	database.Model(&Space{ID: space.ID}).Update("last_net_access", lastAccess)
+
+	stdinReader, stdinWriter := io.Pipe()
+	output := &terminalWriter{conn: conn}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	attached := make(chan struct{})
+	finished := make(chan error, 1)
+	go func() {
+		finished <- dockerClient.StartExec(exec.ID, docker.StartExecOptions{
+			InputStream:  stdinReader,
+			OutputStream: output,
+			ErrorStream:  output,
+			Tty:          true,
+			RawTerminal:  true,
+			Success:      attached,
+			Context:      ctx,
+		})
+	}()
+	//StartExec waits for the success channel to be read back once it is attached
+	select {
+	case <-attached:
+		attached <- struct{}{}
+	case err = <-finished:
+		log.Warningf("Error starting terminal for Space %d: %s\n", space.ID, err)
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "Error starting terminal"))
+		return
+	}
+
+	//Keystrokes and resizes from the browser
+	go func() {
+		defer stdinWriter.Close()
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				cancel()
+				return
+			}
+			if messageType == websocket.BinaryMessage {
+				if _, err := stdinWriter.Write(data); err != nil {
+					return
+				}
+				if time.Since(lastAccess) >= terminalAccessInterval {
+					lastAccess = time.Now()
+					database.Model(&Space{ID: space.ID}).Update("last_net_access", lastAccess)
+				}
+				continue
+			}
+			var control TerminalControlMessage
+			if json.Unmarshal(data, &control) != nil || control.Type != "resize" || control.Cols == 0 || control.Rows == 0 {
+				continue
+			}
+			err = dockerClient.ResizeExecTTY(exec.ID, int(control.Rows), int(control.Cols))
+			if err != nil {
+				log.Debugf("Error resizing terminal for Space %d: %s\n", space.ID, err.Error())
+			}
+		}
+	}()
+
+	err = <-finished
+	if err != nil && ctx.Err() == nil {
+		log.Debugf("Terminal for Space %d ended with error: %s\n", space.ID, err.Error())
+	}
+	database.Model(&Space{ID: space.ID}).Update("last_net_access", time.Now())
+	output.lock.Lock()
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "Terminal closed"))
+	output.lock.Unlock()
+	log.Infof("User %s closed the terminal in Space %s(%d)\n", user.Username, space.FriendlyName, space.ID)
+}
@@ -0,0 +1,185 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package userspaced
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"github.com/spf13/viper"
+	auth "github.com/twa16/go-auth"
+	"goji.io"
+	"goji.io/pat"
+)
+
+//createTestUser Creates a user that holds the permissions given
+func createTestUser(t *testing.T, username string, permissions ...string) *auth.User {
+	var held []auth.Permission
+	for _, permission := range permissions {
+		held = append(held, auth.Permission{Permission: permission})
+	}
+	user, err := authProvider.CreateUser(auth.User{Username: username, Permissions: held})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &user
+}
+
+//serveAsUser Sends a request for a space to a handler as if the user had logged in and returns the status
+func serveAsUser(user *auth.User, spaceID uint, handler func(http.ResponseWriter, *http.Request, *auth.User)) int {
+	mux := goji.NewMux()
+	mux.HandleFunc(pat.Get("/api/v1/space/:spaceid"), func(w http.ResponseWriter, r *http.Request) {
+		handler(w, r, user)
+	})
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", fmt.Sprintf("/api/v1/space/%d", spaceID), nil))
+	return recorder.Code
+}
+
+//setUpExecPermissionTest Creates an owner with a space and users with every combination of the exec permissions
+func setUpExecPermissionTest(t *testing.T) (*gorm.DB, map[string]*auth.User) {
+	db := newTestDatabase(t)
+	useTestAuthProvider(t, db)
+	users := map[string]*auth.User{
+		"owner":           createTestUser(t, "owner", USER_SPACE_EXEC),
+		"owner without":   createTestUser(t, "owner-without"),
+		"exec admin":      createTestUser(t, "exec-admin", USER_SPACE_EXEC, ADMIN_EXEC_SPACE),
+		"update admin":    createTestUser(t, "update-admin", USER_SPACE_EXEC, ADMIN_UPDATE_SPACE),
+		"admin only":      createTestUser(t, "admin-only", ADMIN_EXEC_SPACE),
+		"user with exec":  createTestUser(t, "other", USER_SPACE_EXEC),
+		"user without it": createTestUser(t, "nobody"),
+	}
+	return db, users
+}
+
+func TestGetExecSpaceFromRequest(t *testing.T) {
+	db, users := setUpExecPermissionTest(t)
+	space := Space{OwnerID: users["owner"].ID}
+	db.Create(&space)
+	unexecutable := Space{OwnerID: users["owner without"].ID}
+	db.Create(&unexecutable)
+
+	tests := []struct {
+		user   string
+		space  Space
+		status int
+	}{
+		{"owner", space, http.StatusOK},
+		//Owners whose login provider withholds exec get no shell either
+		{"owner without", unexecutable, http.StatusUnauthorized},
+		{"exec admin", space, http.StatusOK},
+		//Admins that may only pause and resume spaces cannot run anything in them
+		{"update admin", space, http.StatusUnauthorized},
+		{"admin only", space, http.StatusUnauthorized},
+		{"user with exec", space, http.StatusUnauthorized},
+		{"user without it", space, http.StatusUnauthorized},
+		{"exec admin", Space{ID: 999}, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		status := serveAsUser(users[test.user], test.space.ID, func(w http.ResponseWriter, r *http.Request, user *auth.User) {
+			_, status, _ := getExecSpaceFromRequest(r, user)
+			w.WriteHeader(status)
+		})
+		if status != test.status {
+			t.Errorf("%s on space %d: expected %d, got %d", test.user, test.space.ID, test.status, status)
+		}
+	}
+}
+
+func TestCheckTerminalOrigin(t *testing.T) {
+	viper.Set("ApiHost", "userspace.example.edu")
+	defer viper.Set("ApiHost", nil)
+	tests := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"", true},
+		{"https://userspace.example.edu", true},
+		{"https://USERSPACE.example.edu:8080", true},
+		{"https://evil.example.com", false},
+		{"https://userspace.example.edu.evil.example.com", false},
+		{"null", false},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest("GET", "/api/v1/space/1/terminal", nil)
+		if test.origin != "" {
+			request.Header.Set("Origin", test.origin)
+		}
+		if allowed := checkTerminalOrigin(request); allowed != test.allowed {
+			t.Errorf("Origin %q: expected allowed to be %t", test.origin, test.allowed)
+		}
+	}
+}
+
+func TestGetTerminalAPIHandlerRejectsRequests(t *testing.T) {
+	db := newTestDatabase(t)
+	useTestAuthProvider(t, db)
+	viper.Set("ApiHost", "userspace.example.edu")
+	defer viper.Set("ApiHost", nil)
+	tests := []struct {
+		name   string
+		path   string
+		origin string
+		status int
+	}{
+		{"no token", "/api/v1/space/1/terminal", "", http.StatusUnauthorized},
+		{"unknown token", "/api/v1/space/1/terminal?token=nope", "", http.StatusUnauthorized},
+		{"other origin", "/api/v1/space/1/terminal?token=nope", "https://evil.example.com", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest("GET", test.path, nil)
+		if test.origin != "" {
+			request.Header.Set("Origin", test.origin)
+		}
+		recorder := httptest.NewRecorder()
+		getTerminalAPIHandler(recorder, request)
+		if recorder.Code != test.status {
+			t.Errorf("%s: expected %d, got %d", test.name, test.status, recorder.Code)
+		}
+	}
+}
+
+func TestServeTerminalOnlyResumesIdleSpaces(t *testing.T) {
+	db, users := setUpExecPermissionTest(t)
+	host := startTestDockerHost(t, "172.17.0.2")
+	idle := Space{OwnerID: users["owner"].ID, HostID: host.ID, ContainerID: "container", SpaceState: "paused", PausedByLifecycle: true}
+	db.Create(&idle)
+	paused := Space{OwnerID: users["owner"].ID, HostID: host.ID, ContainerID: "container", SpaceState: "paused"}
+	db.Create(&paused)
+
+	//The test host cannot start execs so the terminal fails once the space is running
+	status := serveAsUser(users["owner"], idle.ID, serveTerminal)
+	db.First(&idle, idle.ID)
+	if idle.SpaceState != "running" {
+		t.Errorf("Idle space was not resumed (%d): %s", status, idle.SpaceState)
+	}
+	status = serveAsUser(users["owner"], paused.ID, serveTerminal)
+	db.First(&paused, paused.ID)
+	if status != http.StatusConflict || paused.SpaceState != "paused" {
+		t.Errorf("Space paused by its owner gave %d and is %s", status, paused.SpaceState)
+	}
+	//Nothing is resumed for users that may not open a terminal
+	db.Model(&Space{ID: idle.ID}).Updates(map[string]interface{}{"space_state": "paused", "paused_by_lifecycle": true})
+	status = serveAsUser(users["update admin"], idle.ID, serveTerminal)
+	db.First(&idle, idle.ID)
+	if status != http.StatusUnauthorized || idle.SpaceState != "paused" {
+		t.Errorf("Terminal without exec permission gave %d and left the space %s", status, idle.SpaceState)
+	}
+}
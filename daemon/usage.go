@@ -0,0 +1,291 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package userspaced
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/jinzhu/gorm"
+)
+
+var lastUsageReportID int64
+var usageReportIDLock sync.Mutex
+
+//startUsageCollector Periodically records a usage report for every space
+func startUsageCollector(db *gorm.DB) {
+	var maxReportID sql.NullInt64
+	err := db.Model(&SpaceUsageReport{}).Select("max(report_id)").Row().Scan(&maxReportID)
+	if err != nil {
+		log.Criticalf("Error reading last usage report ID, usage will not be collected: %s\n", err.Error())
+		return
+	}
+	lastUsageReportID = maxReportID.Int64
+
+	interval := getClampedInterval("UsageCollectionIntervalSeconds", minLoopInterval)
+	log.Infof("Usage Collector Started. Collecting every %s\n", interval)
+	for true {
+		collectUsageReports(db)
+		time.Sleep(interval)
+	}
+}
+
+//collectUsageReports Records a usage report for every space that has a container
+func collectUsageReports(db *gorm.DB) {
+	var spaces []Space
+	db.Where("space_state IN (?)", []string{"running", "paused"}).Find(&spaces)
+	for _, space := range spaces {
+		report, err := createUsageReport(db, space)
+		if err != nil {
+			log.Warningf("Failed to collect usage of Space %s(%d): %s\n", space.FriendlyName, space.ID, err.Error())
+			continue
+		}
+		recordSpaceUsageMetrics(report)
+		log.Debugf("Recorded usage report %d for Space %s(%d)\n", report.ReportID, space.FriendlyName, space.ID)
+	}
+}
+
+//nextUsageReportID Returns the ID for a new report. IDs only ever increase.
+func nextUsageReportID() int64 {
+	usageReportIDLock.Lock()
+	defer usageReportIDLock.Unlock()
+	lastUsageReportID++
+	return lastUsageReportID
+}
+
+//createUsageReport Reads the stats of a space's container and stores them as a new report.
+//Docker resets its counters when a container restarts so the report adds the increase since the last
+//report to the totals of the last report instead of storing the counters directly.
+func createUsageReport(db *gorm.DB, space Space) (*SpaceUsageReport, error) {
+	dockerHost := getHostByID(space.HostID)
+	dockerClient, connected := getHostClient(dockerHost)
+	if !connected {
+		return nil, errors.New("Host of space is not connected")
+	}
+	container, err := dockerClient.InspectContainerWithOptions(docker.InspectContainerOptions{ID: space.ContainerID, Size: true})
+	if err != nil {
+		return nil, err
+	}
+	stats, err := getContainerStats(dockerClient, space.ContainerID)
+	if err != nil {
+		return nil, err
+	}
+
+	report := SpaceUsageReport{
+		SpaceID:            space.ID,
+		OwnerID:            space.OwnerID,
+		HostID:             space.HostID,
+		ContainerID:        space.ContainerID,
+		DiskUsageBytes:     container.SizeRw,
+		MemoryUsageBytes:   int64(stats.MemoryStats.Usage),
+		SSHSessionCount:    space.SSHSessionsIn,
+		Timestamp:          time.Now(),
+		ContainerStartedAt: container.State.StartedAt,
+		RawCPUTime:         int64(stats.CPUStats.CPUUsage.TotalUsage),
+	}
+	for _, network := range stats.Networks {
+		report.RawNetworkIn += int64(network.RxBytes)
+		report.RawNetworkOut += int64(network.TxBytes)
+	}
+	for _, entry := range stats.BlkioStats.IOServiceBytesRecursive {
+		switch strings.ToLower(entry.Op) {
+		case "read":
+			report.RawBlockRead += int64(entry.Value)
+		case "write":
+			report.RawBlockWrite += int64(entry.Value)
+		}
+	}
+
+	var previous SpaceUsageReport
+	if db.Where("space_id = ?", space.ID).Order("report_id desc").First(&previous).RecordNotFound() {
+		previous = SpaceUsageReport{}
+	}
+	//A different container or start time means the counters started over
+	reset := previous.ContainerID != report.ContainerID || !previous.ContainerStartedAt.Equal(report.ContainerStartedAt)
+	report.NetworkInBytes = previous.NetworkInBytes + getCounterIncrease(previous.RawNetworkIn, report.RawNetworkIn, reset)
+	report.NetworkOutBytes = previous.NetworkOutBytes + getCounterIncrease(previous.RawNetworkOut, report.RawNetworkOut, reset)
+	report.BlockReadBytes = previous.BlockReadBytes + getCounterIncrease(previous.RawBlockRead, report.RawBlockRead, reset)
+	report.BlockWriteBytes = previous.BlockWriteBytes + getCounterIncrease(previous.RawBlockWrite, report.RawBlockWrite, reset)
+	report.CPUTimeNanos = previous.CPUTimeNanos + getCounterIncrease(previous.RawCPUTime, report.RawCPUTime, reset)
+
+	report.ReportID = nextUsageReportID()
+	err = db.Create(&report).Error
+	if err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+//getCounterIncrease Returns how much a counter grew since it was last read.
+//If the counter was reset everything it counted since is new.
+func getCounterIncrease(previous int64, current int64, reset bool) int64 {
+	if reset || current < previous {
+		return current
+	}
+	return current - previous
+}
+
+//getContainerStats Reads a single set of stats for a container
+func getContainerStats(client *docker.Client, containerID string) (*docker.Stats, error) {
+	statsChan := make(chan *docker.Stats, 1)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- client.Stats(docker.StatsOptions{
+			ID:      containerID,
+			Stats:   statsChan,
+			Stream:  false,
+			Timeout: 30 * time.Second,
+		})
+	}()
+	stats, ok := <-statsChan
+	err := <-errChan
+	if !ok {
+		if err == nil {
+			err = errors.New("Docker returned no stats")
+		}
+		return nil, err
+	}
+	return stats, nil
+}
+
+//getUsageDelta Returns how much usage grew from one report to a later one
+func getUsageDelta(start SpaceUsageReport, end SpaceUsageReport) UsageDelta {
+	return UsageDelta{
+		DiskUsageBytes:  end.DiskUsageBytes - start.DiskUsageBytes,
+		NetworkInBytes:  end.NetworkInBytes - start.NetworkInBytes,
+		NetworkOutBytes: end.NetworkOutBytes - start.NetworkOutBytes,
+		BlockReadBytes:  end.BlockReadBytes - start.BlockReadBytes,
+		BlockWriteBytes: end.BlockWriteBytes - start.BlockWriteBytes,
+		CPUTimeNanos:    end.CPUTimeNanos - start.CPUTimeNanos,
+		SSHSessions:     end.SSHSessionCount - start.SSHSessionCount,
+	}
+}
+
+//addUsageDelta Adds the usage in one delta to another
+func addUsageDelta(total *UsageDelta, delta UsageDelta) {
+	total.DiskUsageBytes += delta.DiskUsageBytes
+	total.NetworkInBytes += delta.NetworkInBytes
+	total.NetworkOutBytes += delta.NetworkOutBytes
+	total.BlockReadBytes += delta.BlockReadBytes
+	total.BlockWriteBytes += delta.BlockWriteBytes
+	total.CPUTimeNanos += delta.CPUTimeNanos
+	total.SSHSessions += delta.SSHSessions
+}
+
+//getUsageReportsInRange Returns the last report of a space from before the range, if there is one, followed by the reports in the range
+func getUsageReportsInRange(db *gorm.DB, spaceID uint, from time.Time, to time.Time) ([]SpaceUsageReport, error) {
+	reports := []SpaceUsageReport{}
+	var baseline SpaceUsageReport
+	query := db.Where("space_id = ? AND timestamp <= ?", spaceID, from).Order("report_id desc").First(&baseline)
+	if query.Error != nil && !query.RecordNotFound() {
+		return reports, query.Error
+	}
+	if !query.RecordNotFound() {
+		reports = append(reports, baseline)
+	}
+	var inRange []SpaceUsageReport
+	err := db.Where("space_id = ? AND timestamp > ? AND timestamp <= ?", spaceID, from, to).Order("report_id asc").Find(&inRange).Error
+	if err != nil {
+		return reports, err
+	}
+	return append(reports, inRange...), nil
+}
+
+//getSpaceUsageHistory Splits a time range into steps and returns how much the usage of a space grew in each step.
+//A step is measured from the last report before it starts to the last report before it ends. If the space has no
+//report before the step starts the first report in the step is used instead.
+func getSpaceUsageHistory(db *gorm.DB, spaceID uint, from time.Time, to time.Time, step time.Duration) ([]UsageDelta, error) {
+	history := []UsageDelta{}
+	reports, err := getUsageReportsInRange(db, spaceID, from, to)
+	if err != nil {
+		return history, err
+	}
+
+	next := 0
+	var last *SpaceUsageReport
+	for stepStart := from; stepStart.Before(to); stepStart = stepStart.Add(step) {
+		stepEnd := stepStart.Add(step)
+		if stepEnd.After(to) {
+			stepEnd = to
+		}
+		start := last
+		for next < len(reports) && !reports[next].Timestamp.After(stepEnd) {
+			if start == nil {
+				start = &reports[next]
+			}
+			last = &reports[next]
+			next++
+		}
+
+		delta := UsageDelta{}
+		if start != nil {
+			delta = getUsageDelta(*start, *last)
+		}
+		delta.From = stepStart
+		delta.To = stepEnd
+		history = append(history, delta)
+	}
+	return history, nil
+}
+
+//getUsageAggregates Returns the combined usage in a time range of the spaces of every user or every host.
+//groupBy is either user or host.
+func getUsageAggregates(db *gorm.DB, from time.Time, to time.Time, groupBy string) ([]UsageAggregate, error) {
+	aggregates := []UsageAggregate{}
+	var spaceIDs []uint
+	err := db.Model(&SpaceUsageReport{}).Where("timestamp > ? AND timestamp <= ?", from, to).Pluck("DISTINCT space_id", &spaceIDs).Error
+	if err != nil {
+		return aggregates, err
+	}
+
+	groups := make(map[uint]*UsageAggregate)
+	for _, spaceID := range spaceIDs {
+		reports, err := getUsageReportsInRange(db, spaceID, from, to)
+		if err != nil {
+			return aggregates, err
+		}
+		last := reports[len(reports)-1]
+		key := last.OwnerID
+		if groupBy == "host" {
+			key = last.HostID
+		}
+		aggregate, exists := groups[key]
+		if !exists {
+			aggregate = &UsageAggregate{Usage: UsageDelta{From: from, To: to}}
+			if groupBy == "host" {
+				aggregate.HostID = key
+			} else {
+				aggregate.UserID = key
+			}
+			groups[key] = aggregate
+		}
+		aggregate.Spaces++
+		addUsageDelta(&aggregate.Usage, getUsageDelta(reports[0], last))
+	}
+	for _, aggregate := range groups {
+		aggregates = append(aggregates, *aggregate)
+	}
+	sort.Slice(aggregates, func(i, j int) bool {
+		return aggregates[i].UserID+aggregates[i].HostID < aggregates[j].UserID+aggregates[j].HostID
+	})
+	return aggregates, nil
+}
@@ -0,0 +1,167 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package userspaced
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+func TestGetCounterIncrease(t *testing.T) {
+	tests := []struct {
+		name     string
+		previous int64
+		current  int64
+		reset    bool
+		want     int64
+	}{
+		{"monotonic", 100, 150, false, 50},
+		{"unchanged", 100, 100, false, 0},
+		//The first report of a space has nothing before it, so the counter is all new
+		{"first sample", 0, 150, true, 150},
+		//The container was restarted and counted past the old value before the next report
+		{"restart", 100, 150, true, 150},
+		//A restart that was not noticed shows as a counter going backwards
+		{"counter went down", 100, 30, false, 30},
+		{"restart with nothing counted", 100, 0, true, 0},
+	}
+	for _, test := range tests {
+		if increase := getCounterIncrease(test.previous, test.current, test.reset); increase != test.want {
+			t.Errorf("%s: expected an increase of %d, got %d", test.name, test.want, increase)
+		}
+	}
+}
+
+//seedTestUsageReports Stores reports for three spaces, counting minutes from base. Space 1 has a report at base.
+func seedTestUsageReports(t *testing.T, base time.Time) *gorm.DB {
+	db := newTestDatabase(t)
+	reports := []struct {
+		spaceID uint
+		ownerID uint
+		hostID  uint
+		minutes int
+		cpu     int64
+	}{
+		{1, 1, 1, 0, 0},
+		{2, 1, 2, 30, 10},
+		{1, 1, 1, 30, 100},
+		{3, 2, 1, 60, 5},
+		{1, 1, 1, 90, 300},
+		{3, 2, 1, 120, 25},
+		{1, 1, 1, 150, 600},
+		{2, 1, 2, 150, 50},
+		//After the ranges that are queried
+		{1, 1, 1, 300, 5000},
+	}
+	for i, report := range reports {
+		db.Create(&SpaceUsageReport{
+			ReportID:     int64(i + 1),
+			SpaceID:      report.spaceID,
+			OwnerID:      report.ownerID,
+			HostID:       report.hostID,
+			Timestamp:    base.Add(time.Duration(report.minutes) * time.Minute),
+			CPUTimeNanos: report.cpu,
+		})
+	}
+	return db
+}
+
+func TestGetSpaceUsageHistory(t *testing.T) {
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	db := seedTestUsageReports(t, base)
+	tests := []struct {
+		name    string
+		spaceID uint
+		from    time.Time
+		to      time.Time
+		cpu     []int64
+	}{
+		//The report at the start of the range is the baseline of the first step
+		{"baseline", 1, base, base.Add(3 * time.Hour), []int64{100, 200, 300}},
+		//Without a report before the range, usage is counted from the first report in it
+		{"no baseline", 2, base, base.Add(3 * time.Hour), []int64{0, 0, 40}},
+		//The last step ends with the range
+		{"partial step", 1, base, base.Add(150 * time.Minute), []int64{100, 200, 300}},
+		{"no reports", 1, base.Add(-3 * time.Hour), base.Add(-time.Hour), []int64{0, 0}},
+		{"after the last report", 3, base.Add(3 * time.Hour), base.Add(4 * time.Hour), []int64{0}},
+	}
+	for _, test := range tests {
+		history, err := getSpaceUsageHistory(db, test.spaceID, test.from, test.to, time.Hour)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+		if len(history) != len(test.cpu) {
+			t.Errorf("%s: expected %d steps, got %d", test.name, len(test.cpu), len(history))
+			continue
+		}
+		for i, delta := range history {
+			if delta.CPUTimeNanos != test.cpu[i] {
+				t.Errorf("%s: step %d used %d, want %d", test.name, i, delta.CPUTimeNanos, test.cpu[i])
+			}
+			if !delta.From.Equal(test.from.Add(time.Duration(i) * time.Hour)) {
+				t.Errorf("%s: step %d starts at %s", test.name, i, delta.From)
+			}
+		}
+		if last := history[len(history)-1]; !last.To.Equal(test.to) {
+			t.Errorf("%s: last step ends at %s, want %s", test.name, last.To, test.to)
+		}
+	}
+}
+
+func TestGetUsageAggregates(t *testing.T) {
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	db := seedTestUsageReports(t, base)
+	tests := []struct {
+		groupBy    string
+		aggregates []UsageAggregate
+	}{
+		{"user", []UsageAggregate{
+			{UserID: 1, Spaces: 2, Usage: UsageDelta{CPUTimeNanos: 640}},
+			{UserID: 2, Spaces: 1, Usage: UsageDelta{CPUTimeNanos: 20}},
+		}},
+		{"host", []UsageAggregate{
+			{HostID: 1, Spaces: 2, Usage: UsageDelta{CPUTimeNanos: 620}},
+			{HostID: 2, Spaces: 1, Usage: UsageDelta{CPUTimeNanos: 40}},
+		}},
+	}
+	for _, test := range tests {
+		aggregates, err := getUsageAggregates(db, base, base.Add(3*time.Hour), test.groupBy)
+		if err != nil {
+			t.Errorf("%s: %s", test.groupBy, err.Error())
+			continue
+		}
+		if len(aggregates) != len(test.aggregates) {
+			t.Errorf("%s: expected %d groups, got %+v", test.groupBy, len(test.aggregates), aggregates)
+			continue
+		}
+		for i, aggregate := range aggregates {
+			want := test.aggregates[i]
+			if aggregate.UserID != want.UserID || aggregate.HostID != want.HostID || aggregate.Spaces != want.Spaces ||
+				aggregate.Usage.CPUTimeNanos != want.Usage.CPUTimeNanos {
+				t.Errorf("%s: group %d is %+v, want %+v", test.groupBy, i, aggregate, want)
+			}
+		}
+	}
+	//A later range is measured from the last report before it
+	aggregates, err := getUsageAggregates(db, base.Add(4*time.Hour), base.Add(6*time.Hour), "user")
+	if err != nil || len(aggregates) != 1 || aggregates[0].Spaces != 1 || aggregates[0].Usage.CPUTimeNanos != 4400 {
+		t.Errorf("Aggregates after the range = %+v, %v", aggregates, err)
+	}
+}
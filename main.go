@@ -1,7 +1,15 @@
 package main
 
-import "github.com/twa16/userspace/daemon"
+import (
+	"os"
+
+	"github.com/twa16/userspace/daemon"
+)
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "reset-admin-password" {
+		userspaced.ResetAdminPassword()
+		return
+	}
 	userspaced.Init()
 }